@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Modes of acquisition, on polling each frame is requested to the firmware and
+// on streaming the firmware pushes frames continuously
+const (
+	pollingAcquisition   = "polling"
+	streamingAcquisition = "streaming"
+)
+
+const (
+	streamStartCommand         = "!"
+	streamStopCommand          = "#"
+	defaultStreamingRate       = 1000 // Hz
+	defaultStreamingBaudRate   = 1000000
+	streamBufferSize           = 4096
+	sampleRingSize             = 4096 // About 4 s on streaming
+	consumerPollingInterval    = time.Millisecond
+	discardedFramesLogInterval = time.Second * 10
+)
+
+// Sample is a frame read from serial, as received and filtered
+type Sample struct {
+	Seq      uint64    // Position since acquisition started
+	Time     time.Time // When it was received
+	Raw      []float64
+	Filtered []float64
+}
+
+// SampleRing keeps the last samples acquired. There must be only one goroutine
+// pushing, but any number of goroutines can read without locking, each one
+// at its own rate. Samples are never modified after pushed
+type SampleRing struct {
+	slots   []atomic.Value
+	written uint64 // Samples pushed, accessed atomically
+}
+
+func newSampleRing(size int) *SampleRing {
+	return &SampleRing{slots: make([]atomic.Value, size)}
+}
+
+// Push a new sample, overwriting the oldest one when full
+func (ring *SampleRing) Push(sample *Sample) {
+	seq := atomic.LoadUint64(&ring.written)
+
+	sample.Seq = seq
+	ring.slots[seq%uint64(len(ring.slots))].Store(sample)
+
+	atomic.StoreUint64(&ring.written, seq+1)
+}
+
+// Latest sample pushed, nil if there is none
+func (ring *SampleRing) Latest() *Sample {
+	written := atomic.LoadUint64(&ring.written)
+	if written == 0 {
+		return nil
+	}
+	return ring.slots[(written-1)%uint64(len(ring.slots))].Load().(*Sample)
+}
+
+// Reader of samples pushed from now on
+func (ring *SampleRing) Reader() *RingReader {
+	return &RingReader{ring: ring, next: atomic.LoadUint64(&ring.written)}
+}
+
+// RingReader reads samples in order, skipping the ones overwritten
+// before being read
+type RingReader struct {
+	ring    *SampleRing
+	next    uint64
+	dropped uint64
+}
+
+// Next sample not read yet, false if there is none
+func (reader *RingReader) Next() (*Sample, bool) {
+	written := atomic.LoadUint64(&reader.ring.written)
+	if reader.next >= written {
+		return nil, false
+	}
+
+	size := uint64(len(reader.ring.slots))
+	if written-reader.next > size {
+		reader.dropped += written - size - reader.next
+		reader.next = written - size
+	}
+
+	sample := reader.ring.slots[reader.next%size].Load().(*Sample)
+	if sample.Seq != reader.next { // Overwritten while reading
+		reader.dropped += sample.Seq - reader.next
+	}
+	reader.next = sample.Seq + 1
+
+	return sample, true
+}
+
+// Filters a frame and makes it available to consumers of the bench
+func (bench *Bench) acquire(frame []float64, received time.Time) {
+	bench.samples.Push(&Sample{Time: received, Raw: frame, Filtered: bench.filterFrame(frame)})
+}
+
+// Parses a line of the frame as sent by the firmware, nil if it's invalid
+func parseLine(line string) []float64 {
+	split := strings.Split(strings.TrimSpace(line), ",")
+	if len(split) != numSerialAttrs {
+		return nil
+	}
+
+	frame, err := parseFrame(split)
+	if err != nil {
+		return nil
+	}
+	return frame
+}
+
+// Reads frames pushed by the firmware until stop is closed, closing done at the end
+func (bench *Bench) streamFrames(stop, done chan bool) {
+	defer close(done)
+
+	bench.port.Write([]byte(streamStartCommand))
+	defer bench.port.Write([]byte(streamStopCommand))
+
+	var (
+		buf        = make([]byte, streamBufferSize)
+		pending    []byte
+		discarded  int
+		lastLogged = time.Now()
+	)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		n, err := bench.port.Read(buf)
+		received := time.Now()
+		if err != nil {
+			time.Sleep(getReadingDelay())
+			continue
+		}
+
+		pending = append(pending, buf[:n]...)
+		for end := bytes.IndexByte(pending, '\n'); end >= 0; end = bytes.IndexByte(pending, '\n') {
+			if frame := parseLine(string(pending[:end])); frame != nil {
+				bench.acquire(frame, received)
+			} else {
+				discarded++
+				discardedFramesMetric.WithLabelValues(bench.name).Inc()
+			}
+			pending = pending[end+1:]
+		}
+
+		if len(pending) > streamBufferSize { // No line end, out of sync
+			pending = nil
+			discarded++
+			discardedFramesMetric.WithLabelValues(bench.name).Inc()
+		}
+
+		if discarded > 0 && time.Since(lastLogged) > discardedFramesLogInterval {
+			bench.logger().WithField("frames", discarded).Warn("Invalid frames discarded from stream")
+			bench.journal.fault(EventData{"frames": discarded}, "Quadros inválidos descartados")
+			discarded, lastLogged = 0, time.Now()
+		}
+	}
+}
+
+// Starts reading frames pushed by the firmware, returns a function which stops it
+func (bench *Bench) startStreaming() func() {
+	stop, done := make(chan bool), make(chan bool)
+	go bench.streamFrames(stop, done)
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Acquires data in background until the returned function is called, for
+// when data is needed out of the collecting routine
+func (bench *Bench) acquireInBackground() func() {
+	bench.startDispatching()
+
+	if isStreaming() {
+		return bench.startStreaming()
+	}
+
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				bench.getData("\"")
+				time.Sleep(getReadingDelay())
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// Logs filtered values at the rate of publishing
+func (bench *Bench) logSamples() {
+	subscription := bench.sampleBus.Subscribe("log", dropOldestPolicy, 1, getPublishDecimation)
+
+	for sample := range subscription.C {
+		var out []string
+		for _, value := range sample.Filtered {
+			out = append(out, strconv.FormatFloat(value, 'f', 2, 64))
+		}
+
+		bench.logger().WithField("values", strings.Join(out, ",")).Debug("Reading")
+	}
+}
+
+func isStreaming() bool {
+	config := getConfig()
+	return config.isStreaming()
+}
+
+// Rate of acquisition, in Hz
+func getSampleRate() int {
+	config := getConfig()
+	return config.sampleRate()
+}
+
+func getBaudRate() int {
+	config := getConfig()
+	if config.isStreaming() {
+		return config.StreamingBaudRate
+	}
+	return config.BaudRate
+}
+
+func (config *ConfigFile) isStreaming() bool {
+	return config.AcquisitionMode == streamingAcquisition
+}
+
+func (config *ConfigFile) sampleRate() int {
+	if config.isStreaming() {
+		return config.StreamingRate
+	}
+	return config.ReadingFrequency
+}
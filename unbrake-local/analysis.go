@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	mqttSubchannelAnalysis      = "/analysis"
+	analysisFileName            = "analysis.json"
+	frictionTemperatureBinWidth = 50.0 // °C
+)
+
+// Phases are identified by their names
+const (
+	baselinePhaseName = "baseline"
+	fadePhaseName     = "fade"
+	recoveryPhaseName = "recovery"
+)
+
+// FrictionStatistics of a group of snubs
+type FrictionStatistics struct {
+	Snubs  int     `json:"snubs"`
+	Mean   float64 `json:"mean"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"std_dev"`
+}
+
+// PhaseAnalysis summarizes the snubs of a phase
+type PhaseAnalysis struct {
+	Name            string             `json:"name"`
+	Friction        FrictionStatistics `json:"friction"`
+	MeanMFDD        float64            `json:"mean_mfdd"`
+	PeakTemperature float64            `json:"peak_temperature"`
+}
+
+// FrictionTemperaturePoint is the mean µ of snubs whose initial
+// temperature is in [Temperature, Temperature + bin width)
+type FrictionTemperaturePoint struct {
+	Temperature float64 `json:"temperature"`
+	Friction    float64 `json:"friction"`
+	Snubs       int     `json:"snubs"`
+}
+
+// ExperimentAnalysis is the fade and recovery analysis of a whole experiment
+type ExperimentAnalysis struct {
+	Snubs                 int                        `json:"snubs"`
+	Friction              FrictionStatistics         `json:"friction"`
+	BaselineFriction      float64                    `json:"baseline_friction"`
+	Fade                  float64                    `json:"fade"`     // %, drop of µ relative to baseline
+	Recovery              float64                    `json:"recovery"` // %, µ after recovery relative to baseline
+	FrictionByTemperature []FrictionTemperaturePoint `json:"friction_by_temperature"`
+	TotalEnergy           float64                    `json:"total_energy"`           // J, proxy of pad wear
+	TotalBrakingTime      float64                    `json:"total_braking_time"`     // s
+	TotalBrakingDistance  float64                    `json:"total_braking_distance"` // m
+	Phases                []PhaseAnalysis            `json:"phases"`
+}
+
+func frictionStatistics(metrics []SnubMetrics) FrictionStatistics {
+	statistics := FrictionStatistics{Snubs: len(metrics)}
+	if len(metrics) == 0 {
+		return statistics
+	}
+
+	statistics.Min, statistics.Max = math.Inf(1), math.Inf(-1)
+	for _, snub := range metrics {
+		statistics.Mean += snub.Friction
+		statistics.Min = math.Min(statistics.Min, snub.Friction)
+		statistics.Max = math.Max(statistics.Max, snub.Friction)
+	}
+	statistics.Mean /= float64(len(metrics))
+
+	for _, snub := range metrics {
+		statistics.StdDev += (snub.Friction - statistics.Mean) * (snub.Friction - statistics.Mean)
+	}
+	statistics.StdDev = math.Sqrt(statistics.StdDev / float64(len(metrics)))
+
+	return statistics
+}
+
+// Snubs of phases whose name contains the given one
+func snubsOfPhase(metrics []SnubMetrics, name string) []SnubMetrics {
+	var snubs []SnubMetrics
+	for _, snub := range metrics {
+		if strings.Contains(strings.ToLower(snub.Phase), name) {
+			snubs = append(snubs, snub)
+		}
+	}
+	return snubs
+}
+
+// Analyzes the metrics of all snubs of an experiment. Baseline is the phase named
+// baseline or, if there is none, the first phase. Fade and recovery are computed
+// only if there are phases named like that
+func analyzeExperiment(metrics []SnubMetrics) ExperimentAnalysis {
+	analysis := ExperimentAnalysis{
+		Snubs:    len(metrics),
+		Friction: frictionStatistics(metrics),
+	}
+
+	if len(metrics) == 0 {
+		return analysis
+	}
+
+	var phaseNames []string
+	phases := map[string][]SnubMetrics{}
+	for _, snub := range metrics {
+		if _, exists := phases[snub.Phase]; !exists {
+			phaseNames = append(phaseNames, snub.Phase)
+		}
+		phases[snub.Phase] = append(phases[snub.Phase], snub)
+
+		analysis.TotalEnergy += snub.Energy
+		analysis.TotalBrakingTime += snub.StoppingTime
+		analysis.TotalBrakingDistance += snub.StoppingDistance
+	}
+
+	for _, name := range phaseNames {
+		phase := PhaseAnalysis{Name: name, Friction: frictionStatistics(phases[name])}
+		for _, snub := range phases[name] {
+			phase.MeanMFDD += snub.MFDD / float64(len(phases[name]))
+			phase.PeakTemperature = math.Max(phase.PeakTemperature, snub.PeakTemperature)
+		}
+		analysis.Phases = append(analysis.Phases, phase)
+	}
+
+	baseline := snubsOfPhase(metrics, baselinePhaseName)
+	if len(baseline) == 0 {
+		baseline = phases[phaseNames[0]]
+	}
+	analysis.BaselineFriction = frictionStatistics(baseline).Mean
+
+	if analysis.BaselineFriction > 0 {
+		if fade := snubsOfPhase(metrics, fadePhaseName); len(fade) > 0 {
+			analysis.Fade = (analysis.BaselineFriction - frictionStatistics(fade).Min) / analysis.BaselineFriction * 100
+		}
+
+		if recovery := snubsOfPhase(metrics, recoveryPhaseName); len(recovery) > 0 {
+			last := recovery[len(recovery)-1]
+			analysis.Recovery = last.Friction / analysis.BaselineFriction * 100
+		}
+	}
+
+	bins := map[float64]*FrictionTemperaturePoint{}
+	for _, snub := range metrics {
+		temperature := math.Floor(snub.InitialTemperature/frictionTemperatureBinWidth) * frictionTemperatureBinWidth
+		if bins[temperature] == nil {
+			bins[temperature] = &FrictionTemperaturePoint{Temperature: temperature}
+		}
+		bins[temperature].Friction += snub.Friction
+		bins[temperature].Snubs++
+	}
+
+	for _, point := range bins {
+		point.Friction /= float64(point.Snubs)
+		analysis.FrictionByTemperature = append(analysis.FrictionByTemperature, *point)
+	}
+	sort.Slice(analysis.FrictionByTemperature, func(i, j int) bool {
+		return analysis.FrictionByTemperature[i].Temperature < analysis.FrictionByTemperature[j].Temperature
+	})
+
+	return analysis
+}
+
+// Reads the metrics of snubs stored during an experiment
+func readSnubMetrics(filePath string) ([]SnubMetrics, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var metrics []SnubMetrics
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var snub SnubMetrics
+		if err = json.Unmarshal(scanner.Bytes(), &snub); err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		metrics = append(metrics, snub)
+	}
+
+	return metrics, scanner.Err()
+}
+
+// Analyzes the experiment just finished, publishing and storing the result
+func (experiment *Experiment) analyze() {
+	folder := getExperimentFolder(experiment.id)
+
+	metrics, err := readSnubMetrics(path.Join(folder, snubMetricsFileName))
+	if err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to read snub metrics for analysis")
+		return
+	}
+
+	data, err := json.Marshal(analyzeExperiment(metrics))
+	if err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to encode analysis")
+		return
+	}
+
+	experiment.bench.publishData(string(data), mqttSubchannelAnalysis)
+	experiment.logger().WithField("analysis", string(data)).Info("Experiment analyzed")
+
+	if err = ioutil.WriteFile(path.Join(folder, analysisFileName), data, 0666); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to store analysis")
+	}
+}
+
+// Analysis by command line of a recorded experiment, given its id or the file of metrics
+func runAnalyzeCommandLine(args []string) bool {
+	if len(args) != 1 {
+		fmt.Println("Uso: unbrake-local analyze <id do ensaio|arquivo de snubs>")
+		return false
+	}
+
+	filePath := args[0]
+	if id, err := strconv.Atoi(args[0]); err == nil {
+		filePath = path.Join(getExperimentFolder(id), snubMetricsFileName)
+	}
+
+	metrics, err := readSnubMetrics(filePath)
+	if err != nil {
+		fmt.Println("Não foi possível ler as métricas: ", err)
+		return false
+	}
+
+	data, _ := json.MarshalIndent(analyzeExperiment(metrics), "", "  ")
+	fmt.Println(string(data))
+
+	return false
+}
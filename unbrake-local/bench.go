@@ -0,0 +1,312 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/getlantern/systray"
+	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBenchName = "principal"
+	benchField       = "bench"
+)
+
+// BenchConfig is a bench besides the main one, set on configuration file
+type BenchConfig struct {
+	Name              string // Letters, numbers, - and _
+	SerialPort        string
+	MqttChannelPrefix string // Empty is the prefix of the main bench followed by /<name>
+}
+
+// Prefix of the MQTT channels of the bench, given the one of the main bench
+func (config *BenchConfig) mqttChannelPrefix(mainPrefix string) string {
+	if config.MqttChannelPrefix != "" {
+		return config.MqttChannelPrefix
+	}
+	return mainPrefix + "/" + config.Name
+}
+
+func isValidBenchName(name string) bool {
+	for _, letter := range name {
+		if !unicode.IsLetter(letter) && !unicode.IsDigit(letter) && letter != '-' && letter != '_' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Bench is a brake test bench driven by the agent. Each one has its own
+// serial port, samples, experiment and MQTT channels, so several benches
+// run experiments at the same time independently
+type Bench struct {
+	name              string
+	config            BenchConfig
+	isMain            bool // Set by the top level of configuration
+	port              Port
+	serialPortNameCh  chan string
+	firmwareBanner    string // Identification sent by the firmware when the port is selected, it has no version
+	firmwareBannerMux sync.Mutex
+	samples           *SampleRing
+	sampleBus         SampleBus
+	dispatchOnce      sync.Once
+	filters           atomic.Value // []FilterPipeline by index, replaced as a whole when configuration changes
+	isAvailable       bool
+	activeCalibration *Calibration // Calibration of last experiment, used for publishing
+	calibrationMux    sync.Mutex
+	maintenance       Maintenance
+	wizard            CalibrationWizard
+	queue             ExperimentQueue
+	journal           Journal
+
+	quitExperimentCh    chan bool
+	idRunningExperiment chan int
+	statusCh            chan string // Status shown on GUI
+	quitEnableCh        chan bool   // Enables quitting experiment on GUI
+	resumeEnableCh      chan bool   // Enables resuming experiment on GUI
+}
+
+func (bench *Bench) setFirmwareBanner(banner string) {
+	bench.firmwareBannerMux.Lock()
+	defer bench.firmwareBannerMux.Unlock()
+
+	bench.firmwareBanner = banner
+}
+
+func (bench *Bench) getFirmwareBanner() string {
+	bench.firmwareBannerMux.Lock()
+	defer bench.firmwareBannerMux.Unlock()
+
+	return bench.firmwareBanner
+}
+
+// Benches driven by the agent, the main one first
+var benches []*Bench
+
+func newBench(config BenchConfig) *Bench {
+	bench := &Bench{
+		name:                config.Name,
+		config:              config,
+		serialPortNameCh:    make(chan string, 1),
+		samples:             newSampleRing(sampleRingSize),
+		isAvailable:         true,
+		quitExperimentCh:    make(chan bool, 1),
+		idRunningExperiment: make(chan int),
+		statusCh:            make(chan string),
+		quitEnableCh:        make(chan bool),
+		resumeEnableCh:      make(chan bool, 1),
+	}
+	bench.port.bench = bench.name
+	bench.maintenance = Maintenance{bench: bench, changedCh: make(chan bool, 1)}
+	bench.wizard = CalibrationWizard{bench: bench}
+	bench.queue = ExperimentQueue{bench: bench, wakeCh: make(chan bool, 1)}
+	bench.journal = Journal{bench: bench}
+	bench.configureFilters()
+
+	return bench
+}
+
+// Creates the benches set on configuration, the main one is set by the
+// parameters of the top level
+func setupBenches() {
+	config := getConfig()
+
+	main := newBench(BenchConfig{Name: config.BenchName, SerialPort: config.SerialPort})
+	main.isMain = true
+
+	benches = []*Bench{main}
+	for _, benchConfig := range config.Benches {
+		benches = append(benches, newBench(benchConfig))
+	}
+}
+
+// Bench set by the parameters of the top level of configuration, also used
+// for what is about the whole agent
+func mainBench() *Bench {
+	return benches[0]
+}
+
+func findBench(name string) *Bench {
+	for _, bench := range benches {
+		if bench.name == name {
+			return bench
+		}
+	}
+	return nil
+}
+
+// Bench which has the serial port open, nil if there is none
+func findBenchByPort(name string) *Bench {
+	for _, bench := range benches {
+		if bench.port.IsOpen() && bench.port.Name() == name {
+			return bench
+		}
+	}
+	return nil
+}
+
+// Bench and serial port given on command line, as the name of a bench or a
+// serial port for the main one. Without it, the main bench on its serial port
+func commandLineBench(arg string) (*Bench, string) {
+	if bench := findBench(arg); bench != nil {
+		return bench, bench.config.SerialPort
+	}
+	if arg != "" {
+		return mainBench(), arg
+	}
+	return mainBench(), mainBench().config.SerialPort
+}
+
+// Claims the bench for an experiment or the maintenance mode, checking and
+// setting it in one step so only one of them gets it. False if it's busy
+func (bench *Bench) reserve() bool {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	if !bench.isAvailable {
+		return false
+	}
+	bench.isAvailable = false
+	return true
+}
+
+// Tells whether the bench can be reserved now, it may not be anymore when
+// reserve is called
+func (bench *Bench) isFree() bool {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	return bench.isAvailable
+}
+
+// Frees the bench claimed by reserve
+func (bench *Bench) release() {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	bench.isAvailable = true
+}
+
+func isAnyBenchBusy() bool {
+	for _, bench := range benches {
+		if !bench.isAvailable {
+			return true
+		}
+	}
+	return false
+}
+
+// Icon shows whether any bench is busy, it's only set once the tray is
+// running, not when run by command line
+func updateIcon() {
+	if atomic.LoadInt32(&isTrayReady) == 0 {
+		return
+	}
+
+	if isAnyBenchBusy() {
+		systray.SetIcon(Icon)
+	} else {
+		systray.SetIcon(IconDisabled)
+	}
+}
+
+// Prefix of the MQTT channels of the bench
+func (bench *Bench) getMqttChannelPrefix() string {
+	if bench.isMain {
+		return getMqttChannelPrefix()
+	}
+	return bench.config.mqttChannelPrefix(getMqttChannelPrefix())
+}
+
+func (bench *Bench) logger() *logrus.Entry {
+	return logger.WithField(benchField, bench.name)
+}
+
+// The main bench keeps the file used before there were several benches
+func (bench *Bench) getCheckpointPath() string {
+	if bench.isMain {
+		return path.Join(appDirs.State, checkpointFileName)
+	}
+	return path.Join(appDirs.State, "checkpoint-"+bench.name+".json")
+}
+
+// Starts acquiring, publishing and receiving experiments and commands
+func (bench *Bench) start() {
+	wgGeneral.Add(1)
+	go bench.CollectData()
+	bench.startDispatching()
+	go bench.logSamples()
+
+	if err := bench.queue.load(); err != nil {
+		bench.logger().WithError(err).Error("Wasn't possible to load queue, starting with it empty")
+	}
+
+	go bench.handleExperimentsReceiving()
+	go bench.handleQueueReceiving()
+	go bench.runQueue()
+	go bench.handleMaintenanceReceiving()
+	go bench.handleCalibrationReceiving()
+	go bench.handleSimulationReceiving()
+
+	bench.subscribeMqtt("/quitExperiment", func(_ *emitter.Client, msg emitter.Message) {
+		go bench.quitExperiment(mqttSource)
+	})
+
+	bench.subscribeMqtt("/resumeExperiment", func(_ *emitter.Client, msg emitter.Message) {
+		bench.logger().Info("Resuming experiment requested by MQTT")
+		go bench.resumeExperiment()
+	})
+
+	go bench.publishUnfinishedExperiment()
+	if autoResume {
+		go bench.waitToResume()
+	}
+
+	go bench.publishAvailability()
+
+	if getMqttKey() != "" {
+		go bench.publishSerialAttrs()
+		go bench.publishConvertedSerialAttrs()
+		go bench.publishQueue()
+	} else {
+		bench.logger().Warn("MQTT key not set, data will not be published")
+	}
+}
+
+// Stops the experiment running, as requested by the operator from source
+func (bench *Bench) quitExperiment(source string) {
+	if bench.isAvailable {
+		return
+	}
+
+	bench.logger().WithField("source", source).Info("Experiment finished by user")
+	bench.journal.record(operatorEvent, EventData{"action": "abort", "source": source}, "Interrupção do ensaio solicitada (%v)", source)
+
+	select {
+	case bench.quitExperimentCh <- true: // The bench is freed when the experiment stops
+	default: // Already requested
+	}
+}
+
+// Publishes whether the bench is available or the experiment it's running
+func (bench *Bench) publishAvailability() {
+	for {
+		select {
+		case id := <-bench.idRunningExperiment:
+			if !bench.isAvailable {
+				bench.publishData("false: "+strconv.Itoa(id), mqttSubchannelIsAvailable)
+			}
+		default:
+			if bench.isAvailable {
+				bench.publishData("true", mqttSubchannelIsAvailable)
+				time.Sleep(time.Millisecond * 500)
+			}
+		}
+	}
+}
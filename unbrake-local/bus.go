@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BufferPolicy is what a subscription does when its buffer is full
+type BufferPolicy int
+
+// Buffer policies of subscriptions
+const (
+	dropNewestPolicy BufferPolicy = iota // Keeps the frames queued, new ones are dropped
+	dropOldestPolicy                     // Drops the oldest frame queued, subscriber always gets the latest
+)
+
+// Subscription receives complete frames from the bus
+type Subscription struct {
+	C          <-chan *Sample
+	ch         chan *Sample
+	name       string
+	policy     BufferPolicy
+	decimation func() int // Frames between each delivery
+	delivered  uint64     // Accessed atomically
+	dropped    uint64     // Accessed atomically
+}
+
+// Delivered frames since subscribed
+func (subscription *Subscription) Delivered() uint64 {
+	return atomic.LoadUint64(&subscription.delivered)
+}
+
+// Dropped frames since subscribed, because subscriber wasn't ready
+func (subscription *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&subscription.dropped)
+}
+
+func (subscription *Subscription) deliver(sample *Sample) {
+	if sample.Seq%uint64(subscription.decimation()) != 0 {
+		return
+	}
+
+	select {
+	case subscription.ch <- sample:
+		atomic.AddUint64(&subscription.delivered, 1)
+		return
+	default:
+	}
+
+	if subscription.policy == dropNewestPolicy {
+		atomic.AddUint64(&subscription.dropped, 1)
+		return
+	}
+
+	select {
+	case <-subscription.ch:
+		atomic.AddUint64(&subscription.dropped, 1)
+	default: // Subscriber read meanwhile
+	}
+
+	select {
+	case subscription.ch <- sample:
+		atomic.AddUint64(&subscription.delivered, 1)
+	default:
+		atomic.AddUint64(&subscription.dropped, 1)
+	}
+}
+
+// SubscriptionStats are the counters of a subscription
+type SubscriptionStats struct {
+	Name      string
+	Delivered uint64
+	Dropped   uint64
+}
+
+// SampleBus delivers every frame acquired to its subscribers, each one with
+// its own rate, buffer and policy for when it's not ready
+type SampleBus struct {
+	mux           sync.RWMutex
+	subscriptions []*Subscription
+}
+
+// Subscribe to frames delivered every decimation frames, the subscription
+// must be cancelled with Unsubscribe when not used anymore
+func (bus *SampleBus) Subscribe(name string, policy BufferPolicy, capacity int, decimation func() int) *Subscription {
+	ch := make(chan *Sample, capacity)
+	subscription := &Subscription{C: ch, ch: ch, name: name, policy: policy, decimation: decimation}
+
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	bus.subscriptions = append(bus.subscriptions, subscription)
+
+	return subscription
+}
+
+// Unsubscribe stops delivering frames to the subscription, closing its channel
+func (bus *SampleBus) Unsubscribe(subscription *Subscription) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	for i, subscribed := range bus.subscriptions {
+		if subscribed == subscription {
+			bus.subscriptions = append(bus.subscriptions[:i], bus.subscriptions[i+1:]...)
+			close(subscription.ch)
+
+			logger.WithFields(logrus.Fields{
+				"subscriber": subscription.name,
+				"delivered":  subscription.Delivered(),
+				"dropped":    subscription.Dropped(),
+			}).Info("Subscriber finished")
+			return
+		}
+	}
+}
+
+// Publish a frame to all subscribers, never blocks
+func (bus *SampleBus) Publish(sample *Sample) {
+	bus.mux.RLock()
+	defer bus.mux.RUnlock()
+
+	for _, subscription := range bus.subscriptions {
+		subscription.deliver(sample)
+	}
+}
+
+// Stats of current subscriptions
+func (bus *SampleBus) Stats() []SubscriptionStats {
+	bus.mux.RLock()
+	defer bus.mux.RUnlock()
+
+	var stats []SubscriptionStats
+	for _, subscription := range bus.subscriptions {
+		stats = append(stats, SubscriptionStats{subscription.name, subscription.Delivered(), subscription.Dropped()})
+	}
+	return stats
+}
+
+// Starts feeding the bus of the bench, only once however many times it's called
+func (bench *Bench) startDispatching() {
+	bench.dispatchOnce.Do(func() { go bench.dispatchSamples() })
+}
+
+// Feeds the bus with the frames acquired, in order
+func (bench *Bench) dispatchSamples() {
+	reader := bench.samples.Reader()
+	var reportedDropped uint64
+
+	for {
+		sample, ok := reader.Next()
+		if !ok {
+			time.Sleep(consumerPollingInterval)
+			continue
+		}
+
+		if reader.dropped > reportedDropped {
+			bench.logger().WithField("frames", reader.dropped-reportedDropped).Warn("Sample bus is late, frames dropped")
+			reportedDropped = reader.dropped
+		}
+
+		bench.sampleBus.Publish(sample)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of calibration curves
+const (
+	linearCurve     = "linear"
+	polynomialCurve = "polynomial"
+	tableCurve      = "table"
+)
+
+// Prefix of subchannels where values converted to engineering units are published,
+// raw values are still published on the original subchannels
+const mqttSubchannelConverted = "/converted"
+
+// Units of each channel after conversion, same index as the data from serial
+var channelUnits = map[int]string{
+	frequencyIdx:     "km/h",
+	temperature1Idx:  "°C",
+	temperature2Idx:  "°C",
+	brakingForce1Idx: "N",
+	brakingForce2Idx: "N",
+	vibrationIdx:     "g",
+	pressureIdx:      "bar",
+}
+
+// Curve converts the voltage (in millivolts) read from a sensor to engineering units
+type Curve interface {
+	Convert(milliVolts float64) float64
+	String() string
+}
+
+// LinearCurve is factor * x + offset
+type LinearCurve struct {
+	factor float64
+	offset float64
+}
+
+// Convert using a linear curve
+func (curve LinearCurve) Convert(milliVolts float64) float64 {
+	return milliVolts*curve.factor + curve.offset
+}
+
+func (curve LinearCurve) String() string {
+	return fmt.Sprintf("linear(factor: %v, offset: %v)", curve.factor, curve.offset)
+}
+
+// PolynomialCurve is c0 + c1*x + c2*x² + ...
+type PolynomialCurve struct {
+	coefficients []float64
+}
+
+// Convert using a polynomial curve
+func (curve PolynomialCurve) Convert(milliVolts float64) float64 {
+	var value float64
+	for i := len(curve.coefficients) - 1; i >= 0; i-- { // Horner's method
+		value = value*milliVolts + curve.coefficients[i]
+	}
+	return value
+}
+
+func (curve PolynomialCurve) String() string {
+	return fmt.Sprintf("polynomial(coefficients: %v)", curve.coefficients)
+}
+
+// TableCurve interpolates linearly between points of (millivolts, value),
+// extrapolating with the first and last segments
+type TableCurve struct {
+	points [][2]float64
+}
+
+func newTableCurve(points [][2]float64) TableCurve {
+	sorted := make([][2]float64, len(points))
+	copy(sorted, points)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+
+	return TableCurve{points: sorted}
+}
+
+// Convert using a lookup table
+func (curve TableCurve) Convert(milliVolts float64) float64 {
+	points := curve.points
+
+	if len(points) == 0 {
+		return milliVolts
+	} else if len(points) == 1 {
+		return points[0][1]
+	}
+
+	i := sort.Search(len(points), func(i int) bool { return points[i][0] >= milliVolts })
+	if i == 0 {
+		i = 1
+	} else if i == len(points) {
+		i = len(points) - 1
+	}
+
+	x0, y0, x1, y1 := points[i-1][0], points[i-1][1], points[i][0], points[i][1]
+	if x1 == x0 {
+		return y0
+	}
+	return y0 + (milliVolts-x0)*(y1-y0)/(x1-x0)
+}
+
+func (curve TableCurve) String() string {
+	return fmt.Sprintf("table(points: %v)", curve.points)
+}
+
+// curveData is how a curve is received inside each sensor calibration,
+// if curve is omitted conversion factor and offset are used as linear
+type curveData struct {
+	Curve        string       `json:"curve,omitempty"`
+	Coefficients []float64    `json:"coefficients,omitempty"`
+	Table        [][2]float64 `json:"table,omitempty"`
+}
+
+// Linear curves are the default, by factor and offset
+func (data curveData) isLinear() bool {
+	return data.Curve == linearCurve || data.Curve == ""
+}
+
+func newCurve(data curveData, factor float64, offset float64) Curve {
+	switch data.Curve {
+	case polynomialCurve:
+		return PolynomialCurve{coefficients: data.Coefficients}
+	case tableCurve:
+		return newTableCurve(data.Table)
+	case linearCurve, "":
+		return LinearCurve{factor: factor, offset: offset}
+	default:
+		logger.WithField("curve", data.Curve).Warn("Invalid calibration curve, using linear")
+		return LinearCurve{factor: factor, offset: offset}
+	}
+}
+
+// Calibration converts every channel read from serial to engineering units
+type Calibration struct {
+	curves     [numSerialAttrs]Curve // Same index as the data from serial, nil is not converted
+	tireRadius float64               // m, to show speeds as rotation
+}
+
+func toMilliVolts(value float64) float64 {
+	const (
+		maxDigitalSignalValue = 1023
+		milliVots             = 5000
+	)
+	return (value * milliVots) / maxDigitalSignalValue
+}
+
+// Convert the raw value of a channel to engineering units
+func (calibration *Calibration) Convert(idx int, value float64) float64 {
+	if calibration.curves[idx] == nil {
+		return value
+	}
+	return calibration.curves[idx].Convert(toMilliVolts(value))
+}
+
+// ConvertAll converts a complete reading from serial
+func (calibration *Calibration) ConvertAll(values []float64) []float64 {
+	converted := make([]float64, len(values))
+	for i, value := range values {
+		converted[i] = calibration.Convert(i, value)
+	}
+	return converted
+}
+
+func (calibration *Calibration) String() string {
+	var channels []string
+	for i, curve := range calibration.curves {
+		if curve != nil {
+			channels = append(channels, fmt.Sprintf("%v: %v", mqttSubchannelSerialAttrs[i], curve))
+		}
+	}
+	return strings.Join(channels, ", ")
+}
+
+// Builds the calibration of all channels from the definition of an experiment
+func calibrationFromDefinition(definition *ExperimentDefinition, tireRadius float64) Calibration {
+	calibration := Calibration{tireRadius: tireRadius}
+	sensors := definition.Sensors
+
+	calibration.curves[frequencyIdx] = LinearCurve{factor: tireRadius} // Frequency is the angular speed
+
+	temperatureIdxs := []int{temperature1Idx, temperature2Idx}
+	for i, temperature := range sensors.Temperature {
+		if i < len(temperatureIdxs) {
+			calibration.curves[temperatureIdxs[i]] = newCurve(temperature.curveData, temperature.factor(), temperature.Offset)
+		}
+	}
+
+	forceIdxs := []int{brakingForce1Idx, brakingForce2Idx}
+	for i, force := range sensors.Force {
+		if i < len(forceIdxs) {
+			calibration.curves[forceIdxs[i]] = newCurve(force.curveData, force.factor(), force.Offset)
+		}
+	}
+
+	if sensors.Vibration != nil {
+		calibration.curves[vibrationIdx] = newCurve(sensors.Vibration.curveData, sensors.Vibration.factor(), sensors.Vibration.Offset)
+	}
+
+	const pressureSensorFullScale = 5000 // millivolts
+	calibration.curves[pressureIdx] = LinearCurve{factor: definition.Bench.Brake.MaxPressureBar / pressureSensorFullScale}
+
+	return calibration
+}
+
+func (bench *Bench) setActiveCalibration(calibration *Calibration) {
+	bench.calibrationMux.Lock()
+	defer bench.calibrationMux.Unlock()
+
+	bench.activeCalibration = calibration
+}
+
+func (bench *Bench) getActiveCalibration() *Calibration {
+	bench.calibrationMux.Lock()
+	defer bench.calibrationMux.Unlock()
+
+	return bench.activeCalibration
+}
+
+// Publish to MQTT broker values of the bench converted to engineering units
+func (bench *Bench) publishConvertedSerialAttrs() {
+	subscription := bench.sampleBus.Subscribe("mqttConverted", dropOldestPolicy, 1, getPublishDecimation)
+
+	for sample := range subscription.C {
+		calibration := bench.getActiveCalibration()
+		if calibration == nil {
+			continue
+		}
+
+		values := calibration.ConvertAll(sample.Filtered)
+		for idx := range channelUnits {
+			value := strconv.FormatFloat(values[idx], 'f', 3, 64)
+			bench.publishData(value, mqttSubchannelConverted+mqttSubchannelSerialAttrs[idx])
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Interval between periodic checkpoints of a running experiment
+const checkpointInterval = time.Second * 5
+
+const mqttSubchannelUnfinishedExperiment = "/unfinishedExperiment"
+
+var autoResume = false
+
+// Checkpoint is the progress of a running experiment saved on disk, so
+// an experiment interrupted by a crash or power loss can be resumed
+type Checkpoint struct {
+	ExperimentID   int             `json:"experimentId"`
+	Payload        json.RawMessage `json:"payload"` // Experiment as received from MQTT
+	CompletedSnubs int             `json:"completedSnubs"`
+	Distance       float64         `json:"distance"`
+	Elapsed        float64         `json:"elapsed"` // Seconds since the experiment started
+	State          string          `json:"state"`
+	SavedAt        time.Time       `json:"savedAt"`
+}
+
+// Saves current progress of the experiment, the file is replaced
+// atomically so a crash while writing won't corrupt the last checkpoint
+func (experiment *Experiment) saveCheckpoint() {
+	experiment.mux.Lock()
+	defer experiment.mux.Unlock()
+
+	if !experiment.continueRunning {
+		return
+	}
+
+	checkpoint := Checkpoint{
+		ExperimentID:   experiment.id,
+		Payload:        experiment.payload,
+		CompletedSnubs: experiment.snub.completed,
+		Distance:       experiment.distance,
+		Elapsed:        time.Since(experiment.duration).Seconds(),
+		State:          byteToStateName[experiment.snub.state],
+		SavedAt:        time.Now(),
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to encode checkpoint")
+		return
+	}
+
+	checkpointPath := experiment.bench.getCheckpointPath()
+	tmpPath := checkpointPath + ".tmp"
+
+	if err = ioutil.WriteFile(tmpPath, data, 0666); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to write checkpoint")
+		return
+	}
+
+	if err = os.Rename(tmpPath, checkpointPath); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to write checkpoint")
+	}
+}
+
+func (experiment *Experiment) watchCheckpoint() {
+	experiment.watch(func() {
+		select {
+		case <-time.After(checkpointInterval):
+			experiment.saveCheckpoint()
+		case <-experiment.stopCh:
+		}
+	})
+}
+
+// Returns the checkpoint of an unfinished experiment of the bench, nil if there is none
+func (bench *Bench) loadCheckpoint() *Checkpoint {
+	data, err := ioutil.ReadFile(bench.getCheckpointPath())
+	if err != nil {
+		return nil
+	}
+
+	var checkpoint Checkpoint
+	if err = json.Unmarshal(data, &checkpoint); err != nil {
+		bench.logger().WithError(err).Warn("Invalid checkpoint file, ignoring it")
+		return nil
+	}
+
+	return &checkpoint
+}
+
+// Removes checkpoint, must be called when experiment finishes or is aborted by the user
+func (bench *Bench) removeCheckpoint() {
+	err := os.Remove(bench.getCheckpointPath())
+	if err != nil && !os.IsNotExist(err) {
+		bench.logger().WithError(err).Error("Wasn't possible to remove checkpoint")
+	}
+
+	select {
+	case bench.resumeEnableCh <- false:
+	default:
+	}
+}
+
+// Builds the experiment back from the checkpoint, ready to continue from
+// the first snub not finished on the bench
+func (checkpoint *Checkpoint) experiment(bench *Bench) (*Experiment, error) {
+	experiment, err := ExperimentFromJSON(bench, checkpoint.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	experiment.snub.completed = checkpoint.CompletedSnubs
+	experiment.applyPhaseOfSnub(experiment.snub.completed + 1)
+	experiment.distance = checkpoint.Distance
+	experiment.elapsed = time.Duration(checkpoint.Elapsed * float64(time.Second))
+
+	return experiment, nil
+}
+
+// Publish and show on GUI that there is an experiment to be resumed
+func (bench *Bench) publishUnfinishedExperiment() {
+	checkpoint := bench.loadCheckpoint()
+	if checkpoint == nil {
+		return
+	}
+
+	bench.logger().WithFields(logrus.Fields{experimentField: checkpoint.ExperimentID, "completed": checkpoint.CompletedSnubs}).Info("Unfinished experiment found")
+
+	data, _ := json.Marshal(checkpoint)
+	bench.publishData(string(data), mqttSubchannelUnfinishedExperiment)
+
+	select {
+	case bench.resumeEnableCh <- true:
+	default:
+	}
+}
+
+// The bench is considered safe when the disc is stopped and
+// the temperatures are under the experiment limit
+func (experiment *Experiment) isBenchSafe() bool {
+	if !experiment.bench.port.IsOpen() {
+		experiment.logger().Warn("Bench not safe: serial port not selected")
+		return false
+	}
+
+	reading := experiment.bench.getLastReading()
+	if reading == nil {
+		experiment.logger().Warn("Bench not safe: no data read from serial yet")
+		return false
+	}
+
+	speed := experiment.calibration.Convert(frequencyIdx, reading[frequencyIdx])
+	temperature1 := experiment.calibration.Convert(temperature1Idx, reading[temperature1Idx])
+	temperature2 := experiment.calibration.Convert(temperature2Idx, reading[temperature2Idx])
+
+	if speed > experiment.snub.lowerSpeedLimit {
+		experiment.logger().WithFields(logrus.Fields{"speed": speed, "limit": experiment.snub.lowerSpeedLimit}).Warn("Bench not safe: speed above limit")
+		return false
+	}
+
+	if temperature1 > experiment.temperatureLimit || temperature2 > experiment.temperatureLimit {
+		experiment.logger().WithFields(logrus.Fields{"temperature1": temperature1, "temperature2": temperature2, "limit": experiment.temperatureLimit}).Warn("Bench not safe: temperature above limit")
+		return false
+	}
+
+	return true
+}
+
+// Resume the unfinished experiment of the bench, returns true if it was resumed
+func (bench *Bench) resumeExperiment() bool {
+	checkpoint := bench.loadCheckpoint()
+	if checkpoint == nil {
+		bench.logger().Warn("Tried to resume an experiment, but there is none unfinished")
+		return false
+	}
+
+	if !bench.isFree() {
+		bench.logger().WithField(experimentField, checkpoint.ExperimentID).Warn("Already running an experiment but tried to resume one")
+		return false
+	}
+
+	experiment, err := checkpoint.experiment(bench)
+	if err != nil {
+		bench.logger().WithField(experimentField, checkpoint.ExperimentID).WithError(err).Error("Invalid experiment on checkpoint, it can only be discarded")
+		bench.publishData("false: "+strconv.Itoa(checkpoint.ExperimentID), "/resumedExperiment")
+		return false
+	}
+
+	if !experiment.isBenchSafe() {
+		bench.publishData("false: "+strconv.Itoa(experiment.id), "/resumedExperiment")
+		return false
+	}
+
+	experiment.logger().Info("Resuming experiment")
+	if !experiment.Run() {
+		bench.publishData("false: "+strconv.Itoa(experiment.id), "/resumedExperiment")
+		return false
+	}
+	bench.publishData("true: "+strconv.Itoa(experiment.id), "/resumedExperiment")
+
+	select {
+	case bench.resumeEnableCh <- false:
+	default:
+	}
+
+	return true
+}
+
+// Used when resuming was requested by command line, waits until the bench
+// is safe to resume the experiment
+func (bench *Bench) waitToResume() {
+	for bench.loadCheckpoint() != nil {
+		if bench.isFree() && bench.port.IsOpen() && bench.resumeExperiment() {
+			return
+		}
+		time.Sleep(checkpointInterval)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Command is an action requested through command line, as in
+// `unbrake-local <command> [args...]`
+type Command struct {
+	description string
+	run         func(args []string) bool // Returns true if the application should start after it
+}
+
+var commands = map[string]Command{
+	"resume": {
+		description: "Inicia a aplicação e retoma o ensaio interrompido assim que a bancada estiver segura",
+		run: func(args []string) bool {
+			autoResume = true
+			return true
+		},
+	},
+	"analyze": {
+		description: "Analisa fade e recuperação de um ensaio gravado: analyze <id|arquivo>",
+		run:         runAnalyzeCommandLine,
+	},
+	"report": {
+		description: "Gera os relatórios HTML e PDF de um ensaio gravado: report <id>",
+		run:         runReportCommandLine,
+	},
+	"simulate": {
+		description: "Valida um ensaio e estima duração, distância e temperaturas sem a bancada: simulate <arquivo>",
+		run:         runSimulationCommandLine,
+	},
+	"dry-run": {
+		description: "O mesmo que simulate",
+		run:         runSimulationCommandLine,
+	},
+	"schema": {
+		description: "Mostra o JSON Schema dos ensaios aceitos",
+		run:         runSchemaCommandLine,
+	},
+	"convert": {
+		description: "Converte um ensaio do formato legado para a versão 2 do formato: convert <arquivo>",
+		run:         runConvertCommandLine,
+	},
+	"events": {
+		description: "Mostra os eventos de um ensaio gravado, opcionalmente só os dos tipos informados: events <id> [tipos...]",
+		run:         runEventsCommandLine,
+	},
+	"calibrate": {
+		description: "Calibra um canal com dois pontos (zero e span): calibrate <canal> [bancada|porta]",
+		run:         runCalibrationCommandLine,
+	},
+	"discard": {
+		description: "Descarta o ensaio interrompido da bancada principal ou da informada: discard [bancada]",
+		run: func(args []string) bool {
+			bench := mainBench()
+			if len(args) > 0 {
+				if bench = findBench(args[0]); bench == nil {
+					fmt.Printf("Bancada %v não configurada\n", args[0])
+					return false
+				}
+			}
+
+			if bench.loadCheckpoint() == nil {
+				fmt.Println("Não há ensaio interrompido")
+				return false
+			}
+			bench.removeCheckpoint()
+			fmt.Println("Ensaio interrompido descartado")
+			return false
+		},
+	},
+	"queue": {
+		description: "Mostra os ensaios na fila da bancada principal ou da informada: queue [bancada]",
+		run:         runQueueCommandLine,
+	},
+	"maintenance": {
+		description: "Opera a bancada manualmente pela linha de comando: maintenance [bancada|porta] [ensaio]",
+		run:         runMaintenanceCommandLine,
+	},
+	"config": {
+		description: "Mostra a configuração efetiva e a origem de cada parâmetro: config print",
+		run:         runConfigCommandLine,
+	},
+	"status": {
+		description: "Mostra os ensaios interrompidos, se houver",
+		run: func(args []string) bool {
+			found := false
+			for _, bench := range benches {
+				checkpoint := bench.loadCheckpoint()
+				if checkpoint == nil {
+					continue
+				}
+
+				if found {
+					fmt.Println()
+				}
+				found = true
+
+				if len(benches) > 1 {
+					fmt.Printf("Bancada %v\n", bench.name)
+				}
+				fmt.Printf("Ensaio %v interrompido em %v\n", checkpoint.ExperimentID, checkpoint.SavedAt.Format("02/01/2006 15:04:05"))
+				fmt.Printf("Snubs concluídos: %v\n", checkpoint.CompletedSnubs)
+				fmt.Printf("Distância percorrida: %.3f km\n", checkpoint.Distance)
+				fmt.Printf("Duração: %.0f s\n", checkpoint.Elapsed)
+			}
+
+			if !found {
+				fmt.Println("Não há ensaio interrompido")
+			}
+			return false
+		},
+	},
+}
+
+// Handles the command given by command line, returns true if
+// the application should be started
+func handleCommandLine(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+
+	command, exists := commands[args[0]]
+	if !exists {
+		printUsage()
+		os.Exit(2)
+	}
+
+	return command.run(args[1:])
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Uso: unbrake-local [opções] [comando]")
+	fmt.Fprintln(os.Stderr, "\nSem comando a aplicação é iniciada normalmente.\n\nComandos:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].description)
+	}
+	printConfigUsage(os.Stderr)
+}
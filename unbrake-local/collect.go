@@ -1,18 +1,13 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	emitter "github.com/icaropires/go/v2"
-)
-
-var (
-	port             Port
-	serialPortNameCh = make(chan string, 1)
-	serialAttrs      = make([]SerialAttribute, numSerialAttrs)
+	"github.com/sirupsen/logrus"
 )
 
 // Index of information get on reading from serial
@@ -28,8 +23,6 @@ const (
 	currentSnubIdx
 )
 
-var data [][]string
-
 // Subchannels for each information sent to MQTT, same index rules
 // as the original data string from serial
 var mqttSubchannelSerialAttrs = []string{
@@ -49,71 +42,64 @@ const (
 	mqttSubchannelIsAvailable = "/isAvailable"
 )
 
-var (
-	numberOfDataToFilter   = 50
-	dutyCycleAndDistanceCh = make(chan float64)
-)
-
-// SerialAttribute represent one attributes of the many that are returned as values
-// from the physical device on serial communication
-type SerialAttribute struct {
-	mqttSubchannel string       // Subchannel associated at mqtt broker
-	publishCh      chan string  // for publishing
-	handleCh       chan float64 // for handling values
-}
-
-// CollectData will collect data from serial bus and distributes it to others goroutines
-func CollectData() {
+// CollectData will collect data from serial bus of the bench and distributes it to others goroutines
+func (bench *Bench) CollectData() {
 	defer wgGeneral.Done()
 
-	var ReadingDelay = time.Second / frequencyReading
-
 	continueCollecting := true
 	for continueCollecting {
-		aplicationStatusCh <- "Esperando seleção de porta válida"
-		log.Println("Waiting for valid serial port selection...")
-		serialPortName := <-serialPortNameCh
+		bench.statusCh <- tr("Esperando seleção de porta válida")
+		bench.logger().Info("Waiting for valid serial port selection")
+		serialPortName := <-bench.serialPortNameCh
 
-		err := port.Open(serialPortName)
+		err := bench.port.Open(serialPortName)
 
 		if err != nil {
-			log.Println(err)
-			if port.IsOpen() {
-				port.Close()
+			bench.logger().WithError(err).Error("Wasn't possible to open serial port")
+			if bench.port.IsOpen() {
+				bench.port.Close()
 			}
 			continue
 		}
 
-		if !isCorrectDevice() {
-			aplicationStatusCh <- "Selecione a porta correta"
-			port.Close()
+		if isStreaming() { // Firmware may still be streaming from a previous run
+			bench.port.Write([]byte(streamStopCommand))
+		}
+
+		if !bench.isCorrectDevice() {
+			bench.statusCh <- tr("Selecione a porta correta")
+			bench.port.Close()
 			continue
 		}
 
-		aplicationStatusCh <- "Coletando dados"
+		bench.statusCh <- tr("Coletando dados")
 
-		log.Println("Initializing collectData routine...")
-		log.Printf("Simulator Port = %s", serialPortName)
-		log.Printf("Buffer size = %d", bufferSize)
-		log.Printf("Baud rate = %d", baudRate)
-		log.Printf("Reading delay = %v", ReadingDelay)
+		bench.logger().WithFields(logrus.Fields{
+			"port":         serialPortName,
+			"bufferSize":   getConfig().BufferSize,
+			"baudRate":     getBaudRate(),
+			"readingDelay": getReadingDelay(),
+		}).Info("Initializing collectData routine")
+
+		stopStreaming := func() {}
+		if isStreaming() {
+			bench.logger().WithField("rate", getSampleRate()).Info("Streaming")
+			stopStreaming = bench.startStreaming()
+		}
 
 		for {
 			select {
-			case stop := <-stopCollectingDataCh:
-				if stop {
-					continueCollecting = false
-				}
-			case sig := <-sigsCh:
-				log.Println("Signal received: ", sig)
-
+			case <-stopCollectingDataCh:
 				continueCollecting = false
-			case serialPortName = <-serialPortNameCh:
-				serialPortNameCh <- serialPortName
-				CollectData()
+			case serialPortName = <-bench.serialPortNameCh:
+				stopStreaming()
+				bench.serialPortNameCh <- serialPortName
+				bench.CollectData()
 			default:
-				getData("\"")
-				time.Sleep(ReadingDelay)
+				if !isStreaming() {
+					bench.getData("\"")
+				}
+				time.Sleep(getReadingDelay())
 			}
 		}
 	}
@@ -121,135 +107,109 @@ func CollectData() {
 
 // Will get the data from the bus and returns it as an
 // array of bytes
-func getData(command string) []byte {
+func (bench *Bench) getData(command string) []byte {
 
-	n := port.Write([]byte(command))
+	n := bench.port.Write([]byte(command))
 
-	buf := make([]byte, bufferSize)
-	n, err := port.Read(buf)
+	buf := make([]byte, getConfig().BufferSize)
+	n, err := bench.port.Read(buf)
 	if err != nil {
-		log.Println("Error reading from serial ", err, ". Is this the right port?")
+		bench.logger().WithError(err).Error("Error reading from serial, is this the right port?")
+		bench.journal.fault(EventData{"error": err.Error()}, "Falha ao ler da porta serial")
 	}
 
 	split := strings.Split(string(buf[:n]), ",")
 
 	if len(split) == numSerialAttrs { // Was a complete read
-
-		data = append(data, split)
-
-		if len(data) == numberOfDataToFilter {
-
-			split = dataFilter(data)
-
-			out := strings.Join(split, ", ")
-
-			log.Println(out)
-
-			frequency, _ := strconv.ParseFloat(split[frequencyIdx], 64)
-			select {
-			case dutyCycleAndDistanceCh <- frequency:
-			default:
-			}
-
-			for i, attr := range split {
-				attrValue, _ := strconv.ParseFloat(attr, 64)
-
-				select {
-				case serialAttrs[i].handleCh <- attrValue:
-				default:
-				}
-
-				select {
-				case serialAttrs[i].publishCh <- attr:
-				default:
-				}
-			}
-			data = data[:0]
+		frame, err := parseFrame(split)
+		if err != nil {
+			bench.logger().WithError(err).Warn("Discarding frame read from serial")
+			bench.journal.fault(EventData{"error": err.Error()}, "Quadro inválido descartado")
+			discardedFramesMetric.WithLabelValues(bench.name).Inc()
+		} else {
+			bench.acquire(frame, time.Now())
 		}
+	} else {
+		discardedFramesMetric.WithLabelValues(bench.name).Inc()
 	}
 
 	return buf
 }
 
-func convertTemperature(value float64, convertionFactor float64, offset float64) float64 {
-	const (
-		maxDigitalSignalValue = 1023
-		milliVots             = 5000
-	)
-	value = (value * milliVots) / maxDigitalSignalValue
-	return value*convertionFactor + offset
-}
-
-func convertSpeed(value float64, tireRadius float64) float64 {
-	const (
-		maxDigitalSignalValue = 1023
-		milliVots             = 5000
-	)
+// Parses a frame read from serial, failing if any value is not a number.
+// Empty values are unused positions of the frame and are kept as zero
+func parseFrame(values []string) ([]float64, error) {
+	frame := make([]float64, len(values))
+	for i, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
 
-	value = (value * milliVots) / maxDigitalSignalValue
-	return value * tireRadius
+		var err error
+		if frame[i], err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("value %v of frame: %v", i, err)
+		}
+	}
+	return frame, nil
 }
 
-func dataFilter(data [][]string) []string {
-
-	var (
-		out         []string
-		counter     int
-		intValue    int
-		stringValue string
-	)
-
-	for i := 0; i < numSerialAttrs; i++ {
-		for j := 0; j < len(data); j++ {
-			intValue, _ = strconv.Atoi(data[j][i])
-			counter += intValue
-		}
-		stringValue = strconv.Itoa(counter / len(data))
-		out = append(out, stringValue)
-		counter = 0
+// Returns the last filtered values read from serial, nil if nothing was read yet
+func (bench *Bench) getLastReading() []float64 {
+	if sample := bench.samples.Latest(); sample != nil {
+		return sample.Filtered
 	}
-	return out
+	return nil
 }
 
 func tireRadius(transversalSelectionWidth int, heightWidthRelation int, rimDiameter int) float64 {
 	return float64((transversalSelectionWidth*heightWidthRelation)/100000) + (0.0254*float64(rimDiameter))/2
 }
 
-func travelledDistance(speed float64) float64 {
-	return (speed / 3600000.0) * (1000 / frequencyReading) * float64(numberOfDataToFilter)
+// Distance, in km, travelled at speed, in km/h, during elapsed
+func travelledDistance(speed float64, elapsed time.Duration) float64 {
+	return speed * elapsed.Hours()
 }
 
-// Publish to MQTT broker the whole current state of local application
-func publishSerialAttrs() {
-	for i := 0; i < numSerialAttrs; i++ {
-		go func(idx int) {
-			for {
-				publishData(<-serialAttrs[idx].publishCh, serialAttrs[idx].mqttSubchannel)
-			}
-		}(i)
+// Publish to MQTT broker the whole current state of the bench
+func (bench *Bench) publishSerialAttrs() {
+	subscription := bench.sampleBus.Subscribe("mqtt", dropOldestPolicy, 1, getPublishDecimation)
+
+	for sample := range subscription.C {
+		for idx, subChannel := range mqttSubchannelSerialAttrs {
+			bench.publishData(strconv.FormatFloat(sample.Filtered[idx], 'f', 2, 64), subChannel)
+		}
 	}
 }
 
-// Publish data to MQTT broker
-func publishData(data string, subChannel string) {
+// Publish data to MQTT broker, on a subchannel of the bench
+func (bench *Bench) publishData(data string, subChannel string) {
 
 	if key := getMqttKey(); key != "" {
+		client := getWritingClient()
 
-		clientWriting.OnError(func(_ *emitter.Client, err emitter.Error) {
+		client.OnError(func(_ *emitter.Client, err emitter.Error) {
 			mqttHasWritingPermission = false
+			publishErrorsMetric.Inc()
 		})
 
-		channel, data := getMqttChannelPrefix()+subChannel, data
-		clientWriting.Publish(key, channel, data)
+		channel, data := bench.getMqttChannelPrefix()+subChannel, data
+		if err := client.Publish(key, channel, data); err != nil {
+			publishErrorsMetric.Inc()
+		} else {
+			publishedMessagesMetric.WithLabelValues(bench.name).Inc()
+			lastPublishMetric.WithLabelValues(bench.name).SetToCurrentTime()
+		}
 
 	} else {
-		log.Println("MQTT key not set!!! Not publishing any data...")
-		mqttKeyStatusCh <- "Chave do MQTT: Ausente"
+		logger.Warn("MQTT key not set, not publishing any data")
+		mqttKeyStatusCh <- tr("Chave do MQTT: Ausente")
 		return
 	}
 }
 
-func writeDutyCycle(duty float64) {
+// Commands the duty cycle of motor, returns the command sent
+func (bench *Bench) writeDutyCycle(duty float64) byte {
 
 	asciiBase := 75.0
 	perCentByAcii := 4.0
@@ -258,37 +218,40 @@ func writeDutyCycle(duty float64) {
 
 	command = append(command, byte(int(duty/perCentByAcii+asciiBase)))
 
-	port.Write(command)
+	if bench.port.Write(command) < 0 {
+		bench.journal.fault(EventData{"duty": duty}, "Falha ao enviar o duty cycle pela porta serial")
+	}
+	dutyCycleMetric.WithLabelValues(bench.name).Set(duty)
+
+	return command[0]
 }
 
 func testKeys() {
 
-	log.Println("Testing MQTT keys...")
-
-	key := getMqttKey()
-	var channel = getMqttChannelPrefix() + "/testingKeys"
+	logger.Info("Testing MQTT keys")
 
-	clientReading.OnError(func(_ *emitter.Client, err emitter.Error) {
+	getReadingClient().OnError(func(_ *emitter.Client, err emitter.Error) {
 		mqttHasReadingPermission = false
 	})
 
-	clientReading.Subscribe(key, channel, func(_ *emitter.Client, msg emitter.Message) {
+	bench := mainBench()
+	bench.subscribeMqtt("/testingKeys", func(_ *emitter.Client, msg emitter.Message) {
 		mqttHasReadingPermission = true
 	})
 
-	publishData("testing", "/testingKeys")
+	bench.publishData("testing", "/testingKeys")
 
 	if mqttHasWritingPermission {
 		if mqttHasReadingPermission {
-			mqttKeyStatusCh <- "Chave de acesso: Válida"
+			mqttKeyStatusCh <- tr("Chave de acesso: Válida")
 		} else {
-			mqttKeyStatusCh <- "Chave de acesso: Válida apenas para escrita"
+			mqttKeyStatusCh <- tr("Chave de acesso: Válida apenas para escrita")
 		}
 	} else {
 		if mqttHasReadingPermission {
-			mqttKeyStatusCh <- "Chave de acesso: Válida apenas para leitura"
+			mqttKeyStatusCh <- tr("Chave de acesso: Válida apenas para leitura")
 		} else {
-			mqttKeyStatusCh <- "Chave de acesso: Inválida"
+			mqttKeyStatusCh <- tr("Chave de acesso: Inválida")
 		}
 	}
 	return
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"log"
+	"strings"
 )
 
-func isCorrectDevice() bool {
+func (bench *Bench) isCorrectDevice() bool {
 
 	var out = true
 
@@ -13,32 +13,33 @@ func isCorrectDevice() bool {
 
 	n := 0
 	var err error
-	buf := make([]byte, bufferSize)
+	buf := make([]byte, getConfig().BufferSize)
 
-	port.Flush()
+	bench.port.Flush()
 	for i := 0; i < 5 && n < len(firmware); i++ {
-		n = port.Write([]byte(" "))
+		n = bench.port.Write([]byte(" "))
 		if n == -1 {
-			log.Println("Error writing to serial")
+			bench.logger().Error("Error writing to serial")
 			out = false
 		}
 
-		n, err = port.Read(buf)
+		n, err = bench.port.Read(buf)
 
 	}
 
 	if err != nil {
-		log.Println("Error reading from serial ", err)
+		bench.logger().WithError(err).Error("Error reading from serial")
 		out = false
 	} else if n == 0 {
-		log.Println("Error reading from serial: timeout waiting for bytes")
+		bench.logger().Error("Error reading from serial: timeout waiting for bytes")
 		out = false
 	}
 
+	bench.setFirmwareBanner(strings.TrimSpace(string(buf[:n])))
 	buf = buf[lineEnd:len(firmware)]
 
 	if string(buf) != firmware[:len(buf)] {
-		log.Println("Wrong serial port selected")
+		bench.logger().Warn("Wrong serial port selected")
 		out = false
 	}
 
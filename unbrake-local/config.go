@@ -2,138 +2,652 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
+// Configuration in use, replaced as a whole when reloaded
 var (
-	configFile ConfigFile
+	configMux     sync.RWMutex
+	configFile    = defaultConfig()
+	configSources = map[string]string{} // Where each parameter came from, by name of field
+	configPath    string                // File read, empty if there is none
+	configArgs    []string              // Command line, read again on reload
 )
 
 // Serial constants
 const (
-	bufferSize       = 48
-	serialPortEnv    = "SERIAL_PORT"
-	baudRate         = 115200
-	frequencyReading = 100
-	numSerialAttrs   = 11 // number of attributes read simultaneously from serial device
+	defaultBufferSize       = 48
+	defaultBaudRate         = 115200
+	defaultReadingFrequency = 100 // Hz, on polling
+	numSerialAttrs          = 11  // number of attributes read simultaneously from serial device
 
 )
 
 // MQTT constants
 const (
-	mqttHostEnv              = "MQTT_HOST"
 	mqttDefaultHost          = "unbrake.ml"
 	mqttDefaultPort          = "8080"
-	mqttPortEnv              = "MQTT_PORT"
 	mqttChannelPrefixDefault = "unbrake/galpao"
-	mqttChannelPrefixEnv     = "MQTT_CHANNEL_PREFIX"
-	mqttKeyEnv               = "MQTT_KEY"
 )
 
 // ConfigFile used to set global parameters
 type ConfigFile struct {
 	SerialPort        string
+	BenchName         string
 	MqttHost          string
 	MqttPort          string
 	MqttKey           string
 	MqttChannelPrefix string
+	Filters           map[string][]FilterConfig // By name of channel
+	Benches           []BenchConfig             // Besides the main one
+	ControlDecimation int
+	PublishDecimation int
+	AcquisitionMode   string // polling or streaming
+	StreamingRate     int    // Hz
+	StreamingBaudRate int
+	BaudRate          int    // On polling
+	BufferSize        int    // bytes, on polling
+	ReadingFrequency  int    // Hz, on polling
+	FilterWindow      int    // Of the moving average of channels without filters set
+	MetricsAddress    string // Where metrics for Prometheus are served, as host:port
+	LogLevel          string // debug, info, warning or error
+	LogFormat         string // json or logfmt
+	LogMaxSize        int    // MB
+	LogMaxAge         int    // days
+	LogMaxBackups     int    // 0 keeps all
+	InterfaceLanguage string // pt-BR or en
+	SpeedUnit         string // Shown on interface, km/h, rpm or m/s
+	TemperatureUnit   string // Shown on interface, C or F
+	ForceUnit         string // Shown on interface, N or kgf
+}
+
+// Description of each parameter, shown on usage and when printing configuration
+var configDescriptions = map[string]string{
+	"SerialPort":        "porta serial da bancada, ex: /dev/ttyACM0",
+	"BenchName":         "nome da bancada principal",
+	"MqttHost":          "host do broker MQTT",
+	"MqttPort":          "porta do broker MQTT",
+	"MqttKey":           "chave do broker MQTT",
+	"MqttChannelPrefix": "prefixo de todos os canais do MQTT",
+	"Filters":           "filtros de cada canal, apenas no arquivo",
+	"Benches":           "outras bancadas operadas pela aplicação, apenas no arquivo",
+	"ControlDecimation": "leituras entre cada atualização do controle, 0 para 10 Hz",
+	"PublishDecimation": "leituras entre cada publicação, 0 para 2 Hz",
+	"AcquisitionMode":   "modo de aquisição: polling ou streaming",
+	"StreamingRate":     "taxa de leituras no modo streaming, em Hz",
+	"StreamingBaudRate": "baud rate no modo streaming",
+	"BaudRate":          "baud rate no modo polling",
+	"BufferSize":        "buffer de leitura da serial no modo polling, em bytes",
+	"ReadingFrequency":  "frequência das leituras no modo polling, em Hz",
+	"FilterWindow":      "janela da média móvel dos canais sem filtros configurados",
+	"MetricsAddress":    "endereço das métricas para o Prometheus, vazio desativa",
+	"LogLevel":          "nível do log: debug, info, warning ou error",
+	"LogFormat":         "formato do log: logfmt ou json",
+	"LogMaxSize":        "tamanho do log para ser rotacionado, em MB",
+	"LogMaxAge":         "dias que os logs rotacionados são mantidos, 0 mantém sempre",
+	"LogMaxBackups":     "quantidade de logs rotacionados mantidos, 0 mantém todos",
+	"InterfaceLanguage": "idioma da interface: pt-BR ou en",
+	"SpeedUnit":         "unidade das velocidades mostradas: km/h, rpm ou m/s",
+	"TemperatureUnit":   "unidade das temperaturas mostradas: C ou F",
+	"ForceUnit":         "unidade das forças mostradas: N ou kgf",
 }
 
 // General application constants
 const (
 	logFilePath           = "unbrake.log"
 	applicationFolderName = "UnBrake"
-	configFileName        = "config.json"
+	configFileName        = "config" // Followed by the extension of its format
+	configFileEnv         = "CONFIG_FILE"
+	configFileFlag        = "config"
+	checkpointFileName    = "checkpoint.json"
+)
+
+// Sources of parameters, from the lowest precedence to the highest
+const (
+	defaultConfigSource = "padrão"
+	fileConfigSource    = "arquivo %v"
+	envConfigSource     = "variável de ambiente %v"
+	flagConfigSource    = "opção -%v"
 )
 
-// Based on current OS will create application folder
-// and log file (if not exists). Returns the log file
-// as a File object
-func getLogFile() *os.File {
-	logPath := getLogPath()
+// Formats of configuration file by extension, the first file found is used
+var configFormats = []struct {
+	extension string
+	unmarshal func([]byte, interface{}) error
+}{
+	{".json", json.Unmarshal},
+	{".yaml", yaml.Unmarshal},
+	{".yml", yaml.Unmarshal},
+	{".toml", toml.Unmarshal},
+}
+
+// ConfigError lists every invalid parameter
+type ConfigError []string
+
+func (err ConfigError) Error() string {
+	return strings.Join(err, "\n")
+}
 
-	os.MkdirAll(logPath, os.ModePerm)
-	logPath = path.Join(logPath, logFilePath)
+func defaultConfig() ConfigFile {
+	return ConfigFile{
+		BenchName:         defaultBenchName,
+		MqttHost:          mqttDefaultHost,
+		MqttPort:          mqttDefaultPort,
+		MqttChannelPrefix: mqttChannelPrefixDefault,
+		AcquisitionMode:   pollingAcquisition,
+		StreamingRate:     defaultStreamingRate,
+		StreamingBaudRate: defaultStreamingBaudRate,
+		BaudRate:          defaultBaudRate,
+		BufferSize:        defaultBufferSize,
+		ReadingFrequency:  defaultReadingFrequency,
+		FilterWindow:      defaultFilterWindow,
+		LogLevel:          defaultLogLevel.String(),
+		LogFormat:         logfmtLogFormat,
+		LogMaxSize:        defaultLogMaxSize,
+		LogMaxAge:         defaultLogMaxAge,
+		InterfaceLanguage: portugueseLanguage,
+		SpeedUnit:         kmhSpeedUnit,
+		TemperatureUnit:   celsiusTemperatureUnit,
+		ForceUnit:         newtonForceUnit,
+	}
+}
 
-	logFile, err := os.OpenFile(logPath, os.O_SYNC|os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+// Loads configuration and starts using it. Returns the arguments left
+// after the options
+func loadConfig(commandLine []string) ([]string, error) {
+	config, sources, filePath, args, err := readConfig(commandLine)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		setupLanguageOf(config) // Errors are shown on the language configured, when it was read
+		return nil, err
+	}
+
+	if filePath == "" {
+		logger.Info("Configuration file not found, defaults and environment variables will be used")
+	}
+
+	setConfig(config, sources, filePath)
+
+	configMux.Lock()
+	configArgs = commandLine[:len(commandLine)-len(args)]
+	configMux.Unlock()
+
+	configureLogging()
+	configureFilters()
+
+	return args, nil
+}
+
+// Reads configuration from its layers, each one overriding the previous:
+// defaults, configuration file, environment variables and command line
+// options. Returns the configuration, the source of each parameter, the
+// file read and the arguments left after the options
+func readConfig(args []string) (ConfigFile, map[string]string, string, []string, error) {
+	config := defaultConfig()
+	sources := map[string]string{}
+	for _, field := range configFields() {
+		sources[field.Name] = defaultConfigSource
+	}
+
+	flags := newConfigFlags()
+	if err := flags.Parse(args); err != nil {
+		return config, nil, "", nil, err
+	}
+
+	filePath := findConfigFile(flags)
+	if filePath != "" {
+		if err := applyConfigFile(&config, sources, filePath); err != nil {
+			return config, nil, "", nil, err
+		}
+	}
+
+	var errs ConfigError
+	for _, field := range configFields() {
+		if value, doesExists := os.LookupEnv(configEnv(field.Name)); doesExists && isScalarConfig(field) {
+			if err := setConfigField(&config, field.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", configEnv(field.Name), err))
+			}
+			sources[field.Name] = fmt.Sprintf(envConfigSource, configEnv(field.Name))
+		}
+	}
+
+	flags.Visit(func(option *flag.Flag) {
+		for _, field := range configFields() {
+			if configFlag(field.Name) == option.Name {
+				if err := setConfigField(&config, field.Name, option.Value.String()); err != nil {
+					errs = append(errs, fmt.Sprintf("-%v: %v", option.Name, err))
+				}
+				sources[field.Name] = fmt.Sprintf(flagConfigSource, option.Name)
+			}
+		}
+	})
+
+	if len(errs) > 0 {
+		return config, nil, "", nil, errs
+	}
+	if err := config.validate(); err != nil {
+		return config, nil, "", nil, err
+	}
+
+	return config, sources, filePath, flags.Args(), nil
+}
+
+func newConfigFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("unbrake-local", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	flags.String(configFileFlag, "", "")
+	flags.String(homeFlag, "", "")
+	for _, field := range configFields() {
+		if isScalarConfig(field) {
+			flags.String(configFlag(field.Name), "", "")
+		}
+	}
+
+	return flags
+}
+
+// Configuration in use
+func getConfig() ConfigFile {
+	configMux.RLock()
+	defer configMux.RUnlock()
+
+	return configFile
+}
+
+func setConfig(config ConfigFile, sources map[string]string, filePath string) {
+	configMux.Lock()
+	defer configMux.Unlock()
+
+	configFile, configSources, configPath = config, sources, filePath
+}
+
+// Path of the configuration file, as given by option or environment
+// variable, or the first one found on application folder
+func findConfigFile(flags *flag.FlagSet) string {
+	if option := flags.Lookup(configFileFlag).Value.String(); option != "" {
+		return option
+	}
+	if filePath, doesExists := os.LookupEnv(configFileEnv); doesExists {
+		return filePath
 	}
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	log.SetOutput(logFile)
 
-	return logFile
+	for _, format := range configFormats {
+		filePath := path.Join(appDirs.Config, configFileName+format.extension)
+		if _, err := os.Stat(filePath); err == nil {
+			return filePath
+		}
+	}
+	return ""
 }
 
-func loadConfigFile() {
-	data, err := ioutil.ReadFile(path.Join(aplicationFolderPath, configFileName))
+// Overrides config with the parameters set on the file
+func applyConfigFile(config *ConfigFile, sources map[string]string, filePath string) error {
+	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Println("Not possible to read configuration file, default will be used, or from environment variables")
+		return err
+	}
+
+	var values map[string]interface{}
+	isFormatKnown := false
+	for _, format := range configFormats {
+		if strings.EqualFold(path.Ext(filePath), format.extension) {
+			isFormatKnown = true
+			if err := format.unmarshal(data, &values); err != nil {
+				return fmt.Errorf("%v: %v", filePath, err)
+			}
+		}
+	}
+	if !isFormatKnown {
+		return fmt.Errorf("%v: unknown format, must be json, yaml or toml", filePath)
 	}
-	err = json.Unmarshal(data, &configFile)
+
+	var errs ConfigError
+	for key := range values {
+		field, exists := configFieldByKey(key)
+		if !exists {
+			errs = append(errs, fmt.Sprintf("%v: unknown parameter %v", filePath, key))
+			continue
+		}
+		sources[field.Name] = fmt.Sprintf(fileConfigSource, filePath)
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errs
+	}
+
+	// Decoded again as JSON, so every format has the same rules
+	data, err = json.Marshal(normalizeConfigValue(values))
 	if err != nil {
-		log.Printf("Invalid Config file: %v\n", err)
+		return fmt.Errorf("%v: %v", filePath, err)
 	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("%v: %v", filePath, err)
+	}
+
+	return nil
 }
 
-func getMqttKey() string {
-	key, doesExists := os.LookupEnv(mqttKeyEnv)
-	if !doesExists {
-		if configFile.MqttKey != "" {
-			key = configFile.MqttKey
-		} else {
-			key = ""
+// Converts maps decoded from YAML, which may have keys of any type, to be
+// encoded as JSON
+func normalizeConfigValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			normalized[fmt.Sprint(key)] = normalizeConfigValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = normalizeConfigValue(item)
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeConfigValue(item)
 		}
+		return value
+	default:
+		return value
 	}
-	return key
 }
 
-func getMqttChannelPrefix() string {
-	channelPrefix, doesExists := os.LookupEnv(mqttChannelPrefixEnv)
-	if !doesExists {
-		if configFile.MqttChannelPrefix != "" {
-			channelPrefix = configFile.MqttChannelPrefix
-		} else {
-			channelPrefix = mqttChannelPrefixDefault
+// Checks every parameter, returning all the invalid ones
+func (config *ConfigFile) validate() error {
+	var errs ConfigError
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, configKey(field)+": "+fmt.Sprintf(format, args...))
+	}
+
+	if config.MqttHost == "" {
+		invalid("MqttHost", "must not be empty")
+	}
+	if port, err := strconv.Atoi(config.MqttPort); err != nil || port < 1 || port > 65535 {
+		invalid("MqttPort", "must be a port number, not %q", config.MqttPort)
+	}
+
+	if config.AcquisitionMode != pollingAcquisition && config.AcquisitionMode != streamingAcquisition {
+		invalid("AcquisitionMode", "must be %v or %v, not %q", pollingAcquisition, streamingAcquisition, config.AcquisitionMode)
+	}
+
+	positives := []struct {
+		field string
+		value int
+	}{
+		{"StreamingRate", config.StreamingRate},
+		{"StreamingBaudRate", config.StreamingBaudRate},
+		{"BaudRate", config.BaudRate},
+		{"BufferSize", config.BufferSize},
+		{"ReadingFrequency", config.ReadingFrequency},
+		{"FilterWindow", config.FilterWindow},
+		{"LogMaxSize", config.LogMaxSize},
+	}
+	for _, positive := range positives {
+		if positive.value <= 0 {
+			invalid(positive.field, "must be positive, not %v", positive.value)
 		}
 	}
-	return channelPrefix
+
+	nonNegatives := []struct {
+		field string
+		value int
+	}{
+		{"ControlDecimation", config.ControlDecimation},
+		{"PublishDecimation", config.PublishDecimation},
+		{"LogMaxAge", config.LogMaxAge},
+		{"LogMaxBackups", config.LogMaxBackups},
+	}
+	for _, nonNegative := range nonNegatives {
+		if nonNegative.value < 0 {
+			invalid(nonNegative.field, "must not be negative, not %v", nonNegative.value)
+		}
+	}
+
+	if config.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsAddress); err != nil {
+			invalid("MetricsAddress", "must be as host:port, %v", err)
+		}
+	}
+
+	if _, err := logrus.ParseLevel(config.LogLevel); err != nil {
+		invalid("LogLevel", "%v", err)
+	}
+	if config.LogFormat != logfmtLogFormat && config.LogFormat != jsonLogFormat {
+		invalid("LogFormat", "must be %v or %v, not %q", logfmtLogFormat, jsonLogFormat, config.LogFormat)
+	}
+
+	if _, exists := translations[config.InterfaceLanguage]; !exists {
+		invalid("InterfaceLanguage", "must be %v or %v, not %q", portugueseLanguage, englishLanguage, config.InterfaceLanguage)
+	}
+	if !isValidSpeedUnit(config.SpeedUnit) {
+		invalid("SpeedUnit", "must be %v, %v or %v, not %q", kmhSpeedUnit, rpmSpeedUnit, msSpeedUnit, config.SpeedUnit)
+	}
+	if _, exists := temperatureUnits[config.TemperatureUnit]; !exists {
+		invalid("TemperatureUnit", "must be %v or %v, not %q", celsiusTemperatureUnit, fahrenheitTemperatureUnit, config.TemperatureUnit)
+	}
+	if _, exists := forceUnits[config.ForceUnit]; !exists {
+		invalid("ForceUnit", "must be %v or %v, not %q", newtonForceUnit, kgfForceUnit, config.ForceUnit)
+	}
+
+	names := make([]string, 0, len(config.Filters))
+	for name := range config.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, exists := calibrationChannels[name]; !exists {
+			invalid("Filters", "unknown channel %v", name)
+		} else if _, err := newFilterPipeline(config.Filters[name], config.sampleRate()); err != nil {
+			invalid("Filters", "%v: %v", name, err)
+		}
+	}
+
+	if !isValidBenchName(config.BenchName) {
+		invalid("BenchName", "must have only letters, numbers, - and _, not %q", config.BenchName)
+	}
+
+	benchNames := map[string]bool{config.BenchName: true}
+	serialPorts := map[string]bool{config.SerialPort: true}
+	prefixes := map[string]bool{config.MqttChannelPrefix: true}
+	for i, bench := range config.Benches {
+		prefix := bench.mqttChannelPrefix(config.MqttChannelPrefix)
+
+		switch {
+		case !isValidBenchName(bench.Name):
+			invalid("Benches", "%v: name must have only letters, numbers, - and _, not %q", i+1, bench.Name)
+		case benchNames[bench.Name]:
+			invalid("Benches", "%v: name %v already used by another bench", i+1, bench.Name)
+		case bench.SerialPort != "" && serialPorts[bench.SerialPort]:
+			invalid("Benches", "%v: serial port %v already used by another bench", bench.Name, bench.SerialPort)
+		case prefixes[prefix]:
+			invalid("Benches", "%v: MQTT channel prefix %v already used by another bench", bench.Name, prefix)
+		}
+
+		benchNames[bench.Name], serialPorts[bench.SerialPort], prefixes[prefix] = true, true, true
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
-func getSerialPort() string {
-	port, doesExists := os.LookupEnv(serialPortEnv)
-	if !doesExists {
-		if configFile.SerialPort != "" {
-			port = configFile.SerialPort
-		} else {
-			port = ""
+// Fields of configuration, in order of declaration
+func configFields() []reflect.StructField {
+	configType := reflect.TypeOf(ConfigFile{})
+
+	fields := make([]reflect.StructField, configType.NumField())
+	for i := range fields {
+		fields[i] = configType.Field(i)
+	}
+	return fields
+}
+
+// Field of a key of configuration file, which is case insensitive
+func configFieldByKey(key string) (reflect.StructField, bool) {
+	for _, field := range configFields() {
+		if strings.EqualFold(field.Name, key) {
+			return field, true
 		}
 	}
-	return port
+	return reflect.StructField{}, false
 }
 
-// Get complete host name with port of the MQTT broker
-func getMqttHost() string {
-	host, doesExists := os.LookupEnv(mqttHostEnv)
-	if !doesExists {
-		if configFile.MqttHost != "" {
-			host = configFile.MqttHost
-		} else {
-			host = mqttDefaultHost
+// Parameters which can also be set by environment variables and options
+func isScalarConfig(field reflect.StructField) bool {
+	return field.Type.Kind() == reflect.String || field.Type.Kind() == reflect.Int
+}
+
+func setConfigField(config *ConfigFile, name, value string) error {
+	field := reflect.ValueOf(config).Elem().FieldByName(name)
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("must be an integer, not %q", value)
 		}
+		field.SetInt(int64(number))
+	default:
+		return fmt.Errorf("can only be set on configuration file")
 	}
 
-	port, doesExists := os.LookupEnv(mqttPortEnv)
-	if !doesExists {
-		if configFile.MqttPort != "" {
-			port = configFile.MqttPort
-		} else {
-			port = mqttDefaultPort
+	return nil
+}
+
+// Name of a parameter on configuration file, as serialPort
+func configKey(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// Name of a parameter on environment, as SERIAL_PORT
+func configEnv(name string) string {
+	return strings.ToUpper(splitConfigName(name, '_'))
+}
+
+// Name of a parameter on command line, as serial-port
+func configFlag(name string) string {
+	return strings.ToLower(splitConfigName(name, '-'))
+}
+
+func splitConfigName(name string, separator rune) string {
+	var split strings.Builder
+	for i, letter := range name {
+		if i > 0 && unicode.IsUpper(letter) {
+			split.WriteRune(separator)
+		}
+		split.WriteRune(letter)
+	}
+	return split.String()
+}
+
+// Prints effective configuration and where each parameter came from
+func printConfig(out io.Writer) {
+	configMux.RLock()
+	defer configMux.RUnlock()
+
+	if configPath != "" {
+		fmt.Fprintf(out, "Arquivo de configuração: %v\n\n", configPath)
+	} else {
+		fmt.Fprint(out, "Nenhum arquivo de configuração encontrado\n\n")
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Configuração:\t%v\n", appDirs.Config)
+	fmt.Fprintf(table, "Estado e logs:\t%v\n", appDirs.State)
+	fmt.Fprintf(table, "Dados:\t%v\n", appDirs.Data)
+	fmt.Fprintf(table, "Cache:\t%v\n\n", appDirs.Cache)
+	table.Flush()
+
+	fmt.Fprintln(table, "PARÂMETRO\tVALOR\tORIGEM")
+
+	config := reflect.ValueOf(configFile)
+	for _, field := range configFields() {
+		value := fmt.Sprint(config.FieldByName(field.Name).Interface())
+
+		switch {
+		case field.Name == "MqttKey" && value != "":
+			value = "********"
+		case field.Name == "Filters" && len(configFile.Filters) == 0:
+			value = "{}"
+		case field.Name == "Filters":
+			encoded, _ := json.Marshal(configFile.Filters)
+			value = string(encoded)
+		case field.Name == "Benches" && len(configFile.Benches) == 0:
+			value = "[]"
+		case field.Name == "Benches":
+			encoded, _ := json.Marshal(configFile.Benches)
+			value = string(encoded)
+		case value == "":
+			value = `""`
+		}
+
+		fmt.Fprintf(table, "%v\t%v\t%v\n", configKey(field.Name), value, configSources[field.Name])
+	}
+
+	table.Flush()
+}
+
+// Prints parameters which can be given by command line
+func printConfigUsage(out io.Writer) {
+	fmt.Fprintln(out, "\nOpções, que têm precedência sobre variáveis de ambiente e arquivo de configuração:")
+	fmt.Fprintf(out, "  -%-21s %s (%s)\n", configFileFlag+" <arquivo>", "arquivo de configuração em JSON, YAML ou TOML", configFileEnv)
+	fmt.Fprintf(out, "  -%-21s %s (%s)\n", homeFlag+" <pasta>", "pasta com todos os arquivos da aplicação", homeEnv)
+
+	for _, field := range configFields() {
+		if isScalarConfig(field) {
+			fmt.Fprintf(out, "  -%-21s %s (%s)\n", configFlag(field.Name), configDescriptions[field.Name], configEnv(field.Name))
 		}
 	}
+}
+
+func runConfigCommandLine(args []string) bool {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Uso: unbrake-local config print")
+		os.Exit(2)
+	}
+
+	printConfig(os.Stdout)
+
+	return false
+}
+
+func getMqttKey() string {
+	return getConfig().MqttKey
+}
+
+func getMqttChannelPrefix() string {
+	return getConfig().MqttChannelPrefix
+}
+
+// Get complete host name with port of the MQTT broker
+func getMqttHost() string {
+	config := getConfig()
+	return "tcp://" + config.MqttHost + ":" + config.MqttPort
+}
 
-	return "tcp://" + host + ":" + port
+// Interval between readings on polling
+func getReadingDelay() time.Duration {
+	return time.Second / time.Duration(getConfig().ReadingFrequency)
 }
@@ -7,10 +7,39 @@ import (
 	"strings"
 )
 
-var aplicationFolderPath = path.Join("/home", os.Getenv("USER"), applicationFolderName)
+const xdgFolderName = "unbrake"
 
-func getLogPath() string {
-	return path.Join(aplicationFolderPath, "logs")
+// Folders of XDG base directory specification
+func defaultAppDirs() AppDirs {
+	home, err := os.UserHomeDir()
+	if err != nil { // As on some containers
+		return singleAppDir(path.Join(os.TempDir(), xdgFolderName))
+	}
+
+	return AppDirs{
+		Config: xdgDir("XDG_CONFIG_HOME", path.Join(home, ".config")),
+		State:  xdgDir("XDG_STATE_HOME", path.Join(home, ".local", "state")),
+		Data:   xdgDir("XDG_DATA_HOME", path.Join(home, ".local", "share")),
+		Cache:  xdgDir("XDG_CACHE_HOME", path.Join(home, ".cache")),
+	}
+}
+
+// Folder of the application inside the base directory set on env, relative
+// paths are ignored as on the specification
+func xdgDir(env, fallback string) string {
+	if base := os.Getenv(env); path.IsAbs(base) {
+		return path.Join(base, xdgFolderName)
+	}
+	return path.Join(fallback, xdgFolderName)
+}
+
+// Folders used by older versions
+func legacyFolders() []string {
+	folders := []string{path.Join("/home", os.Getenv("USER"), applicationFolderName)}
+	if home, err := os.UserHomeDir(); err == nil && path.Join(home, applicationFolderName) != folders[0] {
+		folders = append(folders, path.Join(home, applicationFolderName))
+	}
+	return folders
 }
 
 func getSerialPorts() []string {
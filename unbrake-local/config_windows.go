@@ -1,17 +1,19 @@
 package main
 
 import (
-	"log"
 	"os"
 	"path"
 
 	"golang.org/x/sys/windows/registry"
 )
 
-var aplicationFolderPath = path.Join(os.Getenv("APPDATA"), applicationFolderName)
+func defaultAppDirs() AppDirs {
+	return singleAppDir(path.Join(os.Getenv("APPDATA"), applicationFolderName))
+}
 
-func getLogPath() string {
-	return path.Join(aplicationFolderPath, "logs")
+// Folders used by older versions, the same as the current ones on Windows
+func legacyFolders() []string {
+	return nil
 }
 
 func getSerialPorts() []string {
@@ -21,7 +23,7 @@ func getSerialPorts() []string {
 
 	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\\DEVICEMAP\\SERIALCOMM`, registry.QUERY_VALUE)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 	defer key.Close()
 
@@ -29,20 +31,20 @@ func getSerialPorts() []string {
 	keyInfo, err := key.Stat()
 
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
 	// Get the value count
 	valuesNames, err := key.ReadValueNames(int(keyInfo.ValueCount))
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
 	// List all the string value
 	for _, valueName := range valuesNames {
 		portName, _, err := key.GetStringValue(valueName)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(err)
 		}
 		ports = append(ports, portName)
 	}
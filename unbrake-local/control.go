@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// How brakes are applied during the braking state of a snub
+const (
+	onOffBraking        = "on_off"       // Just the braking state, as the firmware does by itself
+	pressureBraking     = "pressure"     // Controls line pressure to a target
+	decelerationBraking = "deceleration" // Controls line pressure to achieve a target deceleration
+)
+
+// Commands of brake pressure: the output channel is selected by a digit,
+// then the pressure is sent as a byte from 101, by 4%
+const (
+	pressureChannelBase       = '0'
+	maxPressureCommandChannel = 9
+	pressureCommandBase       = 101.0
+	pressurePercentByCommand  = 4.0
+)
+
+// Gains of brake pressure controllers, output is the command in percent of max pressure
+const (
+	pressureKp     = 20.0
+	pressureKi     = 10.0
+	decelerationKp = 15.0
+	decelerationKi = 8.0
+)
+
+// Controller is a proportional-integral controller with output saturation
+type Controller struct {
+	kp, ki   float64
+	min, max float64
+	integral float64
+}
+
+// Update computes next output of the controller, the integral
+// is frozen while output is saturated (anti windup)
+func (controller *Controller) Update(setpoint, measured, dt float64) float64 {
+	err := setpoint - measured
+
+	output := controller.kp*err + controller.ki*(controller.integral+err*dt)
+
+	if output > controller.max {
+		output = controller.max
+	} else if output < controller.min {
+		output = controller.min
+	} else {
+		controller.integral += err * dt
+	}
+
+	return output
+}
+
+// Reset clears the accumulated error of the controller
+func (controller *Controller) Reset() {
+	controller.integral = 0
+}
+
+// Command setting the brake pressure of the output channel, in percent of
+// max pressure
+func pressureCommand(channel int, percent float64) []byte {
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+
+	return []byte{byte(pressureChannelBase + channel), byte(int(percent/pressurePercentByCommand + pressureCommandBase))}
+}
+
+// Writes brake pressure command to the output channel, in percent of max pressure
+func (bench *Bench) writePressure(channel int, percent float64) {
+	if bench.port.Write(pressureCommand(channel, percent)) < 0 {
+		bench.journal.fault(EventData{"channel": channel, "pressure": percent}, "Falha ao enviar a pressão pela porta serial")
+	}
+}
+
+// Modulates brake pressure while braking, to achieve the target
+// pressure or deceleration of current phase
+func (experiment *Experiment) watchBrakeControl() {
+
+	var (
+		controller   Controller
+		lastSpeed    float64
+		lastTime     time.Time
+		wasBraking   bool
+		deceleration float64
+	)
+
+	bench := experiment.bench
+
+	subscription := bench.sampleBus.Subscribe("brakeControl", dropOldestPolicy, 1, getControlDecimation)
+	defer bench.sampleBus.Unsubscribe(subscription)
+
+	experiment.watch(func() {
+
+		sample, ok := experiment.nextSample(subscription)
+		if !ok {
+			return
+		}
+		values, now := sample.Filtered, sample.Time
+
+		phase := experiment.phases[experiment.currentPhase]
+		speed := experiment.calibration.Convert(frequencyIdx, values[frequencyIdx])
+		pressure := experiment.calibration.Convert(pressureIdx, values[pressureIdx])
+
+		dt := now.Sub(lastTime).Seconds()
+		if !lastTime.IsZero() && dt > 0 {
+			deceleration = ((lastSpeed - speed) / 3.6) / dt // km/h to m/s
+		}
+		lastSpeed, lastTime = speed, now
+
+		isBraking := experiment.snub.state == braking || experiment.snub.state == brakingWater
+		if phase.brakeMode == onOffBraking || !isBraking {
+			if wasBraking {
+				bench.writePressure(experiment.pressureCommandChannel, 0)
+				controller.Reset()
+				wasBraking = false
+			}
+			return
+		}
+
+		if !wasBraking {
+			switch phase.brakeMode {
+			case pressureBraking:
+				controller = Controller{kp: pressureKp, ki: pressureKi, max: 100}
+			case decelerationBraking:
+				controller = Controller{kp: decelerationKp, ki: decelerationKi, max: 100}
+			}
+			wasBraking = true
+		}
+
+		var command float64
+		switch phase.brakeMode {
+		case pressureBraking:
+			command = controller.Update(phase.targetPressure, pressure, dt)
+		case decelerationBraking:
+			command = controller.Update(phase.targetDeceleration, deceleration, dt)
+		}
+
+		bench.writePressure(experiment.pressureCommandChannel, command)
+		bench.publishData(strconv.FormatFloat(command, 'f', 3, 64), "/pressureCommand")
+		bench.publishData(strconv.FormatFloat(deceleration, 'f', 3, 64), "/deceleration")
+	})
+
+	bench.writePressure(experiment.pressureCommandChannel, 0)
+}
+
+// Braking controlled by pressure needs the max pressure of the calibration
+func (phase *Phase) validateBrakeMode(maxPressure float64) ExperimentError {
+	var errs ExperimentError
+
+	switch phase.brakeMode {
+	case onOffBraking:
+	case pressureBraking:
+		if phase.targetPressure <= 0 || phase.targetPressure > maxPressure {
+			errs.add(phase.field+"."+phase.key("target_pressure"), "must be greater than 0 and up to the max pressure of calibration (%v bar), not %v bar", maxPressure, phase.targetPressure)
+		}
+	case decelerationBraking:
+		if maxPressure <= 0 {
+			errs.add(phase.field+".brake_mode", "needs the max pressure of calibration to be positive")
+		}
+		if phase.targetDeceleration <= 0 || phase.targetDeceleration > maxDeceleration {
+			errs.add(phase.field+"."+phase.key("target_deceleration"), "must be greater than 0 and up to %v m/s², not %v m/s²", maxDeceleration, phase.targetDeceleration)
+		}
+	default:
+		errs.add(phase.field+".brake_mode", "must be %v, %v or %v, not %q", onOffBraking, pressureBraking, decelerationBraking, phase.brakeMode)
+	}
+
+	return errs
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Version of the experiment format with proper names and units. Experiments
+// without version are the legacy ones, dumps of the backend models
+const experimentFormatVersion = 2
+
+// ExperimentDefinition is an experiment as the agent understands it, the
+// version 2 of the format. Units are on the names of the fields
+type ExperimentDefinition struct {
+	Version     int               `json:"version"`
+	ID          int               `json:"id"`
+	Operator    string            `json:"operator,omitempty"`
+	Calibration string            `json:"calibration,omitempty"` // Name of the calibration of the bench
+	Bench       BenchDefinition   `json:"bench"`
+	Sensors     SensorsDefinition `json:"sensors"`
+	Procedure   []PhaseDefinition `json:"procedure"`
+}
+
+// BenchDefinition is the mechanical setup of the bench for the experiment
+type BenchDefinition struct {
+	Tire    TireDefinition    `json:"tire"`
+	Sheaves SheavesDefinition `json:"sheaves"`
+	Brake   BrakeDefinition   `json:"brake"`
+}
+
+// TireDefinition is the tire simulated, as on its size (175/70 R13)
+type TireDefinition struct {
+	WidthMm            int `json:"width_mm"`
+	AspectRatioPercent int `json:"aspect_ratio_percent"`
+	RimDiameterIn      int `json:"rim_diameter_in"`
+}
+
+// SheavesDefinition gives the transmission ratio between motor and
+// flywheel, diameters only have to be on the same unit
+type SheavesDefinition struct {
+	DrivenDiameter int `json:"driven_diameter"`
+	MotorDiameter  int `json:"motor_diameter"`
+}
+
+// BrakeDefinition is the brake being tested and how its pressure is commanded
+type BrakeDefinition struct {
+	LeverRadiusM           float64 `json:"lever_radius_m,omitempty"`
+	EffectiveRadiusM       float64 `json:"effective_radius_m,omitempty"`
+	PistonAreaCm2          float64 `json:"piston_area_cm2,omitempty"`
+	InertiaKgm2            float64 `json:"inertia_kgm2,omitempty"`
+	MaxPressureBar         float64 `json:"max_pressure_bar,omitempty"`
+	PressureCommandChannel int     `json:"pressure_command_channel,omitempty"`
+}
+
+// SensorsDefinition is the calibration of the sensors, converting millivolts
+// to °C (temperature), N (force) and g (vibration)
+type SensorsDefinition struct {
+	Temperature []SensorDefinition `json:"temperature"`         // One by sensor, 2 of them
+	Force       []SensorDefinition `json:"force"`               // One by sensor, 2 of them
+	Vibration   *SensorDefinition  `json:"vibration,omitempty"` // Without it vibration isn't converted
+}
+
+// SensorDefinition is the calibration of a sensor, linear by factor and
+// offset unless another curve is given
+type SensorDefinition struct {
+	Factor *float64 `json:"factor,omitempty"` // Required on linear curves
+	Offset float64  `json:"offset,omitempty"`
+	curveData
+}
+
+// Calibration of a sensor as it's on a legacy experiment, where the factor
+// is always there
+func legacySensorDefinition(factor, offset float64, data curveData) SensorDefinition {
+	sensor := SensorDefinition{Offset: offset, curveData: data}
+	if data.isLinear() {
+		sensor.Factor = &factor
+	}
+	return sensor
+}
+
+func (sensor *SensorDefinition) factor() float64 {
+	if sensor.Factor == nil {
+		return 0
+	}
+	return *sensor.Factor
+}
+
+// Checks the calibration of the sensor at field
+func (sensor *SensorDefinition) validate(field string) ExperimentError {
+	errs := sensor.curveData.validate(field)
+	if sensor.isLinear() && sensor.Factor == nil {
+		errs.add(field+".factor", "must be set on a linear curve")
+	}
+	return errs
+}
+
+// PhaseDefinition is a block of identical snubs of the procedure
+type PhaseDefinition struct {
+	Name                  string  `json:"name,omitempty"`
+	Snubs                 int     `json:"snubs"`
+	UpperSpeedKmh         float64 `json:"upper_speed_kmh"`
+	LowerSpeedKmh         float64 `json:"lower_speed_kmh"`
+	BrakeDelayS           int     `json:"brake_delay_s,omitempty"`   // At upper speed before braking
+	ReleaseDelayS         int     `json:"release_delay_s,omitempty"` // Braking after lower speed is reached
+	CooldownTimeS         int     `json:"cooldown_time_s,omitempty"`
+	CooldownTemperatureC  float64 `json:"cooldown_temperature_c,omitempty"` // If set, ends cooldown instead of time
+	CooldownMaxTimeS      int     `json:"cooldown_max_time_s,omitempty"`
+	HeatingTemperatureC   float64 `json:"heating_temperature_c,omitempty"` // If set, phase ends when it's reached
+	TemperatureCondition  string  `json:"temperature_condition,omitempty"` // "any" (default) or "both"
+	TemperatureLimitC     float64 `json:"temperature_limit_c"`
+	Water                 bool    `json:"water,omitempty"`
+	WaterTimeS            float64 `json:"water_time_s"`
+	BrakeMode             string  `json:"brake_mode,omitempty"` // "on_off" (default), "pressure" or "deceleration"
+	TargetPressureBar     float64 `json:"target_pressure_bar,omitempty"`
+	TargetDecelerationMs2 float64 `json:"target_deceleration_ms2,omitempty"`
+
+	field string            // Where it's on the experiment received, for errors
+	keys  map[string]string // Names of its parameters there by the legacy ones, nil if they're the same
+}
+
+// Names of the parameters of phases on version 2 by the legacy ones
+var phaseDefinitionKeys = map[string]string{
+	"number":               "snubs",
+	"upper_limit":          "upper_speed_kmh",
+	"inferior_limit":       "lower_speed_kmh",
+	"upper_time":           "brake_delay_s",
+	"inferior_time":        "release_delay_s",
+	"time_between_cycles":  "cooldown_time_s",
+	"cooldown_temperature": "cooldown_temperature_c",
+	"cooldown_max_time":    "cooldown_max_time_s",
+	"heating_temperature":  "heating_temperature_c",
+	"temperature":          "temperature_limit_c",
+	"enable_output":        "water",
+	"time":                 "water_time_s",
+	"target_pressure":      "target_pressure_bar",
+	"target_deceleration":  "target_deceleration_ms2",
+}
+
+// Decodes an experiment on any version of the format, detected by its
+// version field. It's nil when it's not possible to decode, otherwise the
+// invalid fields are returned with it, with the paths of the format received
+func parseExperiment(data []byte) (*ExperimentDefinition, ExperimentError) {
+	var detected struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &detected); err != nil {
+		return nil, decodingError(err)
+	}
+
+	switch {
+	case detected.Version == nil:
+		decoded, errs := decodeExperiment(data)
+		if decoded == nil {
+			return nil, errs
+		}
+		definition := decoded.toDefinition()
+		return &definition, errs
+	case *detected.Version == experimentFormatVersion:
+		return decodeExperimentDefinition(data)
+	default:
+		return nil, ExperimentError{fmt.Sprintf("version: must be %v, or omitted on legacy experiments, not %v", experimentFormatVersion, *detected.Version)}
+	}
+}
+
+// Decodes an experiment on version 2, as strictly as the legacy ones
+func decodeExperimentDefinition(data []byte) (*ExperimentDefinition, ExperimentError) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var definition ExperimentDefinition
+	if err := decoder.Decode(&definition); err != nil {
+		return nil, decodingError(err)
+	}
+
+	if decoder.More() {
+		return nil, ExperimentError{"experiment: unexpected data after it"}
+	}
+
+	for i := range definition.Procedure {
+		definition.Procedure[i].field = fmt.Sprintf("procedure[%v]", i)
+		definition.Procedure[i].keys = phaseDefinitionKeys
+	}
+
+	return &definition, definition.validate()
+}
+
+// Checks the fields which are used as they are received, the ones of
+// the procedure are checked by validateExperiment
+func (definition *ExperimentDefinition) validate() ExperimentError {
+	var errs ExperimentError
+
+	if definition.ID <= 0 {
+		errs.add("id", "must be positive, not %v", definition.ID)
+	}
+
+	positives := []struct {
+		field string
+		value int
+	}{
+		{"bench.tire.width_mm", definition.Bench.Tire.WidthMm},
+		{"bench.tire.aspect_ratio_percent", definition.Bench.Tire.AspectRatioPercent},
+		{"bench.tire.rim_diameter_in", definition.Bench.Tire.RimDiameterIn},
+		{"bench.sheaves.driven_diameter", definition.Bench.Sheaves.DrivenDiameter},
+		{"bench.sheaves.motor_diameter", definition.Bench.Sheaves.MotorDiameter},
+	}
+	for _, positive := range positives {
+		if positive.value <= 0 {
+			errs.add(positive.field, "must be positive, not %v", positive.value)
+		}
+	}
+
+	brake := definition.Bench.Brake
+	nonNegatives := []struct {
+		field string
+		value float64
+	}{
+		{"bench.brake.lever_radius_m", brake.LeverRadiusM},
+		{"bench.brake.effective_radius_m", brake.EffectiveRadiusM},
+		{"bench.brake.piston_area_cm2", brake.PistonAreaCm2},
+		{"bench.brake.inertia_kgm2", brake.InertiaKgm2},
+		{"bench.brake.max_pressure_bar", brake.MaxPressureBar},
+		{"bench.brake.pressure_command_channel", float64(brake.PressureCommandChannel)},
+	}
+	for _, nonNegative := range nonNegatives {
+		if nonNegative.value < 0 {
+			errs.add(nonNegative.field, "must not be negative, not %v", nonNegative.value)
+		}
+	}
+	if brake.PressureCommandChannel > maxPressureCommandChannel {
+		errs.add("bench.brake.pressure_command_channel", "must be at most %v, not %v", maxPressureCommandChannel, brake.PressureCommandChannel)
+	}
+
+	sensors := definition.Sensors
+	if len(sensors.Temperature) != 2 {
+		errs.add("sensors.temperature", "must have 2 calibrations, one by sensor, not %v", len(sensors.Temperature))
+	}
+	for i, temperature := range sensors.Temperature {
+		errs = append(errs, temperature.validate(fmt.Sprintf("sensors.temperature[%v]", i))...)
+	}
+
+	if len(sensors.Force) != 2 {
+		errs.add("sensors.force", "must have 2 calibrations, one by sensor, not %v", len(sensors.Force))
+	}
+	for i, force := range sensors.Force {
+		errs = append(errs, force.validate(fmt.Sprintf("sensors.force[%v]", i))...)
+	}
+
+	if sensors.Vibration != nil {
+		errs = append(errs, sensors.Vibration.validate("sensors.vibration")...)
+	}
+
+	if len(definition.Procedure) == 0 {
+		errs.add("procedure", "must have at least one phase")
+	}
+
+	return errs
+}
+
+// Converts a legacy experiment to version 2. Fields the agent doesn't use,
+// as the ones about the backend models, are left out
+func (decoded *experimentData) toDefinition() ExperimentDefinition {
+	calibration := decoded.Fields.Calibration
+
+	definition := ExperimentDefinition{
+		Version:     experimentFormatVersion,
+		ID:          decoded.Pk,
+		Operator:    decoded.Fields.CreateBy,
+		Calibration: calibration.Name,
+		Bench: BenchDefinition{
+			Tire: TireDefinition{
+				WidthMm:            calibration.Relations.TransversalSelectionWidth,
+				AspectRatioPercent: calibration.Relations.HeigthWidthRelation,
+				RimDiameterIn:      calibration.Relations.RimDiameter,
+			},
+			Sheaves: SheavesDefinition{
+				DrivenDiameter: calibration.Relations.SheaveMoveDiameter,
+				MotorDiameter:  calibration.Relations.SheaveMotorDiameter,
+			},
+			Brake: BrakeDefinition{
+				LeverRadiusM:           calibration.Brake.LeverRadius,
+				EffectiveRadiusM:       calibration.Brake.EffectiveRadius,
+				PistonAreaCm2:          calibration.Brake.PistonArea,
+				InertiaKgm2:            calibration.Brake.Inertia,
+				MaxPressureBar:         calibration.Command.MaxPression,
+				PressureCommandChannel: calibration.Command.ChanelCommandPression,
+			},
+		},
+		Sensors: SensorsDefinition{
+			Temperature: []SensorDefinition{},
+			Force:       []SensorDefinition{},
+		},
+	}
+
+	vibration := legacySensorDefinition(calibration.Vibration.ConversionFactor, calibration.Vibration.VibrationOffset, calibration.Vibration.curveData)
+	definition.Sensors.Vibration = &vibration
+
+	for _, temperature := range calibration.Temperature {
+		definition.Sensors.Temperature = append(definition.Sensors.Temperature,
+			legacySensorDefinition(temperature.ConversionFactor, temperature.TemperatureOffset, temperature.curveData))
+	}
+
+	for _, force := range calibration.Force {
+		definition.Sensors.Force = append(definition.Sensors.Force,
+			legacySensorDefinition(force.ConversionFactor, force.ForceOffset, force.curveData))
+	}
+
+	if len(decoded.Fields.Procedure) > 0 {
+		for i, phase := range decoded.Fields.Procedure {
+			definition.Procedure = append(definition.Procedure, phase.toDefinition(fmt.Sprintf("fields.procedure[%v]", i)))
+		}
+	} else { // A single block of identical snubs
+		configuration := decoded.Fields.Configuration
+		definition.Procedure = []PhaseDefinition{phaseData{
+			Name:              configuration.Name,
+			Number:            configuration.Number,
+			TimeBetweenCycles: configuration.TimeBetweenCycles,
+			UpperLimit:        configuration.UpperLimit,
+			InferiorLimit:     configuration.InferiorLimit,
+			UpperTime:         configuration.UpperTime,
+			LowerTime:         configuration.LowerTime,
+			EnableOutput:      configuration.EnableOutput,
+			Temperature:       configuration.Temperature,
+			Time:              configuration.Time,
+		}.toDefinition("fields.configuration")}
+	}
+
+	return definition
+}
+
+// Converts a phase of a legacy experiment, which is at field on it
+func (data phaseData) toDefinition(field string) PhaseDefinition {
+	return PhaseDefinition{
+		Name:                  data.Name,
+		Snubs:                 data.Number,
+		UpperSpeedKmh:         float64(data.UpperLimit),
+		LowerSpeedKmh:         float64(data.InferiorLimit),
+		BrakeDelayS:           data.UpperTime,
+		ReleaseDelayS:         data.LowerTime,
+		CooldownTimeS:         data.TimeBetweenCycles,
+		CooldownTemperatureC:  data.CooldownTemperature,
+		CooldownMaxTimeS:      data.CooldownMaxTime,
+		HeatingTemperatureC:   data.HeatingTemperature,
+		TemperatureCondition:  data.TemperatureCondition,
+		TemperatureLimitC:     data.Temperature,
+		Water:                 data.EnableOutput,
+		WaterTimeS:            data.Time,
+		BrakeMode:             data.BrakeMode,
+		TargetPressureBar:     data.TargetPressure,
+		TargetDecelerationMs2: data.TargetDeceleration,
+		field:                 field,
+	}
+}
+
+// Id of an experiment on any version, 0 if it's not there
+func experimentIDOf(payload []byte) int {
+	var identification struct {
+		Pk int `json:"pk"`
+		ID int `json:"id"`
+	}
+	json.Unmarshal(payload, &identification)
+
+	if identification.ID != 0 {
+		return identification.ID
+	}
+	return identification.Pk
+}
+
+// Converts an experiment from a file to version 2 by command line, printing
+// it. Experiments already on version 2 are printed as the agent read them
+func runConvertCommandLine(args []string) bool {
+	if len(args) != 1 {
+		fmt.Println("Uso: unbrake-local convert <arquivo do ensaio>")
+		return false
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Println("Não foi possível ler o ensaio: ", err)
+		return false
+	}
+
+	definition, errs := parseExperiment(data)
+	if definition == nil || len(errs) > 0 {
+		fmt.Println("Ensaio inválido, não convertido")
+		for _, err := range errs {
+			fmt.Println("* " + err)
+		}
+		return false
+	}
+
+	converted, _ := json.MarshalIndent(definition, "", "  ")
+	fmt.Println(string(converted))
+
+	return false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	homeEnv        = "UNBRAKE_HOME"
+	homeFlag       = "home"
+	logsFolderName = "logs"
+)
+
+// AppDirs are the folders where the application keeps its files
+type AppDirs struct {
+	Config string // Configuration file
+	State  string // Logs and checkpoint of the experiment running
+	Data   string // Experiments recorded and calibrations
+	Cache  string // Files which can be created again
+}
+
+// Folders in use, set when application starts
+var (
+	appDirs      = defaultAppDirs()
+	isAppDirsSet bool // By the user, instead of the ones of the platform
+)
+
+// Sets the folders of the application, all of them inside the folder given
+// by option or environment variable, or the ones of the platform
+func setAppDirs(args []string) {
+	flags := newConfigFlags()
+	flags.Parse(args)
+
+	home := flags.Lookup(homeFlag).Value.String()
+	if home == "" {
+		home = os.Getenv(homeEnv)
+	}
+
+	if home != "" {
+		appDirs, isAppDirsSet = singleAppDir(home), true
+	} else {
+		appDirs, isAppDirsSet = defaultAppDirs(), false
+	}
+}
+
+// Every folder inside the same one, as on older versions
+func singleAppDir(folder string) AppDirs {
+	return AppDirs{
+		Config: folder,
+		State:  folder,
+		Data:   folder,
+		Cache:  path.Join(folder, "cache"),
+	}
+}
+
+func getLogPath() string {
+	return path.Join(appDirs.State, logsFolderName)
+}
+
+// Moves files from the folder used by older versions to the current folders,
+// unless they were set by the user. Returns where the files were moved to
+func migrateLegacyFolder() ([]string, error) {
+	if isAppDirsSet {
+		return nil, nil
+	}
+
+	var moved []string
+	for _, legacy := range legacyFolders() {
+		movedFromLegacy, err := migrateFolder(legacy, appDirs)
+		moved = append(moved, movedFromLegacy...)
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// Moves every file of folder to where it belongs on dirs, files which already
+// exist on destination are kept on folder
+func migrateFolder(folder string, dirs AppDirs) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil { // Nothing to migrate
+		return nil, nil
+	}
+
+	var (
+		moved []string
+		errs  []string
+	)
+	for _, file := range files {
+		destination := path.Join(legacyDestination(file.Name(), dirs), file.Name())
+		if destination == path.Join(folder, file.Name()) {
+			continue
+		}
+
+		if _, err := os.Stat(destination); err == nil {
+			errs = append(errs, fmt.Sprintf("%v already exists", destination))
+			continue
+		}
+
+		os.MkdirAll(path.Dir(destination), os.ModePerm)
+		if err := os.Rename(path.Join(folder, file.Name()), destination); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		moved = append(moved, destination)
+	}
+
+	os.Remove(folder) // Only when everything was moved, as it must be empty
+
+	if len(errs) > 0 {
+		return moved, errors.New(strings.Join(errs, "; "))
+	}
+	return moved, nil
+}
+
+// Folder where a file of the legacy folder belongs
+func legacyDestination(name string, dirs AppDirs) string {
+	switch {
+	case name == logsFolderName || strings.HasPrefix(name, checkpointFileName):
+		return dirs.State
+	case strings.HasPrefix(name, configFileName+"."):
+		return dirs.Config
+	default: // Experiments and calibrations
+		return dirs.Data
+	}
+}
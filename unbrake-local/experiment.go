@@ -1,16 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/getlantern/systray"
 	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
 )
 
 // Status flags
@@ -22,30 +21,40 @@ var (
 // Experiment is composed of a collection of Snubs, it will perform
 // N Snubs based based on the given data
 type Experiment struct {
-	mux                               sync.Mutex
-	waterMux                          sync.Mutex
-	snub                              Snub
-	snubDuration                      time.Time
-	duration                          time.Time
-	distance                          float64
-	id                                int
-	continueRunning                   bool
-	timeSleepWater                    float64
-	temperatureLimit                  float64
-	totalOfSnubs                      int
-	firstConversionFactorTemperature  float64
-	secondConversionFactorTemperature float64
-	firstOffsetTemperature            float64
-	secondOffsetTemperature           float64
-	tireRadius                        float64
-	sheaveMoveDiameter                int
-	sheaveMotorDiameter               int
-	maxSpeed                          float64
-	doEnableWater                     bool
+	bench                  *Bench
+	mux                    sync.Mutex
+	waterMux               sync.Mutex
+	snub                   Snub
+	snubDuration           time.Time
+	duration               time.Time
+	distance               float64
+	id                     int
+	operator               string
+	continueRunning        bool
+	stopCh                 chan bool      // Closed when the experiment stops, wakes everything waiting on it
+	watchers               sync.WaitGroup // Goroutines of the experiment, the bench is only freed after they return
+	timeSleepWater         float64
+	temperatureLimit       float64
+	totalOfSnubs           int
+	calibration            Calibration
+	tireRadius             float64
+	sheaveMoveDiameter     int
+	sheaveMotorDiameter    int
+	maxSpeed               float64
+	doEnableWater          bool
+	maxPressure            float64
+	pressureCommandChannel int
+	phases                 []Phase
+	currentPhase           int
+	brakeParameters        BrakeParameters
+	metricsRecorder        metricsRecorder
+	snubMetrics            []SnubMetrics
+	temperatures           [2]float64 // Last converted temperatures
+	hasTemperatures        bool
+	payload                []byte        // JSON the experiment was created from
+	elapsed                time.Duration // Time already run before being resumed
 }
 
-var isAvailable = true
-
 // experimentData represents data needed for performing a experiment
 type experimentData struct {
 	Model  string `json:"model"`
@@ -59,6 +68,7 @@ type experimentData struct {
 				AcquisitionChanel int     `json:"acquisition_chanel"`
 				ConversionFactor  float64 `json:"conversion_factor"`
 				VibrationOffset   float64 `json:"vibration_offset"`
+				curveData
 			} `json:"vibration"`
 			Speed struct {
 				AcquisitionChanel int     `json:"acquisition_chanel"`
@@ -72,6 +82,12 @@ type experimentData struct {
 				SheaveMoveDiameter        int `json:"sheave_move_diameter"`
 				SheaveMotorDiameter       int `json:"sheave_motor_diameter"`
 			} `json:"relations"`
+			Brake struct {
+				LeverRadius     float64 `json:"lever_radius"`
+				EffectiveRadius float64 `json:"effective_radius"`
+				PistonArea      float64 `json:"piston_area"`
+				Inertia         float64 `json:"inertia"`
+			} `json:"brake"`
 			Command struct {
 				CommandChanelSpeed    int     `json:"command_chanel_speed"`
 				ActualSpeed           float64 `json:"actual_speed"`
@@ -85,12 +101,14 @@ type experimentData struct {
 				ConversionFactor  float64 `json:"conversion_factor"`
 				TemperatureOffset float64 `json:"temperature_offset"`
 				Calibration       int     `json:"calibration"`
+				curveData
 			} `json:"temperature"`
 			Force []struct {
 				AcquisitionChanel int     `json:"acquisition_chanel"`
 				ConversionFactor  float64 `json:"conversion_factor"`
 				ForceOffset       float64 `json:"force_offset"`
 				Calibration       int     `json:"calibration"`
+				curveData
 			} `json:"force"`
 		} `json:"calibration"`
 		Configuration struct {
@@ -107,176 +125,215 @@ type experimentData struct {
 			Temperature       float64 `json:"temperature"`
 			Time              float64 `json:"time"`
 		} `json:"configuration"`
+		Procedure []phaseData `json:"procedure"` // When present, replaces configuration snubs by phases
 	} `json:"fields"`
 }
 
-// Run an experiment
-func (experiment *Experiment) Run() {
+// Run an experiment, returns false if it wasn't started because it's
+// invalid or the bench is busy
+func (experiment *Experiment) Run() bool {
+
+	bench := experiment.bench
+
+	if errs := experiment.validateExperiment(); len(errs) == 0 {
+
+		select {
+		case <-bench.quitExperimentCh: // Requested when there was no experiment running
+		default:
+		}
+
+		if !bench.reserve() {
+			experiment.logger().Warn("Bench busy, experiment not started")
+			return false
+		}
+
+		bench.quitEnableCh <- false
+		updateIcon()
+		bench.statusCh <- tr("Coletando dados e executando ensaio")
 
-	isAvailable = false
-	quitExperimentEnableCh <- false
-	systray.SetIcon(Icon)
-	aplicationStatusCh <- "Colentando dados e executando ensaio"
-	experiment.distance = 0
+		bench.publishData("true: "+strconv.Itoa(experiment.id), "/validExperiment")
 
-	if experiment.validateExperiment() {
+		experiment.applyPhaseOfSnub(experiment.snub.completed + 1)
+		experiment.publishCurrentPhase()
 
-		publishData("true: "+strconv.Itoa(experiment.id), "/validExperiment")
+		bench.setActiveCalibration(&experiment.calibration)
+
+		experiment.startRecording()
+		experimentRunningMetric.WithLabelValues(bench.name).Set(1)
+		experimentIDMetric.WithLabelValues(bench.name).Set(float64(experiment.id))
+		totalSnubsMetric.WithLabelValues(bench.name).Set(float64(experiment.totalOfSnubs))
+		completedSnubsMetric.WithLabelValues(bench.name).Set(float64(experiment.snub.completed))
+		distanceMetric.WithLabelValues(bench.name).Set(experiment.distance)
+		if experiment.snub.completed == 0 {
+			experiment.recordEvent(experimentEvent, EventData{"snubs": experiment.totalOfSnubs}, "Ensaio iniciado")
+		} else {
+			experiment.recordEvent(experimentEvent, EventData{"completed": experiment.snub.completed}, "Ensaio retomado após o snub %v", experiment.snub.completed)
+		}
 
 		experiment.snub.SetState(acelerating)
-		experiment.duration = time.Now()
+		experiment.duration = time.Now().Add(-experiment.elapsed)
 		experiment.snubDuration = time.Now()
+		experiment.stopCh = make(chan bool)
+		experiment.snub.stopCh = experiment.stopCh
 		experiment.continueRunning = true
 		go experiment.watchSnubState()
 		experiment.snub.counterCh = make(chan int)
-		experiment.snub.counterCh <- 1
+		experiment.snub.counterCh <- experiment.snub.completed + 1
 
 	} else {
 
-		publishData("false: "+strconv.Itoa(experiment.id), "/validExperiment")
+		bench.rejectExperiment(experiment.payload, errs)
+		return false
 
 	}
 
+	return true
 }
 
-func (experiment *Experiment) validateExperiment() bool {
+// Checks the ranges of the parameters of the experiment, returning
+// every invalid one
+func (experiment *Experiment) validateExperiment() ExperimentError {
 
-	var valid = true
+	var errs ExperimentError
 	motorMaxRpm := 1700.0
 
-	experiment.maxSpeed = float64(experiment.sheaveMoveDiameter/experiment.sheaveMotorDiameter) * motorMaxRpm
-
-	if experiment.snub.upperSpeedLimit <= experiment.snub.lowerSpeedLimit {
-		valid = false
+	experiment.maxSpeed = math.Inf(1) // Unknown without the sheaves, which are reported when decoding
+	if experiment.sheaveMoveDiameter > 0 && experiment.sheaveMotorDiameter > 0 {
+		experiment.maxSpeed = float64(experiment.sheaveMoveDiameter/experiment.sheaveMotorDiameter) * motorMaxRpm
 	}
 
-	if experiment.snub.upperSpeedLimit > experiment.maxSpeed {
-		valid = false
+	for i := range experiment.phases {
+		errs = append(errs, experiment.phases[i].validate(experiment.maxSpeed, experiment.maxPressure)...)
 	}
 
-	if experiment.totalOfSnubs <= 0 || experiment.timeSleepWater <= 0 || experiment.temperatureLimit <= 0 {
-		valid = false
-	}
+	return errs
 
-	if experiment.sheaveMoveDiameter <= 0 || experiment.sheaveMotorDiameter <= 0 {
-		valid = false
-	}
-
-	if experiment.snub.delayAcelerateToBrake < 0 || experiment.snub.delayBrakeToCooldown < 0 || experiment.snub.timeCooldown < 0 {
-		valid = false
-	}
+}
 
-	if experiment.snub.lowerSpeedLimit < 0 {
-		valid = false
+// Waits for experiments of the bench to be published at a specific MQTT channel,
+// currently the prefix of the bench + /experiment. They are queued and start
+// as soon as the bench is free
+func (bench *Bench) handleExperimentsReceiving() {
+	if getMqttKey() == "" {
+		bench.logger().Warn("MQTT key not set, experiments will arrive only after it's set")
 	}
 
-	return valid
+	bench.subscribeMqtt("/experiment", func(_ *emitter.Client, msg emitter.Message) {
+		if !bench.port.IsOpen() {
+			bench.logger().Warn("Experiment submitted without selecting a serial port, it will start when one is selected")
+		}
 
+		bench.enqueueExperiment(msg.Payload())
+	})
 }
 
-// HandleExperimentsReceiving will wait for experiments to be published at a specific MQTT channel
-// currently the prefix + /experiment
-func HandleExperimentsReceiving() {
-	for {
-		wgHandleExperimentReceiving.Add(1)
-
-		key := getMqttKey()
-		if key == "" {
-			log.Println("MQTT key not set!!! Not waiting for tests to arrive...")
-			return
-		}
-
-		// Wait for tests
-		var channel = getMqttChannelPrefix() + "/experiment"
-		clientReading.Subscribe(key, channel, func(_ *emitter.Client, msg emitter.Message) {
-			experiment := ExperimentFromJSON(msg.Payload())
-			if isAvailable {
+// ExperimentFromJSON takes a json as an array of bytes, on any version of the
+// format, and returns an experiment to be run on the bench, which is nil when
+// it's not going to be run. The error is an ExperimentError with every invalid
+// field, when there are some
+func ExperimentFromJSON(bench *Bench, data []byte) (*Experiment, error) {
+	experiment := Experiment{bench: bench}
+	experiment.snub.bench = bench
+
+	definition, errs := parseExperiment(data)
+	if definition == nil {
+		return nil, errs
+	}
 
-				log.Printf("Experiment received: %s", experiment)
+	tire := definition.Bench.Tire
+	brake := definition.Bench.Brake
+
+	experiment.payload = data
+	experiment.id = definition.ID
+	experiment.operator = definition.Operator
+	experiment.snub.experimentID = definition.ID
+	experiment.tireRadius = tireRadius(tire.WidthMm, tire.AspectRatioPercent, tire.RimDiameterIn)
+	experiment.calibration = calibrationFromDefinition(definition, experiment.tireRadius)
+	experiment.sheaveMoveDiameter = definition.Bench.Sheaves.DrivenDiameter
+	experiment.sheaveMotorDiameter = definition.Bench.Sheaves.MotorDiameter
+	experiment.brakeParameters = BrakeParameters{
+		leverRadius:     brake.LeverRadiusM,
+		effectiveRadius: brake.EffectiveRadiusM,
+		pistonArea:      brake.PistonAreaCm2,
+		inertia:         brake.InertiaKgm2,
+		wheelRadius:     experiment.tireRadius,
+	}
+	experiment.maxPressure = brake.MaxPressureBar
+	experiment.pressureCommandChannel = brake.PressureCommandChannel
 
-				if port.IsOpen() {
-					experiment.Run()
-				} else {
-					log.Println("Tried to begin an experiment without select a serial port")
-				}
+	for _, phase := range definition.Procedure {
+		experiment.phases = append(experiment.phases, phaseFromDefinition(phase))
+	}
 
-			} else {
-				log.Printf("Alredy running an experiment but one was submitted(id: %v)", experiment.id)
-			}
-		})
-		wgHandleExperimentReceiving.Wait()
+	for _, phase := range experiment.phases {
+		experiment.totalOfSnubs += phase.totalOfSnubs
 	}
-}
 
-// ExperimentFromJSON takes a json as an array of bytes and returns an experiment
-func ExperimentFromJSON(data []byte) *Experiment {
-	var experiment Experiment
+	experiment.currentPhase = -1
+	experiment.applyPhaseOfSnub(1)
 
-	var decoded experimentData
-	if err := json.Unmarshal(data, &decoded); err != nil {
-		log.Println("Wasn't possible to decode JSON, error: ", err)
+	if errs = append(errs, experiment.validateExperiment()...); len(errs) > 0 {
+		return nil, errs
 	}
 
-	experiment.id = decoded.Pk
-	experiment.totalOfSnubs = decoded.Fields.Configuration.Number
-	experiment.timeSleepWater = decoded.Fields.Configuration.Time
-	experiment.doEnableWater = decoded.Fields.Configuration.EnableOutput
-	experiment.firstConversionFactorTemperature = decoded.Fields.Calibration.Temperature[0].ConversionFactor
-	experiment.secondConversionFactorTemperature = decoded.Fields.Calibration.Temperature[1].ConversionFactor
-	experiment.firstOffsetTemperature = decoded.Fields.Calibration.Temperature[0].TemperatureOffset
-	experiment.secondOffsetTemperature = decoded.Fields.Calibration.Temperature[1].TemperatureOffset
-	experiment.temperatureLimit = decoded.Fields.Configuration.Temperature
-	experiment.tireRadius = tireRadius(
-		decoded.Fields.Calibration.Relations.TransversalSelectionWidth,
-		decoded.Fields.Calibration.Relations.HeigthWidthRelation,
-		decoded.Fields.Calibration.Relations.RimDiameter,
-	)
-	experiment.sheaveMoveDiameter = decoded.Fields.Calibration.Relations.SheaveMoveDiameter
-	experiment.sheaveMotorDiameter = decoded.Fields.Calibration.Relations.SheaveMotorDiameter
-
-	experiment.snub.delayAcelerateToBrake = decoded.Fields.Configuration.UpperTime
-	experiment.snub.delayBrakeToCooldown = decoded.Fields.Configuration.LowerTime
-	experiment.snub.upperSpeedLimit = float64(decoded.Fields.Configuration.UpperLimit)
-	experiment.snub.lowerSpeedLimit = float64(decoded.Fields.Configuration.InferiorLimit)
-	experiment.snub.timeCooldown = decoded.Fields.Configuration.TimeBetweenCycles
-
-	return &experiment
+	return &experiment, nil
 }
 
 func (experiment *Experiment) String() string {
 	printedAttrs := []string{
 		fmt.Sprintf("timeSleepWater: %v", experiment.timeSleepWater),
 		fmt.Sprintf("totalOfSnubs: %v", experiment.totalOfSnubs),
+		fmt.Sprintf("phases: %v", len(experiment.phases)),
 		fmt.Sprintf("temperatureLimit: %v", experiment.temperatureLimit),
-		fmt.Sprintf("firstConversionfactorTemperature: %v", experiment.firstConversionFactorTemperature),
-		fmt.Sprintf("secondConversionfactorTemperature: %v", experiment.secondConversionFactorTemperature),
-		fmt.Sprintf("firstOffsetTemperature: %v", experiment.firstOffsetTemperature),
-		fmt.Sprintf("secondOffsetTemperature: %v", experiment.secondConversionFactorTemperature),
+		fmt.Sprintf("calibration: {%v}", &experiment.calibration),
 		fmt.Sprintf("doEnableWater: %v", experiment.doEnableWater),
+		fmt.Sprintf("maxPressure: %v", experiment.maxPressure),
+		fmt.Sprintf("pressureCommandChannel: %v", experiment.pressureCommandChannel),
 	}
 
 	return strings.Join(printedAttrs, ", ")
 }
 
 // Will manage the state of running experiment.snub, handling all state transitions,
-// synchronization, collecting needed data and writing needed commands
+// synchronization, collecting needed data and writing needed commands. The
+// bench is freed only when every watcher returned
 func (experiment *Experiment) watchSnubState() {
 
-	go experiment.watchEnd()
-	go experiment.watchSpeed()
-	go experiment.watchTemperature()
-	go experiment.watchIsAvailable()
-	go experiment.watchDuration()
-	go experiment.watchDutyCycleAndDistance()
+	watchers := []func(){
+		experiment.watchEnd,
+		experiment.watchSpeed,
+		experiment.watchTemperature,
+		experiment.watchIsAvailable,
+		experiment.watchDuration,
+		experiment.watchDutyCycleAndDistance,
+		experiment.watchCheckpoint,
+		experiment.watchBrakeControl,
+		experiment.watchMetrics,
+	}
+
+	experiment.watchers.Add(len(watchers))
+	for _, watcher := range watchers {
+		go func(watcher func()) {
+			defer experiment.watchers.Done()
+			watcher()
+		}(watcher)
+	}
+
+	experiment.watchers.Wait()
+	experiment.finish()
 }
 
 func (experiment *Experiment) watch(watchFunction func()) {
 
-	for experiment.continueRunning {
+	for experiment.isRunning() {
 		select {
-		case <-quitExperimentCh:
-			experiment.continueRunning = false
-			aplicationStatusCh <- "Coletando dados"
+		case <-experiment.bench.quitExperimentCh:
+			experiment.stop()
+			experiment.recordEvent(experimentEvent, EventData{"completed": experiment.snub.completed}, "Ensaio interrompido pelo operador")
+			experiment.saveRunInfo(abortedStatus)
+			experiment.bench.journal.close()
+			experimentRunningMetric.WithLabelValues(experiment.bench.name).Set(0)
+		case <-experiment.stopCh:
 		default:
 			watchFunction()
 		}
@@ -284,19 +341,84 @@ func (experiment *Experiment) watch(watchFunction func()) {
 	experiment.snub.SetState(cooldown)
 }
 
+// Stops the experiment, its watchers return as soon as they see it. The
+// checkpoint is removed under the lock it's saved with, so a save in
+// progress can't bring it back
+func (experiment *Experiment) stop() {
+	experiment.mux.Lock()
+	defer experiment.mux.Unlock()
+
+	if experiment.continueRunning {
+		experiment.continueRunning = false
+		close(experiment.stopCh)
+		experiment.bench.removeCheckpoint()
+	}
+}
+
+func (experiment *Experiment) isRunning() bool {
+	experiment.mux.Lock()
+	defer experiment.mux.Unlock()
+
+	return experiment.continueRunning
+}
+
+// Frees the bench for the next experiment, nothing of this one runs anymore
+func (experiment *Experiment) finish() {
+	bench := experiment.bench
+
+	select {
+	case <-bench.quitExperimentCh: // Requested while it was stopping
+	default:
+	}
+
+	bench.release()
+	bench.queue.finished()
+	bench.quitEnableCh <- true
+	bench.statusCh <- tr("Coletando dados")
+	updateIcon()
+}
+
+// Next sample of subscription, false when the experiment stopped meanwhile
+func (experiment *Experiment) nextSample(subscription *Subscription) (*Sample, bool) {
+	select {
+	case sample := <-subscription.C:
+		return sample, true
+	case <-experiment.stopCh:
+		return nil, false
+	}
+}
+
 func (experiment *Experiment) watchDutyCycleAndDistance() {
 
+	bench := experiment.bench
+
+	subscription := bench.sampleBus.Subscribe("dutyCycle", dropOldestPolicy, 1, getPublishDecimation)
+	defer bench.sampleBus.Unsubscribe(subscription)
+
+	var lastTime time.Time
+	var lastCommand byte
+
 	experiment.watch(func() {
 
-		frequency := <-dutyCycleAndDistanceCh
-		speed := convertSpeed(frequency, experiment.tireRadius) // Frequency is the angular speed
+		sample, ok := experiment.nextSample(subscription)
+		if !ok {
+			return
+		}
+		speed := experiment.calibration.Convert(frequencyIdx, sample.Filtered[frequencyIdx])
 
 		duty := experiment.speedToDutyCycle(speed)
-		experiment.distance += travelledDistance(speed)
+		if !lastTime.IsZero() {
+			experiment.distance += travelledDistance(speed, sample.Time.Sub(lastTime))
+		}
+		lastTime = sample.Time
 
-		writeDutyCycle(duty)
-		publishData(strconv.FormatFloat(experiment.distance, 'f', 3, 64), "/distance")
-		publishData(strconv.FormatFloat(duty, 'f', 3, 64), "/dutyCycle")
+		if command := bench.writeDutyCycle(duty); command != lastCommand {
+			experiment.recordEvent(dutyEvent, EventData{"duty": duty, "speed": speed}, "Duty cycle do motor em %.0f%%", duty)
+			lastCommand = command
+		}
+		bench.publishData(strconv.FormatFloat(experiment.distance, 'f', 3, 64), "/distance")
+		distanceMetric.WithLabelValues(bench.name).Set(experiment.distance)
+		bench.publishData(strconv.FormatFloat(duty, 'f', 3, 64), "/dutyCycle")
 
 	})
 }
@@ -304,7 +426,7 @@ func (experiment *Experiment) watchDutyCycleAndDistance() {
 func (experiment *Experiment) watchIsAvailable() {
 
 	experiment.watch(func() {
-		idRunningExperiment <- experiment.id
+		experiment.bench.idRunningExperiment <- experiment.id
 		time.Sleep(time.Millisecond * 500)
 	})
 }
@@ -316,7 +438,7 @@ func (experiment *Experiment) watchDuration() {
 
 		floatDuration := duration.Seconds()
 
-		publishData(strconv.FormatFloat(floatDuration, 'f', 3, 64), "/experimentDuration")
+		experiment.bench.publishData(strconv.FormatFloat(floatDuration, 'f', 3, 64), "/experimentDuration")
 
 		time.Sleep(time.Second * 1)
 	})
@@ -327,22 +449,28 @@ func (experiment *Experiment) watchEnd() {
 	experiment.watch(func() {
 
 		time.Sleep(time.Millisecond)
-		counter := <-experiment.snub.counterCh
+
+		var counter int
+		select {
+		case counter = <-experiment.snub.counterCh:
+		case <-experiment.stopCh:
+			return
+		}
 
 		if counter > experiment.totalOfSnubs {
 			experiment.snub.SetState(cooldown)
 			close(experiment.snub.counterCh)
 
-			log.Println("---> End of an experiment <---")
-			experiment.continueRunning = false
-			isAvailable = true
-			quitExperimentEnableCh <- true
-			wgHandleExperimentReceiving.Done()
-			aplicationStatusCh <- "Coletando dados"
-			systray.SetIcon(IconDisabled)
+			experiment.logger().Info("End of experiment")
+			experiment.stop()
+			experimentRunningMetric.WithLabelValues(experiment.bench.name).Set(0)
+			experiment.bench.journal.close()
 
 		} else {
-			experiment.snub.counterCh <- counter
+			select {
+			case experiment.snub.counterCh <- counter:
+			case <-experiment.stopCh:
+			}
 		}
 	})
 }
@@ -363,22 +491,30 @@ func (experiment *Experiment) speedToDutyCycle(speed float64) float64 {
 // Watchs speed, changing state when necessary
 func (experiment *Experiment) watchSpeed() {
 
+	subscription := experiment.bench.sampleBus.Subscribe("speed", dropOldestPolicy, 1, getControlDecimation)
+	defer experiment.bench.sampleBus.Unsubscribe(subscription)
+
 	experiment.watch(func() {
 
-		frequency := <-serialAttrs[frequencyIdx].handleCh
+		sample, ok := experiment.nextSample(subscription)
+		if !ok {
+			return
+		}
 
-		speed := convertSpeed(frequency, experiment.tireRadius) // Frequency is the angular speed
+		speed := experiment.calibration.Convert(frequencyIdx, sample.Filtered[frequencyIdx])
 
+		experiment.watchers.Add(1)
 		go func() {
+			defer experiment.watchers.Done()
 
 			if (experiment.snub.state == acelerating || experiment.snub.state == aceleratingWater) && !experiment.snub.isStabilizing {
-				if speed >= experiment.snub.upperSpeedLimit {
+				if isBrakingSpeed(speed, experiment.snub.upperSpeedLimit) {
 					experiment.snub.NextState() // Acelerating to Braking
 				}
 			} else if (experiment.snub.state == braking || experiment.snub.state == brakingWater) && !experiment.snub.isStabilizing {
-				if speed < experiment.snub.lowerSpeedLimit {
+				if isReleaseSpeed(speed, experiment.snub.lowerSpeedLimit) {
 					experiment.snub.NextState() // Braking to Cooldown
-					if experiment.continueRunning {
+					if experiment.isRunning() {
 						experiment.snub.NextState() // Cooldown to Acelerate
 
 						end := time.Now()
@@ -387,9 +523,26 @@ func (experiment *Experiment) watchSpeed() {
 
 						floatSnubDuration := snubDuration.Seconds()
 
-						publishData(strconv.FormatFloat(floatSnubDuration, 'f', 3, 64), "/snubDuration")
+						experiment.bench.publishData(strconv.FormatFloat(floatSnubDuration, 'f', 3, 64), "/snubDuration")
+
+						experiment.logger().WithField("duration", snubDuration).Info("Snub finished")
+
+						experiment.finishSnubMetrics()
+
+						experiment.checkHeatingPhase()
+						if experiment.snub.completed >= experiment.totalOfSnubs {
+							experiment.analyze()
+							experiment.recordEvent(experimentEvent, EventData{"completed": experiment.snub.completed, "distance": experiment.distance}, "Ensaio concluído após %v snubs", experiment.snub.completed)
+							experiment.saveRunInfo(finishedStatus)
+							experiment.generateReport()
+						}
 
-						log.Println("Duration of the snub: ", snubDuration)
+						if experiment.applyPhaseOfSnub(experiment.snub.completed + 1) {
+							experiment.publishCurrentPhase()
+							experiment.recordEvent(phaseEvent, EventData{"phase": experiment.currentPhase + 1, "name": experiment.phases[experiment.currentPhase].name}, "Início da fase %v", experiment.phases[experiment.currentPhase].name)
+						}
+
+						experiment.saveCheckpoint()
 					}
 				}
 			}
@@ -399,18 +552,28 @@ func (experiment *Experiment) watchSpeed() {
 
 // Follow temperature and throw water if needed
 func (experiment *Experiment) watchTemperature() {
+	subscription := experiment.bench.sampleBus.Subscribe("temperature", dropOldestPolicy, 1, getControlDecimation)
+	defer experiment.bench.sampleBus.Unsubscribe(subscription)
+
 	experiment.watch(func() {
 
-		temperature1 := <-serialAttrs[temperature1Idx].handleCh
-		temperature2 := <-serialAttrs[temperature2Idx].handleCh
+		sample, ok := experiment.nextSample(subscription)
+		if !ok {
+			return
+		}
+
+		temperature1 := experiment.calibration.Convert(temperature1Idx, sample.Filtered[temperature1Idx])
+		temperature2 := experiment.calibration.Convert(temperature2Idx, sample.Filtered[temperature2Idx])
 
-		temperature1 = convertTemperature(temperature1, experiment.firstConversionFactorTemperature, experiment.firstOffsetTemperature)
-		temperature2 = convertTemperature(temperature2, experiment.secondConversionFactorTemperature, experiment.secondOffsetTemperature)
+		experiment.mux.Lock()
+		experiment.temperatures = [2]float64{temperature1, temperature2}
+		experiment.hasTemperatures = true
+		experiment.mux.Unlock()
 
-		if (temperature1 > experiment.temperatureLimit || temperature2 > experiment.temperatureLimit) && experiment.doEnableWater {
+		if isAboveTemperatureLimit([2]float64{temperature1, temperature2}, experiment.temperatureLimit) && experiment.doEnableWater {
 			if experiment.snub.state == acelerating || experiment.snub.state == braking || experiment.snub.state == cooldown {
 				experiment.changeStateWater()
-				if experiment.continueRunning {
+				if experiment.isRunning() {
 					experiment.changeStateWater()
 				}
 			}
@@ -425,17 +588,29 @@ func (experiment *Experiment) changeStateWater() {
 
 	oldState := experiment.snub.state
 
+	experiment.mux.Lock()
+	temperatures := experiment.temperatures
+	experiment.mux.Unlock()
+
 	if !experiment.snub.isWaterOn {
 		experiment.snub.state = offToOnWater[experiment.snub.state]
-		log.Printf("Turn on water(%vs): %v ---> %v\n", experiment.timeSleepWater, byteToStateName[oldState], byteToStateName[experiment.snub.state])
+		experiment.logger().WithFields(logrus.Fields{"from": byteToStateName[oldState], "duration": experiment.timeSleepWater}).Info("Turn on water")
+		experiment.recordEvent(waterEvent, EventData{"on": true, "from": byteToStateName[oldState], "to": byteToStateName[experiment.snub.state], "duration": experiment.timeSleepWater, "temperatures": temperatures}, "Água ligada")
 	} else {
-		time.Sleep(time.Second * time.Duration(experiment.timeSleepWater))
+		select {
+		case <-time.After(time.Second * time.Duration(experiment.timeSleepWater)):
+		case <-experiment.stopCh:
+		}
 		experiment.snub.state = onToOffWater[experiment.snub.state]
-		log.Printf("Turn off water: %v ---> %v\n", byteToStateName[oldState], byteToStateName[experiment.snub.state])
+		experiment.logger().WithField("from", byteToStateName[oldState]).Info("Turn off water")
+		experiment.recordEvent(waterEvent, EventData{"on": false, "from": byteToStateName[oldState], "to": byteToStateName[experiment.snub.state], "temperatures": temperatures}, "Água desligada")
 	}
 
-	port.Write([]byte(experiment.snub.state))
+	if experiment.bench.port.Write([]byte(experiment.snub.state)) < 0 {
+		experiment.bench.journal.fault(EventData{"state": byteToStateName[experiment.snub.state]}, "Falha ao enviar o estado pela porta serial")
+	}
 
-	publishData(byteToStateName[experiment.snub.state], mqttSubchannelSnubState)
+	experiment.bench.publishData(byteToStateName[experiment.snub.state], mqttSubchannelSnubState)
+	experiment.bench.setSnubStateMetric(experiment.snub.state)
 	experiment.snub.isWaterOn = !experiment.snub.isWaterOn
 }
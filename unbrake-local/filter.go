@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Types of filters which can be configured for a channel
+const (
+	movingAverageFilter = "moving_average"
+	medianFilter        = "median"
+	exponentialFilter   = "exponential"
+	butterworthFilter   = "butterworth"
+	outlierFilter       = "outlier"
+)
+
+// Defaults when nothing is set on configuration file
+const (
+	defaultControlRate  = 10 // Hz
+	defaultPublishRate  = 2  // Hz
+	defaultFilterWindow = 10
+	outlierMADScale     = 1.4826 // Makes MAD comparable to standard deviation
+)
+
+// Filter processes a channel sample by sample, at the rate of reading
+type Filter interface {
+	Apply(value float64) float64
+}
+
+// FilterConfig is a filter as set on configuration file
+type FilterConfig struct {
+	Type      string  // One of the filter types
+	Window    int     // Samples, for moving average, median and outlier
+	Alpha     float64 // Smoothing factor in (0, 1], for exponential
+	Cutoff    float64 // Hz, for butterworth
+	Threshold float64 // Deviations from median, for outlier
+}
+
+// Last values of a channel, oldest are overwritten
+type window struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newWindow(size int) *window {
+	return &window{values: make([]float64, size)}
+}
+
+func (window *window) add(value float64) {
+	window.values[window.next] = value
+	window.next = (window.next + 1) % len(window.values)
+	window.full = window.full || window.next == 0
+}
+
+func (window *window) contents() []float64 {
+	if window.full {
+		return window.values
+	}
+	return window.values[:window.next]
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// MovingAverage is the mean of the last values
+type MovingAverage struct {
+	window *window
+	sum    float64
+}
+
+// Apply filter to a new value
+func (filter *MovingAverage) Apply(value float64) float64 {
+	if filter.window.full {
+		filter.sum -= filter.window.values[filter.window.next]
+	}
+	filter.sum += value
+	filter.window.add(value)
+
+	return filter.sum / float64(len(filter.window.contents()))
+}
+
+// Median of the last values, removes spikes without smearing edges
+type Median struct {
+	window *window
+}
+
+// Apply filter to a new value
+func (filter *Median) Apply(value float64) float64 {
+	filter.window.add(value)
+	return median(filter.window.contents())
+}
+
+// Exponential moving average
+type Exponential struct {
+	alpha       float64
+	last        float64
+	initialized bool
+}
+
+// Apply filter to a new value
+func (filter *Exponential) Apply(value float64) float64 {
+	if !filter.initialized {
+		filter.last, filter.initialized = value, true
+	}
+	filter.last = filter.alpha*value + (1-filter.alpha)*filter.last
+	return filter.last
+}
+
+// Butterworth is a second order low-pass filter
+type Butterworth struct {
+	a0, a1, a2, b1, b2 float64
+	x1, x2, y1, y2     float64
+	initialized        bool
+}
+
+func newButterworth(cutoff, sampleRate float64) *Butterworth {
+	k := math.Tan(math.Pi * cutoff / sampleRate)
+	norm := 1 / (1 + math.Sqrt2*k + k*k)
+
+	filter := Butterworth{a0: k * k * norm}
+	filter.a1 = 2 * filter.a0
+	filter.a2 = filter.a0
+	filter.b1 = 2 * (k*k - 1) * norm
+	filter.b2 = (1 - math.Sqrt2*k + k*k) * norm
+
+	return &filter
+}
+
+// Apply filter to a new value
+func (filter *Butterworth) Apply(value float64) float64 {
+	if !filter.initialized { // Starts at steady state, avoiding a transient from zero
+		filter.x1, filter.x2, filter.y1, filter.y2 = value, value, value, value
+		filter.initialized = true
+	}
+
+	output := filter.a0*value + filter.a1*filter.x1 + filter.a2*filter.x2 - filter.b1*filter.y1 - filter.b2*filter.y2
+
+	filter.x2, filter.x1 = filter.x1, value
+	filter.y2, filter.y1 = filter.y1, output
+
+	return output
+}
+
+// OutlierRejection replaces values too far from the median of the last ones
+// by the median, using the median absolute deviation as measure of spread
+type OutlierRejection struct {
+	window    *window
+	threshold float64
+}
+
+// Apply filter to a new value
+func (filter *OutlierRejection) Apply(value float64) float64 {
+	values := filter.window.contents()
+	filter.window.add(value)
+
+	if len(values) < 3 {
+		return value
+	}
+
+	center := median(values)
+
+	deviations := make([]float64, len(values))
+	for i, past := range values {
+		deviations[i] = math.Abs(past - center)
+	}
+	spread := median(deviations) * outlierMADScale
+
+	if spread > 0 && math.Abs(value-center) > filter.threshold*spread {
+		return center
+	}
+	return value
+}
+
+func newFilter(config FilterConfig, sampleRate int) (Filter, error) {
+	window := config.Window
+	if window == 0 {
+		window = defaultFilterWindow
+	}
+
+	switch config.Type {
+	case movingAverageFilter, medianFilter, outlierFilter:
+		if window < 1 {
+			return nil, fmt.Errorf("invalid window for %v: %v", config.Type, window)
+		}
+	}
+
+	switch config.Type {
+	case movingAverageFilter:
+		return &MovingAverage{window: newWindow(window)}, nil
+
+	case medianFilter:
+		return &Median{window: newWindow(window)}, nil
+
+	case exponentialFilter:
+		if config.Alpha <= 0 || config.Alpha > 1 {
+			return nil, fmt.Errorf("invalid alpha for exponential: %v", config.Alpha)
+		}
+		return &Exponential{alpha: config.Alpha}, nil
+
+	case butterworthFilter:
+		nyquist := float64(sampleRate) / 2
+		if config.Cutoff <= 0 || config.Cutoff >= nyquist {
+			return nil, fmt.Errorf("invalid cutoff for butterworth: %v Hz, must be below %v Hz", config.Cutoff, nyquist)
+		}
+		return newButterworth(config.Cutoff, float64(sampleRate)), nil
+
+	case outlierFilter:
+		if config.Threshold <= 0 {
+			return nil, fmt.Errorf("invalid threshold for outlier: %v", config.Threshold)
+		}
+		return &OutlierRejection{window: newWindow(window), threshold: config.Threshold}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown filter: %v", config.Type)
+	}
+}
+
+// FilterPipeline applies its filters in order
+type FilterPipeline []Filter
+
+// Apply all filters to a new value
+func (pipeline FilterPipeline) Apply(value float64) float64 {
+	for _, filter := range pipeline {
+		value = filter.Apply(value)
+	}
+	return value
+}
+
+func newFilterPipeline(configs []FilterConfig, sampleRate int) (FilterPipeline, error) {
+	var pipeline FilterPipeline
+	for _, config := range configs {
+		filter, err := newFilter(config, sampleRate)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, filter)
+	}
+	return pipeline, nil
+}
+
+// Builds the filters of every bench from configuration file
+func configureFilters() {
+	for _, bench := range benches {
+		bench.configureFilters()
+	}
+}
+
+// Builds the filters of each channel of the bench from configuration file, a
+// channel without filters set, or with invalid ones, uses a moving average
+func (bench *Bench) configureFilters() {
+	config := getConfig()
+
+	filters := make([]FilterPipeline, numSerialAttrs)
+	for i := range filters {
+		filters[i] = FilterPipeline{&MovingAverage{window: newWindow(config.FilterWindow)}}
+	}
+
+	for name, configs := range config.Filters {
+		channel, exists := calibrationChannels[name]
+		if !exists {
+			bench.logger().WithField("channel", name).Warn("Filters set for unknown channel")
+			continue
+		}
+
+		pipeline, err := newFilterPipeline(configs, config.sampleRate())
+		if err != nil {
+			bench.logger().WithError(err).WithField("channel", name).Warn("Invalid filters, default will be used")
+			continue
+		}
+
+		filters[channel.idx] = pipeline
+		bench.logger().WithFields(logrus.Fields{"channel": name, "filters": configs}).Info("Filters configured")
+	}
+
+	bench.filters.Store(filters)
+}
+
+// Filters a whole frame read from serial of the bench
+func (bench *Bench) filterFrame(frame []float64) []float64 {
+	filters, _ := bench.filters.Load().([]FilterPipeline)
+
+	filtered := make([]float64, len(frame))
+	for i, value := range frame {
+		if i < len(filters) {
+			value = filters[i].Apply(value)
+		}
+		filtered[i] = value
+	}
+	return filtered
+}
+
+// Frames read between each delivery of filtered values to control loops
+func getControlDecimation() int {
+	if decimation := getConfig().ControlDecimation; decimation > 0 {
+		return decimation
+	}
+	return decimationForRate(defaultControlRate)
+}
+
+// Frames read between each publishing of filtered values
+func getPublishDecimation() int {
+	if decimation := getConfig().PublishDecimation; decimation > 0 {
+		return decimation
+	}
+	return decimationForRate(defaultPublishRate)
+}
+
+func decimationForRate(rate int) int {
+	if decimation := getSampleRate() / rate; decimation > 1 {
+		return decimation
+	}
+	return 1
+}
@@ -0,0 +1,100 @@
+package main
+
+import "fmt"
+
+// Languages of the interface
+const (
+	portugueseLanguage = "pt-BR"
+	englishLanguage    = "en"
+)
+
+// Language of the interface, as menus are created once it's only set when
+// the application starts
+var language = portugueseLanguage
+
+func setupLanguage() {
+	setupLanguageOf(getConfig())
+}
+
+// Sets the language of config, if it's a valid one
+func setupLanguageOf(config ConfigFile) {
+	if _, exists := translations[config.InterfaceLanguage]; exists {
+		language = config.InterfaceLanguage
+	}
+}
+
+// Translations of the messages of the interface by language. Messages are
+// written in Portuguese, which is used when there is no translation
+var translations = map[string]map[string]string{
+	portugueseLanguage: {},
+	englishLanguage: {
+		"Status": "Status",
+		"Seção para visualização do status da aplicação": "Section showing the status of the application",
+		"Chave de acesso: Não avaliada":                  "Access key: Not evaluated",
+		"Status da chave do MQTT":                        "Status of the MQTT key",
+		"Status de conexão":                              "Connection status",
+		"Sair":                                           "Quit",
+		"Fechar UnBrake":                                 "Close UnBrake",
+		"Bancada %v":                                     "Bench %v",
+		"Status e operação da bancada":                   "Status and operation of the bench",
+		"Status de aquisição":                            "Acquisition status",
+		"Não iniciada":                                   "Not started",
+		"Encerrar ensaio":                                "Stop experiment",
+		"Finaliza o ensaio atual":                        "Stops the current experiment",
+		"Retomar ensaio interrompido":                    "Resume interrupted experiment",
+		"Retoma o ensaio interrompido, se a bancada estiver segura": "Resumes the interrupted experiment, if the bench is safe",
+		"Fila: vazia":                  "Queue: empty",
+		"Fila: %v ensaio(s)":           "Queue: %v experiment(s)",
+		"Ensaios aguardando a bancada": "Experiments waiting for the bench",
+
+		"Portas":                       "Ports",
+		"Selecione a porta de leitura": "Select the reading port",
+		"Selecionar porta":             "Select port",
+
+		"Manutenção":                                       "Maintenance",
+		"Operação manual da bancada":                       "Manual operation of the bench",
+		"Iniciar modo manutenção":                          "Start maintenance mode",
+		"Encerrar modo manutenção":                         "Stop maintenance mode",
+		"Opera a bancada fora de um ensaio":                "Operates the bench out of an experiment",
+		"Duty cycle: %v%%":                                 "Duty cycle: %v%%",
+		"Duty cycle atual do motor":                        "Current duty cycle of the motor",
+		"Aumentar duty cycle (+%v%%)":                      "Increase duty cycle (+%v%%)",
+		"Diminuir duty cycle (-%v%%)":                      "Decrease duty cycle (-%v%%)",
+		"Acionar freio":                                    "Apply brake",
+		"Soltar freio":                                     "Release brake",
+		"Ligar água":                                       "Turn water on",
+		"Desligar água":                                    "Turn water off",
+		"Sensores: %v":                                     "Sensors: %v",
+		"Últimas leituras dos sensores":                    "Last readings of the sensors",
+		"sem leituras":                                     "no readings",
+		"freq: %v, temp: %v/%v, força: %v/%v, pressão: %v": "freq: %v, temp: %v/%v, force: %v/%v, pressure: %v",
+		"velocidade: %v, temp: %v/%v, força: %v/%v, pressão: %v": "speed: %v, temp: %v/%v, force: %v/%v, pressure: %v",
+
+		"Conectado":                                   "Connected",
+		"Desconectado":                                "Disconnected",
+		"Esperando seleção de porta válida":           "Waiting for a valid port to be selected",
+		"Selecione a porta correta":                   "Select the right port",
+		"Coletando dados":                             "Collecting data",
+		"Coletando dados e executando ensaio":         "Collecting data and running experiment",
+		"Chave do MQTT: Ausente":                      "MQTT key: Missing",
+		"Chave de acesso: Válida":                     "Access key: Valid",
+		"Chave de acesso: Válida apenas para escrita": "Access key: Valid only for writing",
+		"Chave de acesso: Válida apenas para leitura": "Access key: Valid only for reading",
+		"Chave de acesso: Inválida":                   "Access key: Invalid",
+
+		"Configuração inválida:": "Invalid configuration:",
+	},
+}
+
+// Message of the interface on the language configured, formatted with args
+// when there are some
+func tr(message string, args ...interface{}) string {
+	if translated, exists := translations[language][message]; exists {
+		message = translated
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const mqttSubchannelEvent = "/event"
+
+// Types of the events of the journal of an experiment
+const (
+	experimentEvent = "experiment" // Start, resume, end and abort
+	phaseEvent      = "phase"
+	stateEvent      = "state" // Transitions of the snub sent to the firmware
+	waterEvent      = "water"
+	dutyEvent       = "duty" // Changes of the duty cycle commanded to the motor
+	faultEvent      = "fault"
+	operatorEvent   = "operator"
+	connectionEvent = "connection"
+	configEvent     = "config" // Snapshot of configuration
+)
+
+// Interval between records of the same fault, which tends to repeat on
+// every reading while it lasts
+const journalFaultInterval = time.Second * 10
+
+// Events which are too many to be shown on reports, they are on the journal
+var journalOnlyEvents = map[string]bool{stateEvent: true, dutyEvent: true}
+
+// Where an operator action came from
+const (
+	systraySource = "systray"
+	mqttSource    = "mqtt"
+)
+
+// EventData is what describes an event besides its description, as the
+// values involved
+type EventData map[string]interface{}
+
+// Journal is the append-only record of everything that happens during the
+// experiments of a bench, on the events file of each experiment
+type Journal struct {
+	bench        *Bench
+	mux          sync.Mutex
+	experimentID int                  // Running, receives the events of the bench, 0 if there is none
+	lastFaults   map[string]time.Time // By description
+}
+
+// Starts recording the events of the bench on the journal of experiment,
+// beginning by a snapshot of configuration
+func (journal *Journal) open(id int) {
+	journal.mux.Lock()
+	journal.experimentID = id
+	journal.lastFaults = map[string]time.Time{}
+	journal.mux.Unlock()
+
+	if err := experimentLogs.open(id); err != nil {
+		journal.bench.logger().WithField(experimentField, id).WithError(err).Error("Wasn't possible to open log file of experiment")
+	}
+
+	journal.record(configEvent, configSnapshot(getConfig()), "Configuração no início do ensaio")
+}
+
+// Stops recording the events of the bench, the experiment ended
+func (journal *Journal) close() {
+	journal.mux.Lock()
+	id := journal.experimentID
+	journal.experimentID = 0
+	journal.mux.Unlock()
+
+	experimentLogs.close(id)
+}
+
+// Records an event of the bench on the journal of the experiment running,
+// if there is one
+func (journal *Journal) record(eventType string, data EventData, format string, args ...interface{}) {
+	journal.mux.Lock()
+	id := journal.experimentID
+	journal.mux.Unlock()
+
+	if id != 0 {
+		journal.append(id, eventType, data, format, args...)
+	}
+}
+
+// Records a fault of the bench, the same one only once by interval
+func (journal *Journal) fault(data EventData, format string, args ...interface{}) {
+	description := fmt.Sprintf(format, args...)
+
+	journal.mux.Lock()
+	last, exists := journal.lastFaults[description]
+	isRecorded := journal.experimentID != 0 && (!exists || time.Since(last) > journalFaultInterval)
+	if isRecorded {
+		journal.lastFaults[description] = time.Now()
+	}
+	journal.mux.Unlock()
+
+	if isRecorded {
+		journal.record(faultEvent, data, "%v", description)
+	}
+}
+
+// Appends an event to the journal of experiment id and publishes it
+func (journal *Journal) append(id int, eventType string, data EventData, format string, args ...interface{}) {
+	event := Event{Time: time.Now(), Type: eventType, Description: fmt.Sprintf(format, args...), Data: data}
+	encoded, _ := json.Marshal(event)
+
+	journal.mux.Lock()
+	err := appendLine(path.Join(getExperimentFolder(id), eventsFileName), encoded)
+	journal.mux.Unlock()
+
+	if err != nil {
+		journal.bench.logger().WithField(experimentField, id).WithError(err).Error("Wasn't possible to record event")
+	}
+
+	published, _ := json.Marshal(struct {
+		ExperimentID int `json:"experimentId"`
+		Event
+	}{id, event})
+	journal.bench.publishData(string(published), mqttSubchannelEvent)
+}
+
+// Records an event of the experiment on its journal
+func (experiment *Experiment) recordEvent(eventType string, data EventData, format string, args ...interface{}) {
+	experiment.bench.journal.append(experiment.id, eventType, data, format, args...)
+}
+
+// Records an event of the snub on the journal of its experiment
+func (snub *Snub) recordEvent(eventType string, data EventData, format string, args ...interface{}) {
+	if snub.bench != nil && snub.experimentID != 0 {
+		snub.bench.journal.append(snub.experimentID, eventType, data, format, args...)
+	}
+}
+
+// Records an event on the journals of every bench running an experiment
+func recordEventOnBenches(eventType string, data EventData, format string, args ...interface{}) {
+	for _, bench := range benches {
+		bench.journal.record(eventType, data, format, args...)
+	}
+}
+
+// Parameters of configuration by their keys, without secrets
+func configSnapshot(config ConfigFile) EventData {
+	snapshot := EventData{}
+
+	value := reflect.ValueOf(config)
+	for _, field := range configFields() {
+		snapshot[configKey(field.Name)] = value.FieldByName(field.Name).Interface()
+	}
+
+	if config.MqttKey != "" {
+		snapshot[configKey("MqttKey")] = "********"
+	}
+
+	return snapshot
+}
+
+// Prints the journal of a recorded experiment by command line, optionally
+// only the events of the given types
+func runEventsCommandLine(args []string) bool {
+	if len(args) < 1 {
+		fmt.Println("Uso: unbrake-local events <id> [tipos...]")
+		return false
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Println("Id de ensaio inválido: ", args[0])
+		return false
+	}
+
+	events, err := readEvents(path.Join(getExperimentFolder(id), eventsFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("Ensaio %v sem eventos gravados\n", id)
+		} else {
+			fmt.Println("Não foi possível ler os eventos: ", err)
+		}
+		return false
+	}
+
+	types := map[string]bool{}
+	for _, eventType := range args[1:] {
+		types[eventType] = true
+	}
+
+	for _, event := range events {
+		if len(types) > 0 && !types[event.Type] {
+			continue
+		}
+
+		line := fmt.Sprintf("%v  %-10v  %v", event.Time.Format("2006-01-02 15:04:05.000"), event.Type, event.Description)
+		if len(event.Data) > 0 {
+			data, _ := json.Marshal(event.Data)
+			line += "  " + string(data)
+		}
+		fmt.Println(line)
+	}
+
+	return false
+}
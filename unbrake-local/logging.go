@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Formats of log lines
+const (
+	jsonLogFormat   = "json"
+	logfmtLogFormat = "logfmt"
+)
+
+const (
+	defaultLogLevel        = logrus.InfoLevel
+	defaultLogMaxSize      = 50 // MB, file is rotated when bigger
+	defaultLogMaxAge       = 30 // days, older rotated files are removed
+	experimentLogFileName  = "experiment.log"
+	mqttSubchannelLogLevel = "/logLevel"
+)
+
+// Fields identifying where a log line comes from
+const (
+	experimentField = "experiment"
+	snubField       = "snub"
+	stateField      = "state"
+)
+
+var (
+	logger         = logrus.New()
+	logRotation    *lumberjack.Logger
+	logRotationMux sync.Mutex
+)
+
+// Creates application folder and starts logging to a rotated file on it.
+// Returns the file, to be closed at the end
+func getLogFile() *lumberjack.Logger {
+	logPath := getLogPath()
+	os.MkdirAll(logPath, os.ModePerm)
+
+	logRotation = newLogRotation(path.Join(logPath, logFilePath))
+
+	logger.SetOutput(logRotation)
+	logger.SetLevel(defaultLogLevel)
+	logger.AddHook(experimentLogs)
+
+	// Libraries log through standard logger
+	log.SetFlags(0)
+	log.SetOutput(logger.WriterLevel(logrus.InfoLevel))
+
+	go rotateLogDaily()
+
+	return logRotation
+}
+
+func newLogRotation(filename string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:  filename,
+		MaxSize:   defaultLogMaxSize,
+		MaxAge:    defaultLogMaxAge,
+		LocalTime: true,
+		Compress:  true,
+	}
+}
+
+// Applies the settings of logging from configuration file
+func configureLogging() {
+	config := getConfig()
+
+	if config.LogFormat == jsonLogFormat {
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339Nano, DisableColors: true})
+	}
+
+	logRotationMux.Lock()
+	if logRotation != nil && (logRotation.MaxSize != config.LogMaxSize ||
+		logRotation.MaxAge != config.LogMaxAge || logRotation.MaxBackups != config.LogMaxBackups) {
+
+		// Settings of a file being written can't be changed, so it's replaced
+		rotation := newLogRotation(logRotation.Filename)
+		rotation.MaxSize, rotation.MaxAge, rotation.MaxBackups = config.LogMaxSize, config.LogMaxAge, config.LogMaxBackups
+
+		logger.SetOutput(rotation)
+		logRotation.Close()
+		logRotation = rotation
+	}
+	logRotationMux.Unlock()
+
+	if err := setLogLevel(config.LogLevel); err != nil {
+		logger.WithError(err).Warn("Invalid log level, using default")
+	}
+}
+
+func setLogLevel(name string) error {
+	level, err := logrus.ParseLevel(strings.TrimSpace(name))
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(level)
+	logger.WithField("level", level).Info("Log level changed")
+
+	return nil
+}
+
+// Rotates log file at every midnight, besides when it's too big
+func rotateLogDaily() {
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		time.Sleep(midnight.Sub(now))
+
+		logRotationMux.Lock()
+		err := logRotation.Rotate()
+		logRotationMux.Unlock()
+
+		if err != nil {
+			logger.WithError(err).Error("Wasn't possible to rotate log file")
+		}
+	}
+}
+
+// Changes log level by MQTT, while application is running
+func handleLogLevelReceiving() {
+	mainBench().subscribeMqtt(mqttSubchannelLogLevel, func(_ *emitter.Client, msg emitter.Message) {
+		if err := setLogLevel(string(msg.Payload())); err != nil {
+			logger.WithError(err).Warn("Invalid log level received")
+		}
+	})
+}
+
+// Copies lines about an experiment to a log file on the folder of the
+// experiment, while its journal is open. Benches run experiments at the same
+// time, so there is a file by experiment
+type experimentLogHook struct {
+	mux   sync.Mutex
+	files map[int]*os.File // By experiment id
+}
+
+var experimentLogs = &experimentLogHook{files: map[int]*os.File{}}
+
+// Starts copying the lines about experiment id to its log file
+func (hook *experimentLogHook) open(id int) error {
+	folder := getExperimentFolder(id)
+	os.MkdirAll(folder, os.ModePerm)
+
+	file, err := os.OpenFile(path.Join(folder, experimentLogFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	hook.mux.Lock()
+	defer hook.mux.Unlock()
+
+	if previous, exists := hook.files[id]; exists {
+		previous.Close()
+	}
+	hook.files[id] = file
+
+	return nil
+}
+
+// Stops copying the lines about experiment id, closing its log file
+func (hook *experimentLogHook) close(id int) {
+	hook.mux.Lock()
+	defer hook.mux.Unlock()
+
+	if file, exists := hook.files[id]; exists {
+		file.Close()
+		delete(hook.files, id)
+	}
+}
+
+func (hook *experimentLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *experimentLogHook) Fire(entry *logrus.Entry) error {
+	id, isAboutExperiment := entry.Data[experimentField].(int)
+	if !isAboutExperiment || id <= 0 {
+		return nil
+	}
+
+	line, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	hook.mux.Lock()
+	defer hook.mux.Unlock()
+
+	file, isOpen := hook.files[id]
+	if !isOpen {
+		return nil
+	}
+
+	_, err = file.Write(line)
+	return err
+}
+
+// Logger with the current position of the experiment
+func (experiment *Experiment) logger() *logrus.Entry {
+	return experiment.snub.logger()
+}
+
+// Logger with the current position of the snub
+func (snub *Snub) logger() *logrus.Entry {
+	entry := logrus.NewEntry(logger)
+	if snub.bench != nil {
+		entry = snub.bench.logger()
+	}
+
+	return entry.WithFields(logrus.Fields{
+		experimentField: snub.experimentID,
+		snubField:       snub.completed + 1,
+		stateField:      byteToStateName[snub.state],
+	})
+}
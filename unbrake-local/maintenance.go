@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/systray"
+	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Safety limits of maintenance mode
+const (
+	maintenanceMaxDutyCycle      = 60.0
+	maintenanceDutyCycleStep     = 10.0
+	maintenanceInactivityTimeout = time.Minute * 2
+	maintenanceMaxTemperature    = 300.0 // °C, above it the bench goes to cooldown with water
+	maintenanceCheckInterval     = time.Millisecond * 500
+)
+
+const (
+	mqttSubchannelMaintenance       = "/maintenance"
+	mqttSubchannelMaintenanceStatus = "/maintenanceStatus"
+)
+
+// Maintenance allows driving the bench outside of an experiment, used
+// when servicing pads and sensors
+type Maintenance struct {
+	bench        *Bench
+	mux          sync.Mutex
+	isActive     bool
+	dutyCycle    float64
+	isBraking    bool
+	isWaterOn    bool
+	isOverheated bool // Motor and brake are locked until the disc cools down
+	lastActivity time.Time
+	changedCh    chan bool // Notifies GUI about changes
+}
+
+// Start maintenance mode, not possible while running an experiment
+func (maintenance *Maintenance) Start() error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	if maintenance.isActive {
+		return nil
+	}
+
+	if !maintenance.bench.port.IsOpen() {
+		return errors.New("serial port not selected")
+	}
+
+	if !maintenance.bench.reserve() {
+		return errors.New("experiment running")
+	}
+
+	maintenance.isActive = true
+	maintenance.dutyCycle = 0
+	maintenance.isBraking = false
+	maintenance.isWaterOn = false
+	maintenance.isOverheated = false
+	maintenance.lastActivity = time.Now()
+	maintenance.apply()
+
+	maintenance.bench.logger().Info("Maintenance mode started")
+	go maintenance.watch()
+
+	return nil
+}
+
+// Stop maintenance mode putting bench back on cooldown
+func (maintenance *Maintenance) Stop() {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	if !maintenance.isActive {
+		return
+	}
+
+	maintenance.dutyCycle = 0
+	maintenance.isBraking = false
+	maintenance.isWaterOn = false
+	maintenance.apply()
+
+	maintenance.isActive = false
+	maintenance.bench.release()
+
+	maintenance.bench.logger().Info("Maintenance mode finished")
+}
+
+// IsActive tells whether maintenance mode is started
+func (maintenance *Maintenance) IsActive() bool {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.isActive
+}
+
+// SetDutyCycle of motor, in percent, limited by maintenanceMaxDutyCycle
+func (maintenance *Maintenance) SetDutyCycle(duty float64) error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.setDutyCycle(duty)
+}
+
+// StepDutyCycle changes the duty cycle of motor by step, in percent
+func (maintenance *Maintenance) StepDutyCycle(step float64) error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.setDutyCycle(maintenance.dutyCycle + step)
+}
+
+// Must be called holding the mutex
+func (maintenance *Maintenance) setDutyCycle(duty float64) error {
+	if !maintenance.isActive {
+		return errors.New("maintenance mode not started")
+	}
+
+	if duty < 0 || duty > maintenanceMaxDutyCycle {
+		return fmt.Errorf("duty cycle must be between 0 and %v", maintenanceMaxDutyCycle)
+	}
+
+	if duty > 0 && maintenance.isBraking {
+		return errors.New("release brake before accelerating")
+	}
+
+	if duty > 0 {
+		if err := maintenance.checkInterlock(); err != nil {
+			return err
+		}
+	}
+
+	maintenance.dutyCycle = duty
+	maintenance.lastActivity = time.Now()
+	maintenance.apply()
+
+	return nil
+}
+
+// SetBrake engages or releases brake, motor is turned off when braking
+func (maintenance *Maintenance) SetBrake(isBraking bool) error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.setBrake(isBraking)
+}
+
+// ToggleBrake engages the brake if it's released, otherwise releases it
+func (maintenance *Maintenance) ToggleBrake() error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.setBrake(!maintenance.isBraking)
+}
+
+// Must be called holding the mutex
+func (maintenance *Maintenance) setBrake(isBraking bool) error {
+	if !maintenance.isActive {
+		return errors.New("maintenance mode not started")
+	}
+
+	if isBraking {
+		if err := maintenance.checkInterlock(); err != nil {
+			return err
+		}
+	}
+
+	maintenance.isBraking = isBraking
+	if isBraking {
+		maintenance.dutyCycle = 0
+	}
+	maintenance.lastActivity = time.Now()
+	maintenance.apply()
+
+	return nil
+}
+
+// SetWater turns water on or off
+func (maintenance *Maintenance) SetWater(isWaterOn bool) error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.setWater(isWaterOn)
+}
+
+// ToggleWater turns water on if it's off, otherwise turns it off
+func (maintenance *Maintenance) ToggleWater() error {
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.setWater(!maintenance.isWaterOn)
+}
+
+// Must be called holding the mutex
+func (maintenance *Maintenance) setWater(isWaterOn bool) error {
+	if !maintenance.isActive {
+		return errors.New("maintenance mode not started")
+	}
+
+	if !isWaterOn && maintenance.isOverheated {
+		return fmt.Errorf("temperature above %v °C, water stays on until it cools down", maintenanceMaxTemperature)
+	}
+
+	maintenance.isWaterOn = isWaterOn
+	maintenance.lastActivity = time.Now()
+	maintenance.apply()
+
+	return nil
+}
+
+// Writes current state to serial, must be called holding the mutex
+func (maintenance *Maintenance) apply() {
+	state := cooldown
+	if maintenance.isBraking {
+		state = braking
+	} else if maintenance.dutyCycle > 0 {
+		state = acelerating
+	}
+
+	if maintenance.isWaterOn {
+		state = offToOnWater[state]
+	}
+
+	bench := maintenance.bench
+
+	bench.port.Write([]byte(state))
+	if state == acelerating || state == aceleratingWater {
+		bench.writeDutyCycle(maintenance.dutyCycle)
+	}
+
+	bench.logger().WithFields(logrus.Fields{stateField: byteToStateName[state], "dutyCycle": maintenance.dutyCycle}).Info("Maintenance outputs changed")
+
+	if getWritingClient() != nil { // Not connected when run by command line
+		bench.publishData(maintenance.status(), mqttSubchannelMaintenanceStatus)
+		bench.publishData(byteToStateName[state], mqttSubchannelSnubState)
+	}
+
+	select {
+	case maintenance.changedCh <- true:
+	default:
+	}
+}
+
+func (maintenance *Maintenance) status() string {
+	if !maintenance.isActive {
+		return "inactive"
+	}
+
+	return fmt.Sprintf("dutyCycle: %v, braking: %v, water: %v, overheated: %v",
+		maintenance.dutyCycle, maintenance.isBraking, maintenance.isWaterOn, maintenance.isOverheated)
+}
+
+// Motor and brake can only be used while temperatures are watched and under
+// the limit, must be called holding the mutex
+func (maintenance *Maintenance) checkInterlock() error {
+	if maintenance.bench.getActiveCalibration() == nil {
+		return errors.New("no calibration to watch temperatures, run an experiment before or give one on command line")
+	}
+	if maintenance.isOverheated {
+		return fmt.Errorf("temperature above %v °C, wait for it to cool down", maintenanceMaxTemperature)
+	}
+	return nil
+}
+
+// Applies the safety limits of maintenance mode while it's active
+func (maintenance *Maintenance) watch() {
+	for {
+		time.Sleep(maintenanceCheckInterval)
+
+		if !maintenance.check(time.Now()) {
+			return
+		}
+	}
+}
+
+// Goes back to cooldown if nothing was done for a while, and with water
+// if temperatures are above the limit. Returns false when maintenance
+// mode isn't active anymore
+func (maintenance *Maintenance) check(now time.Time) bool {
+	maintenance.mux.Lock()
+	isActive := maintenance.isActive
+	isInactive := now.Sub(maintenance.lastActivity) > maintenanceInactivityTimeout
+	maintenance.mux.Unlock()
+
+	if !isActive {
+		return false
+	}
+
+	if isInactive {
+		maintenance.bench.logger().Warn("Maintenance mode finished by inactivity")
+		maintenance.Stop()
+		return false
+	}
+
+	maintenance.checkTemperatures()
+	return true
+}
+
+// Turns motor and brake off and water on when a temperature goes above the
+// limit, they are locked until temperatures go below it
+func (maintenance *Maintenance) checkTemperatures() {
+	bench := maintenance.bench
+
+	reading, calibration := bench.getLastReading(), bench.getActiveCalibration()
+	if reading == nil || calibration == nil {
+		return
+	}
+
+	temperature1 := calibration.Convert(temperature1Idx, reading[temperature1Idx])
+	temperature2 := calibration.Convert(temperature2Idx, reading[temperature2Idx])
+	isOverheated := temperature1 > maintenanceMaxTemperature || temperature2 > maintenanceMaxTemperature
+
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	fields := logrus.Fields{"temperature1": temperature1, "temperature2": temperature2, "limit": maintenanceMaxTemperature}
+	if isOverheated && !maintenance.isOverheated {
+		bench.logger().WithFields(fields).Warn("Temperature above limit on maintenance mode, cooling down with water")
+		maintenance.isOverheated = true
+		maintenance.dutyCycle = 0
+		maintenance.isBraking = false
+		maintenance.isWaterOn = true
+		maintenance.apply()
+	} else if !isOverheated && maintenance.isOverheated {
+		bench.logger().WithFields(fields).Info("Temperature back under limit on maintenance mode")
+		maintenance.isOverheated = false
+		maintenance.apply()
+	}
+}
+
+// Returns last values read from the sensors of the bench, as text. Values
+// are on the units configured when there is a calibration to convert them
+func (bench *Bench) sensorsSummary() string {
+	reading := bench.getLastReading()
+	if reading == nil {
+		return tr("sem leituras")
+	}
+
+	calibration := bench.getActiveCalibration()
+	if calibration == nil {
+		return tr("freq: %v, temp: %v/%v, força: %v/%v, pressão: %v",
+			reading[frequencyIdx], reading[temperature1Idx], reading[temperature2Idx],
+			reading[brakingForce1Idx], reading[brakingForce2Idx], reading[pressureIdx])
+	}
+
+	converted := calibration.ConvertAll(reading)
+	return tr("velocidade: %v, temp: %v/%v, força: %v/%v, pressão: %v",
+		formatSpeed(converted[frequencyIdx], calibration.tireRadius),
+		formatTemperature(converted[temperature1Idx]), formatTemperature(converted[temperature2Idx]),
+		formatForce(converted[brakingForce1Idx]), formatForce(converted[brakingForce2Idx]),
+		formatNumber(converted[pressureIdx], 2)+" bar")
+}
+
+// Handles a maintenance command of the bench in text, as received from MQTT
+// or command line, returning the answer
+func (bench *Bench) handleMaintenanceCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	maintenance := &bench.maintenance
+
+	var err error
+
+	switch {
+	case args[0] == "start":
+		err = maintenance.Start()
+	case args[0] == "stop":
+		maintenance.Stop()
+	case args[0] == "duty" && len(args) == 2:
+		var duty float64
+		duty, err = strconv.ParseFloat(args[1], 64)
+		if err == nil {
+			err = maintenance.SetDutyCycle(duty)
+		}
+	case args[0] == "brake" && len(args) == 2:
+		err = maintenance.SetBrake(args[1] == "on")
+	case args[0] == "water" && len(args) == 2:
+		err = maintenance.SetWater(args[1] == "on")
+	case args[0] == "show":
+		return bench.sensorsSummary(), nil
+	default:
+		err = fmt.Errorf("invalid command: %v", command)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	maintenance.mux.Lock()
+	defer maintenance.mux.Unlock()
+
+	return maintenance.status(), nil
+}
+
+// Receives maintenance commands of the bench from MQTT
+func (bench *Bench) handleMaintenanceReceiving() {
+	bench.subscribeMqtt(mqttSubchannelMaintenance, func(_ *emitter.Client, msg emitter.Message) {
+		answer, err := bench.handleMaintenanceCommand(string(msg.Payload()))
+		if err != nil {
+			bench.logger().WithError(err).Warn("Invalid maintenance command")
+			answer = "error: " + err.Error()
+		}
+
+		bench.publishData(answer, mqttSubchannelMaintenanceStatus)
+	})
+}
+
+// Controls maintenance mode of the bench via GUI
+func handleMaintenanceSectionGUI(bench *Bench, addMenuItem menuAdder) {
+	maintenance := &bench.maintenance
+	maintenanceMenu := addMenuItem(tr("Manutenção"), tr("Operação manual da bancada"))
+
+	toggle := maintenanceMenu.AddSubMenuItem(tr("Iniciar modo manutenção"), tr("Opera a bancada fora de um ensaio"))
+	dutyCycle := maintenanceMenu.AddSubMenuItem(tr("Duty cycle: %v%%", 0), tr("Duty cycle atual do motor"))
+	dutyCycle.Disable()
+	increase := maintenanceMenu.AddSubMenuItem(tr("Aumentar duty cycle (+%v%%)", maintenanceDutyCycleStep), "")
+	decrease := maintenanceMenu.AddSubMenuItem(tr("Diminuir duty cycle (-%v%%)", maintenanceDutyCycleStep), "")
+	brake := maintenanceMenu.AddSubMenuItem(tr("Acionar freio"), "")
+	water := maintenanceMenu.AddSubMenuItem(tr("Ligar água"), "")
+	sensors := maintenanceMenu.AddSubMenuItem(tr("Sensores: %v", tr("sem leituras")), tr("Últimas leituras dos sensores"))
+	sensors.Disable()
+
+	controls := []*systray.MenuItem{increase, decrease, brake, water}
+
+	update := func() {
+		maintenance.mux.Lock()
+		defer maintenance.mux.Unlock()
+
+		for _, item := range controls {
+			if maintenance.isActive {
+				item.Enable()
+			} else {
+				item.Disable()
+			}
+		}
+
+		if maintenance.isActive {
+			toggle.SetTitle(tr("Encerrar modo manutenção"))
+		} else {
+			toggle.SetTitle(tr("Iniciar modo manutenção"))
+		}
+
+		dutyCycle.SetTitle(tr("Duty cycle: %v%%", maintenance.dutyCycle))
+
+		if maintenance.isBraking {
+			brake.SetTitle(tr("Soltar freio"))
+		} else {
+			brake.SetTitle(tr("Acionar freio"))
+		}
+
+		if maintenance.isWaterOn {
+			water.SetTitle(tr("Desligar água"))
+		} else {
+			water.SetTitle(tr("Ligar água"))
+		}
+	}
+	update()
+
+	logError := func(err error) {
+		if err != nil {
+			bench.logger().WithError(err).Warn("Maintenance command refused")
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-maintenance.changedCh:
+				update()
+			case <-toggle.ClickedCh:
+				if maintenance.IsActive() {
+					maintenance.Stop()
+				} else {
+					logError(maintenance.Start())
+				}
+			case <-increase.ClickedCh:
+				logError(maintenance.StepDutyCycle(maintenanceDutyCycleStep))
+			case <-decrease.ClickedCh:
+				logError(maintenance.StepDutyCycle(-maintenanceDutyCycleStep))
+			case <-brake.ClickedCh:
+				logError(maintenance.ToggleBrake())
+			case <-water.ClickedCh:
+				logError(maintenance.ToggleWater())
+			case <-time.After(time.Second):
+				if maintenance.IsActive() {
+					sensors.SetTitle(tr("Sensores: %v", bench.sensorsSummary()))
+				}
+			}
+		}
+	}()
+}
+
+// Maintenance mode by command line, without GUI or MQTT. Commands are read
+// from standard input. Temperatures are watched with the calibration of the
+// experiment given, without it motor and brake can't be used
+func runMaintenanceCommandLine(args []string) bool {
+	var arg string
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	bench, serialPortName := commandLineBench(arg)
+
+	if serialPortName == "" {
+		fmt.Println("Informe a porta serial: unbrake-local maintenance <porta> [ensaio]")
+		return false
+	}
+
+	if len(args) > 1 {
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			fmt.Println("Não foi possível ler o ensaio: ", err)
+			return false
+		}
+
+		experiment, err := ExperimentFromJSON(nil, data)
+		if err != nil {
+			fmt.Printf("Ensaio inválido:\n%v\n", err)
+			return false
+		}
+		bench.setActiveCalibration(&experiment.calibration)
+	}
+
+	if err := bench.port.Open(serialPortName); err != nil {
+		fmt.Println("Não foi possível abrir a porta serial: ", err)
+		return false
+	}
+	defer bench.port.Close()
+
+	if !bench.isCorrectDevice() {
+		fmt.Println("A porta selecionada não é do simulador de frenagem")
+		return false
+	}
+
+	defer bench.acquireInBackground()()
+
+	maintenance := &bench.maintenance
+	if err := maintenance.Start(); err != nil {
+		fmt.Println("Não foi possível iniciar o modo manutenção: ", err)
+		return false
+	}
+	defer maintenance.Stop()
+
+	fmt.Println("Modo manutenção. Comandos: duty <percentual>, brake on|off, water on|off, show, exit")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for fmt.Print("> "); scanner.Scan(); fmt.Print("> ") {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "exit" {
+			break
+		}
+		if command == "" {
+			continue
+		}
+
+		answer, err := bench.handleMaintenanceCommand(command)
+		if err != nil {
+			fmt.Println("Erro: ", err)
+			continue
+		}
+		fmt.Println(answer)
+
+		maintenance.mux.Lock()
+		isActive := maintenance.isActive
+		maintenance.mux.Unlock()
+
+		if !isActive {
+			fmt.Println("Modo manutenção encerrado")
+			break
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	mqttSubchannelSnubMetrics = "/snubMetrics"
+	experimentsFolderName     = "experiments"
+	snubMetricsFileName       = "snubs.jsonl"
+)
+
+const recorderBufferSize = 64 // Frames, recorder writes to disk and may be slower sometimes
+
+// BrakeParameters are the geometry and inertia of the bench needed for
+// computing brake metrics
+type BrakeParameters struct {
+	leverRadius     float64 // m, arm of the force sensors
+	effectiveRadius float64 // m, effective friction radius of the disc
+	pistonArea      float64 // cm², total area of caliper pistons on one side
+	inertia         float64 // kg·m², of the flywheel
+	wheelRadius     float64 // m
+}
+
+// SnubMetrics are the standard brake metrics of a snub
+type SnubMetrics struct {
+	Snub               int     `json:"snub"`
+	Phase              string  `json:"phase"`
+	InitialSpeed       float64 `json:"initial_speed"`       // km/h
+	FinalSpeed         float64 `json:"final_speed"`         // km/h
+	MeanTorque         float64 `json:"mean_torque"`         // N·m
+	PeakTorque         float64 `json:"peak_torque"`         // N·m
+	MeanPressure       float64 `json:"mean_pressure"`       // bar
+	Friction           float64 `json:"friction"`            // µ, mean while braking
+	MFDD               float64 `json:"mfdd"`                // m/s², mean fully developed deceleration
+	StoppingTime       float64 `json:"stopping_time"`       // s
+	StoppingDistance   float64 `json:"stopping_distance"`   // m
+	Energy             float64 `json:"energy"`              // J
+	InitialTemperature float64 `json:"initial_temperature"` // °C
+	PeakTemperature    float64 `json:"peak_temperature"`    // °C
+}
+
+// Values converted to engineering units read during a snub
+type metricsSample struct {
+	time      time.Time
+	isBraking bool
+	values    []float64
+}
+
+// Keeps the samples of current snub
+type metricsRecorder struct {
+	mux     sync.Mutex
+	samples []metricsSample
+}
+
+func (recorder *metricsRecorder) add(sample metricsSample) {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+
+	recorder.samples = append(recorder.samples, sample)
+}
+
+// Returns samples of the snub and starts a new one
+func (recorder *metricsRecorder) finish() []metricsSample {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+
+	samples := recorder.samples
+	recorder.samples = nil
+
+	return samples
+}
+
+func maxTemperature(values []float64) float64 {
+	return math.Max(values[temperature1Idx], values[temperature2Idx])
+}
+
+// Torque is measured by both force sensors on the lever
+func brakeTorque(values []float64, parameters BrakeParameters) float64 {
+	return (values[brakingForce1Idx] + values[brakingForce2Idx]) * parameters.leverRadius
+}
+
+// Computes metrics from the samples of a snub, speeds are in km/h
+func computeSnubMetrics(samples []metricsSample, parameters BrakeParameters) SnubMetrics {
+	var metrics SnubMetrics
+
+	var braking []metricsSample
+	for _, sample := range samples {
+		metrics.PeakTemperature = math.Max(metrics.PeakTemperature, maxTemperature(sample.values))
+		if sample.isBraking {
+			braking = append(braking, sample)
+		}
+	}
+
+	if len(braking) == 0 {
+		return metrics
+	}
+
+	first, last := braking[0], braking[len(braking)-1]
+	metrics.InitialSpeed = first.values[frequencyIdx]
+	metrics.FinalSpeed = last.values[frequencyIdx]
+	metrics.InitialTemperature = maxTemperature(first.values)
+	metrics.StoppingTime = last.time.Sub(first.time).Seconds()
+
+	var (
+		frictionSamples           int
+		distances                 = make([]float64, len(braking))
+		speedBegin, speedEnd      = 0.8 * metrics.InitialSpeed, 0.1 * metrics.InitialSpeed
+		distanceBegin, foundBegin = 0.0, false
+		distanceEnd, foundEnd     = 0.0, false
+		speedAtBegin, speedAtEnd  float64
+	)
+
+	for i, sample := range braking {
+		torque := brakeTorque(sample.values, parameters)
+		pressure := sample.values[pressureIdx]
+
+		metrics.MeanTorque += torque
+		metrics.PeakTorque = math.Max(metrics.PeakTorque, torque)
+		metrics.MeanPressure += pressure
+
+		clampForce := pressure * 10 * parameters.pistonArea // bar * cm² to N
+		if clampForce > 0 && parameters.effectiveRadius > 0 {
+			metrics.Friction += torque / (2 * clampForce * parameters.effectiveRadius) // Two faces of the disc
+			frictionSamples++
+		}
+
+		if i > 0 {
+			dt := sample.time.Sub(braking[i-1].time).Seconds()
+			meanSpeed := (sample.values[frequencyIdx] + braking[i-1].values[frequencyIdx]) / 2
+			distances[i] = distances[i-1] + (meanSpeed/3.6)*dt
+		}
+
+		speed := sample.values[frequencyIdx]
+		if !foundBegin && speed <= speedBegin {
+			distanceBegin, speedAtBegin, foundBegin = distances[i], speed, true
+		}
+		if foundBegin && speed >= speedEnd {
+			distanceEnd, speedAtEnd, foundEnd = distances[i], speed, true
+		}
+	}
+
+	metrics.MeanTorque /= float64(len(braking))
+	metrics.MeanPressure /= float64(len(braking))
+	metrics.StoppingDistance = distances[len(distances)-1]
+
+	if frictionSamples > 0 {
+		metrics.Friction /= float64(frictionSamples)
+	}
+
+	// As in ECE R13, ending at 10% of initial speed or where braking stopped
+	if foundBegin && foundEnd && distanceEnd > distanceBegin {
+		metrics.MFDD = (speedAtBegin*speedAtBegin - speedAtEnd*speedAtEnd) / (25.92 * (distanceEnd - distanceBegin))
+	}
+
+	if parameters.wheelRadius > 0 {
+		initialAngularSpeed := (metrics.InitialSpeed / 3.6) / parameters.wheelRadius
+		finalAngularSpeed := (metrics.FinalSpeed / 3.6) / parameters.wheelRadius
+		metrics.Energy = parameters.inertia * (initialAngularSpeed*initialAngularSpeed - finalAngularSpeed*finalAngularSpeed) / 2
+	}
+
+	return metrics
+}
+
+// Records converted values while the experiment is running
+func (experiment *Experiment) watchMetrics() {
+	subscription := experiment.bench.sampleBus.Subscribe("recorder", dropNewestPolicy, recorderBufferSize, getControlDecimation)
+	defer experiment.bench.sampleBus.Unsubscribe(subscription)
+
+	experiment.watch(func() {
+		frame, ok := experiment.nextSample(subscription)
+		if !ok {
+			return
+		}
+		state := experiment.snub.state
+
+		sample := metricsSample{
+			time:      frame.Time,
+			isBraking: state == braking || state == brakingWater,
+			values:    experiment.calibration.ConvertAll(frame.Filtered),
+		}
+
+		experiment.metricsRecorder.add(sample)
+		experiment.recordSample(sample, state)
+	})
+}
+
+// Computes, publishes and stores metrics of the snub just finished
+func (experiment *Experiment) finishSnubMetrics() {
+	metrics := computeSnubMetrics(experiment.metricsRecorder.finish(), experiment.brakeParameters)
+	metrics.Snub = experiment.snub.completed
+	metrics.Phase = experiment.phases[experiment.currentPhase].name
+
+	experiment.snubMetrics = append(experiment.snubMetrics, metrics)
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to encode snub metrics")
+		return
+	}
+
+	experiment.bench.publishData(string(data), mqttSubchannelSnubMetrics)
+	experiment.logger().WithField("metrics", string(data)).Info("Snub metrics computed")
+
+	if err = appendLine(path.Join(getExperimentFolder(experiment.id), snubMetricsFileName), data); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to store snub metrics")
+	}
+}
+
+// Folder where data of an experiment is stored
+func getExperimentFolder(id int) string {
+	return path.Join(appDirs.Data, experimentsFolderName, strconv.Itoa(id))
+}
+
+func appendLine(filePath string, data []byte) error {
+	os.MkdirAll(path.Dir(filePath), os.ModePerm)
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
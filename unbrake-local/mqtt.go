@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	emitter "github.com/icaropires/go/v2"
+)
+
+const mqttDisconnectWait = time.Millisecond * 250
+
+var (
+	mqttMux           sync.RWMutex // Clients are replaced when broker changes
+	clientWriting     *emitter.Client
+	clientReading     *emitter.Client
+	mqttSubscriptions = map[mqttSubscription]emitter.MessageHandler{} // Subscribed again on reconnection
+)
+
+// Subchannel of a bench subscribed
+type mqttSubscription struct {
+	bench      *Bench
+	subchannel string
+}
+
+func getWritingClient() *emitter.Client {
+	mqttMux.RLock()
+	defer mqttMux.RUnlock()
+
+	return clientWriting
+}
+
+func getReadingClient() *emitter.Client {
+	mqttMux.RLock()
+	defer mqttMux.RUnlock()
+
+	return clientReading
+}
+
+// Connects both clients to the broker set on configuration
+func connectMqtt() {
+	writing, _ := emitter.Connect(
+		getMqttHost(),
+		func(_ *emitter.Client, msg emitter.Message) {},
+		emitter.WithConnectTimeout(time.Second*2),
+		emitter.WithAutoReconnect(true),
+		emitter.WithPingTimeout(time.Second*2),
+	)
+
+	reading, _ := emitter.Connect(
+		getMqttHost(),
+		func(_ *emitter.Client, msg emitter.Message) {},
+		emitter.WithConnectTimeout(time.Second*2),
+		emitter.WithAutoReconnect(true),
+		emitter.WithPingTimeout(time.Second*2),
+	)
+
+	writing.OnConnect(func(_ *emitter.Client) {
+		connectStatusCh <- tr("Conectado")
+		logger.Info("Connected with writing broker successfully")
+		recordEventOnBenches(connectionEvent, EventData{"client": "writing", "connected": true}, "Conectado ao broker MQTT de escrita")
+
+		for _, bench := range benches {
+			go bench.publishUnfinishedExperiment()
+			go bench.publishQueue()
+			go bench.publishExperimentSchema()
+			go bench.publishDisplayUnits()
+		}
+	})
+
+	reading.OnConnect(func(_ *emitter.Client) {
+		logger.Info("Connected with reading broker successfully")
+		recordEventOnBenches(connectionEvent, EventData{"client": "reading", "connected": true}, "Conectado ao broker MQTT de leitura")
+
+		go resubscribeMqtt()
+	})
+
+	writing.OnDisconnect(func(_ *emitter.Client, err error) {
+		connectStatusCh <- tr("Desconectado")
+		logger.WithError(err).Warn("Disconnected from writing broker")
+		recordEventOnBenches(connectionEvent, EventData{"client": "writing", "connected": false, "error": fmt.Sprint(err)}, "Conexão com o broker MQTT de escrita perdida")
+	})
+
+	reading.OnDisconnect(func(_ *emitter.Client, err error) {
+		connectStatusCh <- tr("Desconectado")
+		logger.WithError(err).Warn("Disconnected from reading broker")
+		recordEventOnBenches(connectionEvent, EventData{"client": "reading", "connected": false, "error": fmt.Sprint(err)}, "Conexão com o broker MQTT de leitura perdida")
+	})
+
+	mqttMux.Lock()
+	clientWriting, clientReading = writing, reading
+	mqttMux.Unlock()
+
+	if writing.IsConnected() {
+		connectStatusCh <- tr("Conectado")
+	} else {
+		connectStatusCh <- tr("Desconectado")
+	}
+}
+
+// Subscribes to a subchannel of the bench, which is kept subscribed when
+// the connection is lost or the broker, the key or the prefix of channels change
+func (bench *Bench) subscribeMqtt(subchannel string, handler emitter.MessageHandler) {
+	mqttMux.Lock()
+	mqttSubscriptions[mqttSubscription{bench, subchannel}] = handler
+	client := clientReading
+	mqttMux.Unlock()
+
+	if key := getMqttKey(); key != "" && client != nil {
+		client.Subscribe(key, bench.getMqttChannelPrefix()+subchannel, handler)
+	}
+}
+
+// Subscribes again to every subchannel
+func resubscribeMqtt() {
+	mqttMux.RLock()
+	subscriptions := make(map[mqttSubscription]emitter.MessageHandler, len(mqttSubscriptions))
+	for subscription, handler := range mqttSubscriptions {
+		subscriptions[subscription] = handler
+	}
+	mqttMux.RUnlock()
+
+	for subscription, handler := range subscriptions {
+		subscription.bench.subscribeMqtt(subscription.subchannel, handler)
+	}
+}
+
+// Disconnects from current broker and connects to the one configured,
+// subscribing again to every subchannel
+func reconnectMqtt() {
+	for _, client := range []*emitter.Client{getWritingClient(), getReadingClient()} {
+		if client != nil {
+			client.Disconnect(mqttDisconnectWait)
+		}
+	}
+
+	connectMqtt()
+	resubscribeMqtt()
+
+	go testKeys()
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/tarm/serial"
-	"log"
 	"sync"
 	"time"
 )
@@ -10,6 +9,8 @@ import (
 // Port represents the serial inteface with the connected device
 type Port struct {
 	port     *serial.Port
+	name     string
+	bench    string // Name, for metrics
 	readMux  sync.Mutex
 	writeMux sync.Mutex
 }
@@ -25,11 +26,12 @@ func (port *Port) Write(data []byte) int {
 	if port.port != nil {
 		n, err = port.port.Write(data)
 		if err != nil {
-			log.Printf("Could not to write on port: %v", err)
+			logger.WithError(err).Error("Could not write on serial port")
+			serialErrorsMetric.WithLabelValues(port.bench, "write").Inc()
 			n = -1
 		}
 	} else {
-		log.Println("Was tried to write in a nil port")
+		logger.Error("Tried to write on a serial port not opened")
 		n = -1
 	}
 	return n
@@ -47,10 +49,11 @@ func (port *Port) Read(data []byte) (int, error) {
 	if port.port != nil {
 		n, err = port.port.Read(data)
 		if err != nil {
-			log.Printf("Was not possible to read from serial port: %v", err)
+			logger.WithError(err).Error("Could not read from serial port")
+			serialErrorsMetric.WithLabelValues(port.bench, "read").Inc()
 		}
 	} else {
-		log.Println("Was tried te read from a nil port")
+		logger.Error("Tried to read from a serial port not opened")
 	}
 
 	return n, err
@@ -69,14 +72,15 @@ func (port *Port) Open(portName string) error {
 
 	configuration := &serial.Config{
 		Name:        portName,
-		Baud:        baudRate,
+		Baud:        getBaudRate(),
 		ReadTimeout: time.Second,
 	}
 
 	port.port, err = serial.OpenPort(configuration)
+	port.name = portName
 
 	if err != nil {
-		log.Printf("Was not possible to open the serial port: %v", err)
+		logger.WithError(err).Error("Could not open serial port")
 	}
 
 	return err
@@ -87,6 +91,14 @@ func (port *Port) IsOpen() bool {
 	return port.port != nil
 }
 
+// Name of the port last opened
+func (port *Port) Name() string {
+	port.writeMux.Lock()
+	defer port.writeMux.Unlock()
+
+	return port.name
+}
+
 // Flush to clean the buffer
 func (port *Port) Flush() {
 	port.port.Flush()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/getlantern/systray"
+	"github.com/sirupsen/logrus"
 )
 
 const checkedPrefix = "\u2713 "
@@ -13,17 +14,19 @@ type serialPortGUI struct {
 	title string
 }
 
-// Controls the serial ports selection via GUI
-func handlePortsSectionGUI() {
-	systray.AddSeparator()
-	portsTitle := systray.AddMenuItem("Portas", "Selecione a porta de leitura")
+// Controls the serial ports selection of the bench via GUI
+func handlePortsSectionGUI(bench *Bench, addMenuItem menuAdder) {
+	if len(benches) == 1 {
+		systray.AddSeparator()
+	}
+	portsTitle := addMenuItem(tr("Portas"), tr("Selecione a porta de leitura"))
 	portsTitle.Disable()
 
 	// Get available ports
 	portsNames := getSerialPorts()
 
-	// Add environment variable serial port if not already exists
-	found, userDefinedPort := false, getSerialPort()
+	// Add configured serial port if not already exists
+	found, userDefinedPort := false, bench.config.SerialPort
 	for i := range portsNames {
 		if portsNames[i] == userDefinedPort {
 			found = true
@@ -37,14 +40,21 @@ func handlePortsSectionGUI() {
 	// Create ports
 	ports := make([]serialPortGUI, len(portsNames))
 	for i, portName := range portsNames {
-		ports[i] = createPort(portName, "Select port")
+		ports[i] = createPort(addMenuItem, portName, tr("Selecionar porta"))
 	}
 
-	systray.AddSeparator()
+	if len(benches) == 1 {
+		systray.AddSeparator()
+	}
 
 	handleSelect := func(selected int, ports []serialPortGUI) {
-		if port.IsOpen() {
-			port.Close()
+		if other := findBenchByPort(ports[selected].title); other != nil && other != bench {
+			bench.logger().WithFields(logrus.Fields{"port": ports[selected].title, "usedBy": other.name}).Warn("Serial port already used by another bench")
+			return
+		}
+
+		if bench.port.IsOpen() {
+			bench.port.Close()
 		}
 		for i := range ports {
 			if i != selected {
@@ -53,7 +63,7 @@ func handlePortsSectionGUI() {
 		}
 
 		ports[selected].uncheck()
-		serialPortNameCh <- ports[selected].title
+		bench.serialPortNameCh <- ports[selected].title
 		ports[selected].check()
 	}
 
@@ -69,11 +79,11 @@ func handlePortsSectionGUI() {
 }
 
 // Creates a Serial on systray
-func createPort(title, tooltip string) serialPortGUI {
+func createPort(addMenuItem menuAdder, title, tooltip string) serialPortGUI {
 	var port serialPortGUI
 
 	port.title = title
-	port.item = systray.AddMenuItem(title, tooltip)
+	port.item = addMenuItem(title, tooltip)
 
 	return port
 }
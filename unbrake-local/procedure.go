@@ -0,0 +1,316 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const mqttSubchannelCurrentPhase = "/currentPhase"
+
+// Phase is a block of identical snubs of a test procedure, real brake
+// standards are sequences of phases like bedding-in, baseline, fade and recovery
+type Phase struct {
+	name                  string
+	totalOfSnubs          int
+	upperSpeedLimit       float64
+	lowerSpeedLimit       float64
+	delayAcelerateToBrake int
+	delayBrakeToCooldown  int
+	timeCooldown          int
+	temperatureLimit      float64
+	doEnableWater         bool
+	timeSleepWater        float64
+	cooldownTemperature   float64 // Initial brake temperature, if set ends cooldown instead of time
+	maxTimeCooldown       int
+	heatingTemperature    float64 // If set, phase ends when it's reached, snubs are a maximum
+	temperatureCondition  string
+	brakeMode             string
+	targetPressure        float64           // bar
+	targetDeceleration    float64           // m/s²
+	field                 string            // Where it's on the experiment received, for errors
+	keys                  map[string]string // Names of its parameters there by the legacy ones, nil if they're the same
+}
+
+// Which temperature sensors must reach a target temperature
+const (
+	anySensor   = "any"
+	bothSensors = "both"
+)
+
+// phaseData represents a phase as received on a procedure, keys follows
+// the ones used by the configuration of a legacy experiment
+type phaseData struct {
+	Name              string  `json:"name"`
+	Number            int     `json:"number"`
+	TimeBetweenCycles int     `json:"time_between_cycles"`
+	UpperLimit        int     `json:"upper_limit"`
+	InferiorLimit     int     `json:"inferior_limit"`
+	UpperTime         int     `json:"upper_time"`
+	LowerTime         int     `json:"inferior_time"`
+	EnableOutput      bool    `json:"enable_output"`
+	Temperature       float64 `json:"temperature"`
+	Time              float64 `json:"time"`
+
+	CooldownTemperature  float64 `json:"cooldown_temperature"`
+	CooldownMaxTime      int     `json:"cooldown_max_time"`
+	HeatingTemperature   float64 `json:"heating_temperature"`
+	TemperatureCondition string  `json:"temperature_condition"` // "any" (default) or "both"
+
+	BrakeMode          string  `json:"brake_mode"` // "on_off" (default), "pressure" or "deceleration"
+	TargetPressure     float64 `json:"target_pressure"`
+	TargetDeceleration float64 `json:"target_deceleration"`
+}
+
+func phaseFromDefinition(data PhaseDefinition) Phase {
+	temperatureCondition := data.TemperatureCondition
+	if temperatureCondition == "" {
+		temperatureCondition = anySensor
+	}
+
+	brakeMode := data.BrakeMode
+	if brakeMode == "" {
+		brakeMode = onOffBraking
+	}
+
+	return Phase{
+		name:                  data.Name,
+		totalOfSnubs:          data.Snubs,
+		upperSpeedLimit:       data.UpperSpeedKmh,
+		lowerSpeedLimit:       data.LowerSpeedKmh,
+		delayAcelerateToBrake: data.BrakeDelayS,
+		delayBrakeToCooldown:  data.ReleaseDelayS,
+		timeCooldown:          data.CooldownTimeS,
+		temperatureLimit:      data.TemperatureLimitC,
+		doEnableWater:         data.Water,
+		timeSleepWater:        data.WaterTimeS,
+		cooldownTemperature:   data.CooldownTemperatureC,
+		maxTimeCooldown:       data.CooldownMaxTimeS,
+		heatingTemperature:    data.HeatingTemperatureC,
+		temperatureCondition:  temperatureCondition,
+		brakeMode:             brakeMode,
+		targetPressure:        data.TargetPressureBar,
+		targetDeceleration:    data.TargetDecelerationMs2,
+		field:                 data.field,
+		keys:                  data.keys,
+	}
+}
+
+// Name of a parameter of the phase on the experiment received, given by
+// its legacy name
+func (phase *Phase) key(name string) string {
+	if key, ok := phase.keys[name]; ok {
+		return key
+	}
+	return name
+}
+
+// Returns the index of the phase the given snub (starting at 1) belongs to
+func (experiment *Experiment) phaseOfSnub(snub int) int {
+	last := 0
+	for i, phase := range experiment.phases {
+		last += phase.totalOfSnubs
+		if snub <= last {
+			return i
+		}
+	}
+	return len(experiment.phases) - 1
+}
+
+// Sets the parameters of the phase which the given snub (starting at 1)
+// belongs to as the current ones of experiment, returns true if phase changed
+func (experiment *Experiment) applyPhaseOfSnub(snub int) bool {
+	idx := experiment.phaseOfSnub(snub)
+	if idx < 0 || idx == experiment.currentPhase {
+		return false
+	}
+
+	phase := experiment.phases[idx]
+
+	experiment.snub.mux.Lock()
+	experiment.snub.upperSpeedLimit = phase.upperSpeedLimit
+	experiment.snub.lowerSpeedLimit = phase.lowerSpeedLimit
+	experiment.snub.delayAcelerateToBrake = phase.delayAcelerateToBrake
+	experiment.snub.delayBrakeToCooldown = phase.delayBrakeToCooldown
+	experiment.snub.timeCooldown = phase.timeCooldown
+	experiment.snub.maxTimeCooldown = phase.maxTimeCooldown
+	experiment.snub.isCooldownOver = nil
+	if phase.cooldownTemperature > 0 {
+		experiment.snub.isCooldownOver = func() bool {
+			temperatures, isRead := experiment.getTemperatures()
+			return isRead && phase.isCooldownOver(temperatures)
+		}
+	}
+	experiment.snub.mux.Unlock()
+
+	experiment.temperatureLimit = phase.temperatureLimit
+	experiment.doEnableWater = phase.doEnableWater
+	experiment.timeSleepWater = phase.timeSleepWater
+
+	experiment.currentPhase = idx
+
+	return true
+}
+
+// Transitions of snubs and phases, experiments and simulations decide them
+// by the same predicates. Speeds are in km/h and temperatures in °C
+
+// Braking starts at upper speed limit
+func isBrakingSpeed(speed, upperSpeedLimit float64) bool {
+	return speed >= upperSpeedLimit
+}
+
+// Braking ends below lower speed limit
+func isReleaseSpeed(speed, lowerSpeedLimit float64) bool {
+	return speed < lowerSpeedLimit
+}
+
+// Water is thrown above the temperature limit, on any sensor
+func isAboveTemperatureLimit(temperatures [2]float64, limit float64) bool {
+	return temperatures[0] > limit || temperatures[1] > limit
+}
+
+// Checks if disc temperatures are above (or below) target, on any or both sensors
+func isTemperatureReached(temperatures [2]float64, target float64, condition string, above bool) bool {
+	reached := 0
+	for _, temperature := range temperatures {
+		if (above && temperature >= target) || (!above && temperature <= target) {
+			reached++
+		}
+	}
+
+	if condition == bothSensors {
+		return reached == len(temperatures)
+	}
+	return reached > 0
+}
+
+// Cooldown by temperature ends when disc cools down to it
+func (phase *Phase) isCooldownOver(temperatures [2]float64) bool {
+	return isTemperatureReached(temperatures, phase.cooldownTemperature, phase.temperatureCondition, false)
+}
+
+// Heating phase ends when disc heats up to its temperature
+func (phase *Phase) isHeatingOver(temperatures [2]float64) bool {
+	return phase.heatingTemperature > 0 && isTemperatureReached(temperatures, phase.heatingTemperature, phase.temperatureCondition, true)
+}
+
+// Last disc temperatures read, false if none was read yet
+func (experiment *Experiment) getTemperatures() ([2]float64, bool) {
+	experiment.mux.Lock()
+	defer experiment.mux.Unlock()
+
+	return experiment.temperatures, experiment.hasTemperatures
+}
+
+// Ends the current phase if it's a heating one and its target temperature
+// was reached, remaining snubs of the phase are skipped
+func (experiment *Experiment) checkHeatingPhase() {
+	phase := experiment.phases[experiment.currentPhase]
+	if temperatures, isRead := experiment.getTemperatures(); !isRead || !phase.isHeatingOver(temperatures) {
+		return
+	}
+
+	endOfPhase := 0
+	for i := 0; i <= experiment.currentPhase; i++ {
+		endOfPhase += experiment.phases[i].totalOfSnubs
+	}
+
+	var counter int
+	select {
+	case received, isOpen := <-experiment.snub.counterCh:
+		if !isOpen {
+			return
+		}
+		counter = received
+	case <-experiment.stopCh:
+		return
+	}
+
+	if counter <= endOfPhase {
+		experiment.logger().WithFields(logrus.Fields{"temperature": phase.heatingTemperature, "skipped": endOfPhase - counter + 1}).Info("Heating temperature reached, skipping snubs of phase")
+		counter = endOfPhase + 1
+		experiment.snub.completed = endOfPhase
+	}
+
+	select {
+	case experiment.snub.counterCh <- counter:
+	case <-experiment.stopCh:
+	}
+}
+
+// Publish current phase as "<number of phase>: <name of phase>"
+func (experiment *Experiment) publishCurrentPhase() {
+	phase := experiment.phases[experiment.currentPhase]
+
+	experiment.logger().WithFields(logrus.Fields{"phase": phase.name, "number": experiment.currentPhase + 1, "phases": len(experiment.phases)}).Info("Phase started")
+	experiment.bench.publishData(strconv.Itoa(experiment.currentPhase+1)+": "+phase.name, mqttSubchannelCurrentPhase)
+}
+
+// Checks the parameters of the phase, the ones of braking included
+func (phase *Phase) validate(maxSpeed, maxPressure float64) ExperimentError {
+	var errs ExperimentError
+	invalid := func(key, format string, args ...interface{}) {
+		errs.add(phase.field+"."+phase.key(key), format, args...)
+	}
+
+	if phase.totalOfSnubs <= 0 {
+		invalid("number", "must be positive, not %v", phase.totalOfSnubs)
+	}
+
+	if phase.upperSpeedLimit <= phase.lowerSpeedLimit {
+		invalid("upper_limit", "must be greater than %v (%v km/h), not %v km/h", phase.key("inferior_limit"), phase.lowerSpeedLimit, phase.upperSpeedLimit)
+	}
+	if phase.upperSpeedLimit > maxSpeed {
+		invalid("upper_limit", "must not be greater than the max speed of the bench (%v km/h), not %v km/h", maxSpeed, phase.upperSpeedLimit)
+	}
+	if phase.lowerSpeedLimit <= 0 {
+		invalid("inferior_limit", "must be positive, not %v km/h, braking would never end", phase.lowerSpeedLimit)
+	}
+
+	if phase.timeSleepWater <= 0 {
+		invalid("time", "must be positive, not %v s", phase.timeSleepWater)
+	}
+
+	nonNegatives := []struct {
+		key   string
+		value int
+	}{
+		{"upper_time", phase.delayAcelerateToBrake},
+		{"inferior_time", phase.delayBrakeToCooldown},
+		{"time_between_cycles", phase.timeCooldown},
+		{"cooldown_max_time", phase.maxTimeCooldown},
+	}
+	for _, nonNegative := range nonNegatives {
+		if nonNegative.value < 0 {
+			invalid(nonNegative.key, "must not be negative, not %v s", nonNegative.value)
+		}
+	}
+
+	if phase.temperatureLimit <= 0 || phase.temperatureLimit > maxDiscTemperature {
+		invalid("temperature", "must be greater than 0 and up to %v °C, not %v °C", maxDiscTemperature, phase.temperatureLimit)
+	}
+
+	temperatures := []struct {
+		key   string
+		value float64
+	}{
+		{"cooldown_temperature", phase.cooldownTemperature},
+		{"heating_temperature", phase.heatingTemperature},
+	}
+	for _, temperature := range temperatures {
+		if temperature.value < 0 || temperature.value > maxDiscTemperature {
+			invalid(temperature.key, "must be between 0 and %v °C, not %v °C", maxDiscTemperature, temperature.value)
+		}
+	}
+
+	if phase.cooldownTemperature > 0 && phase.maxTimeCooldown <= 0 {
+		invalid("cooldown_max_time", "must be positive when %v is set, not %v s", phase.key("cooldown_temperature"), phase.maxTimeCooldown)
+	}
+
+	if phase.temperatureCondition != anySensor && phase.temperatureCondition != bothSensors {
+		invalid("temperature_condition", "must be %v or %v, not %q", anySensor, bothSensors, phase.temperatureCondition)
+	}
+
+	return append(errs, phase.validateBrakeMode(maxPressure)...)
+}
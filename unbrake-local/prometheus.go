@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	emitter "github.com/icaropires/go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "unbrake"
+)
+
+// Metrics updated where the values change
+var (
+	snubStateMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snub_state",
+		Help:      "Current state of the snub, 1 on the active one.",
+	}, []string{"bench", "state"})
+
+	dutyCycleMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "duty_cycle_percent",
+		Help:      "Last duty cycle sent to the motor.",
+	}, []string{"bench"})
+
+	distanceMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "distance_km",
+		Help:      "Distance travelled on current experiment.",
+	}, []string{"bench"})
+
+	experimentRunningMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "experiment_running",
+		Help:      "1 while an experiment is running.",
+	}, []string{"bench"})
+
+	experimentIDMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "experiment_id",
+		Help:      "Id of the last experiment run.",
+	}, []string{"bench"})
+
+	completedSnubsMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "experiment_completed_snubs",
+		Help:      "Snubs completed on current experiment.",
+	}, []string{"bench"})
+
+	totalSnubsMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "experiment_total_snubs",
+		Help:      "Snubs of current experiment.",
+	}, []string{"bench"})
+
+	discardedFramesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "serial_frames_discarded_total",
+		Help:      "Frames read from serial which were incomplete or invalid.",
+	}, []string{"bench"})
+
+	serialErrorsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "serial_errors_total",
+		Help:      "Errors reading from or writing to serial.",
+	}, []string{"bench", "operation"})
+
+	publishErrorsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mqtt_publish_errors_total",
+		Help:      "Failures publishing to MQTT broker.",
+	})
+
+	publishedMessagesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mqtt_published_messages_total",
+		Help:      "Messages published to MQTT broker.",
+	}, []string{"bench"})
+
+	lastPublishMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mqtt_last_publish_timestamp_seconds",
+		Help:      "Unix time of the last message published to MQTT broker.",
+	}, []string{"bench"})
+)
+
+// Metrics read from current state of the application when scraped
+var (
+	agentInfoDesc = prometheus.NewDesc(metricsNamespace+"_agent_info",
+		"Version of the agent and identification banner of the firmware of each bench.", []string{"bench", "version", "firmware_banner"}, nil)
+
+	sensorRawDesc = prometheus.NewDesc(metricsNamespace+"_sensor_raw",
+		"Last filtered value read from each channel, as sent by the firmware.", []string{"bench", "channel"}, nil)
+
+	sensorValueDesc = prometheus.NewDesc(metricsNamespace+"_sensor_value",
+		"Last filtered value of each channel on engineering units, when there is a calibration.", []string{"bench", "channel", "unit"}, nil)
+
+	framesDesc = prometheus.NewDesc(metricsNamespace+"_serial_frames_total",
+		"Complete frames acquired from serial.", []string{"bench"}, nil)
+
+	mqttConnectedDesc = prometheus.NewDesc(metricsNamespace+"_mqtt_connected",
+		"1 if the client is connected to MQTT broker.", []string{"client"}, nil)
+
+	busDeliveredDesc = prometheus.NewDesc(metricsNamespace+"_bus_delivered_total",
+		"Frames delivered to each subscriber of the sample bus.", []string{"bench", "subscriber"}, nil)
+
+	busDroppedDesc = prometheus.NewDesc(metricsNamespace+"_bus_dropped_total",
+		"Frames dropped because the subscriber wasn't ready.", []string{"bench", "subscriber"}, nil)
+
+	queuedExperimentsDesc = prometheus.NewDesc(metricsNamespace+"_queued_experiments",
+		"Experiments waiting on the queue of the bench.", []string{"bench"}, nil)
+)
+
+type stateCollector struct{}
+
+func (collector stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{agentInfoDesc, sensorRawDesc, sensorValueDesc, framesDesc, mqttConnectedDesc, busDeliveredDesc, busDroppedDesc, queuedExperimentsDesc} {
+		ch <- desc
+	}
+}
+
+func (collector stateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, bench := range benches {
+		collector.collectBench(ch, bench)
+	}
+
+	for name, client := range map[string]*emitter.Client{"writing": getWritingClient(), "reading": getReadingClient()} {
+		connected := 0.0
+		if client != nil && client.IsConnected() {
+			connected = 1
+		}
+		ch <- prometheus.MustNewConstMetric(mqttConnectedDesc, prometheus.GaugeValue, connected, name)
+	}
+
+}
+
+func (collector stateCollector) collectBench(ch chan<- prometheus.Metric, bench *Bench) {
+	ch <- prometheus.MustNewConstMetric(agentInfoDesc, prometheus.GaugeValue, 1, bench.name, version, bench.getFirmwareBanner())
+	ch <- prometheus.MustNewConstMetric(framesDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&bench.samples.written)), bench.name)
+	ch <- prometheus.MustNewConstMetric(queuedExperimentsDesc, prometheus.GaugeValue, float64(bench.queue.Len()), bench.name)
+
+	if reading := bench.getLastReading(); reading != nil {
+		calibration := bench.getActiveCalibration()
+
+		for name, channel := range calibrationChannels {
+			ch <- prometheus.MustNewConstMetric(sensorRawDesc, prometheus.GaugeValue, reading[channel.idx], bench.name, name)
+
+			if calibration != nil {
+				ch <- prometheus.MustNewConstMetric(sensorValueDesc, prometheus.GaugeValue,
+					calibration.Convert(channel.idx, reading[channel.idx]), bench.name, name, channelUnits[channel.idx])
+			}
+		}
+	}
+
+	for _, stats := range bench.sampleBus.Stats() {
+		ch <- prometheus.MustNewConstMetric(busDeliveredDesc, prometheus.CounterValue, float64(stats.Delivered), bench.name, stats.Name)
+		ch <- prometheus.MustNewConstMetric(busDroppedDesc, prometheus.CounterValue, float64(stats.Dropped), bench.name, stats.Name)
+	}
+}
+
+// Marks state as the active one of the bench
+func (bench *Bench) setSnubStateMetric(state string) {
+	for _, name := range byteToStateName {
+		snubStateMetric.WithLabelValues(bench.name, name).Set(0)
+	}
+	snubStateMetric.WithLabelValues(bench.name, byteToStateName[state]).Set(1)
+}
+
+// Address where metrics are served, disabled if empty
+func getMetricsAddress() string {
+	return getConfig().MetricsAddress
+}
+
+var (
+	metricsServerMux sync.Mutex
+	metricsServer    *http.Server
+)
+
+// Registry with the metrics of the agent and of the Go runtime
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		stateCollector{},
+		snubStateMetric,
+		dutyCycleMetric,
+		distanceMetric,
+		experimentRunningMetric,
+		experimentIDMetric,
+		completedSnubsMetric,
+		totalSnubsMetric,
+		discardedFramesMetric,
+		serialErrorsMetric,
+		publishErrorsMetric,
+		publishedMessagesMetric,
+		lastPublishMetric,
+	)
+
+	return registry
+}
+
+// Serves metrics for Prometheus, if an address is set
+func serveMetrics() {
+	address := getMetricsAddress()
+	if address == "" {
+		return
+	}
+
+	registry := newMetricsRegistry()
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Addr: address, Handler: mux}
+
+	metricsServerMux.Lock()
+	metricsServer = server
+	metricsServerMux.Unlock()
+
+	logger.WithField("address", address+metricsPath).Info("Serving metrics")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithError(err).Error("Wasn't possible to serve metrics")
+	}
+}
+
+// Stops serving metrics and serves them again on the address configured
+func restartMetrics() {
+	metricsServerMux.Lock()
+	if metricsServer != nil {
+		metricsServer.Close()
+		metricsServer = nil
+	}
+	metricsServerMux.Unlock()
+
+	go serveMetrics()
+}
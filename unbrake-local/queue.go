@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Interval between checks of whether the next experiment of the queue can start
+const queuePollInterval = time.Second
+
+const (
+	queueFileName             = "queue.json"
+	mqttSubchannelQueue       = "/queue"
+	mqttSubchannelQueueStatus = "/queueStatus"
+)
+
+// QueuedExperiment is an experiment submitted while the bench was busy or
+// scheduled to start later, waiting for its turn
+type QueuedExperiment struct {
+	ExperimentID int             `json:"experimentId"`
+	Payload      json.RawMessage `json:"payload,omitempty"` // Experiment as received from MQTT, not published on status
+	SubmittedAt  time.Time       `json:"submittedAt"`
+	StartAt      *time.Time      `json:"startAt,omitempty"` // Doesn't start before it
+	Cooldown     float64         `json:"cooldown"`          // Seconds waited after the previous experiment finishes
+}
+
+// ExperimentQueue holds the experiments of a bench in the order they will run,
+// saved on disk so they aren't lost when the application is restarted
+type ExperimentQueue struct {
+	bench        *Bench
+	mux          sync.Mutex
+	experiments  []QueuedExperiment
+	lastFinished time.Time // When the last experiment of the bench finished or was aborted
+	wakeCh       chan bool // Checks the queue before the next poll
+}
+
+// The main bench keeps the name used for its other files
+func (bench *Bench) getQueuePath() string {
+	if bench.isMain {
+		return path.Join(appDirs.State, queueFileName)
+	}
+	return path.Join(appDirs.State, "queue-"+bench.name+".json")
+}
+
+// Loads the experiments saved on disk, replacing the ones on memory
+func (queue *ExperimentQueue) load() error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	data, err := ioutil.ReadFile(queue.bench.getQueuePath())
+	if os.IsNotExist(err) {
+		queue.experiments = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var experiments []QueuedExperiment
+	if err = json.Unmarshal(data, &experiments); err != nil {
+		return err
+	}
+	queue.experiments = experiments
+
+	return nil
+}
+
+// Saves the queue, the file is replaced atomically as the checkpoint.
+// Must be called holding the mutex
+func (queue *ExperimentQueue) save() {
+	data, err := json.Marshal(queue.experiments)
+	if err != nil {
+		queue.bench.logger().WithError(err).Error("Wasn't possible to encode queue")
+		return
+	}
+
+	queuePath := queue.bench.getQueuePath()
+	tmpPath := queuePath + ".tmp"
+
+	if err = ioutil.WriteFile(tmpPath, data, 0666); err != nil {
+		queue.bench.logger().WithError(err).Error("Wasn't possible to write queue")
+		return
+	}
+
+	if err = os.Rename(tmpPath, queuePath); err != nil {
+		queue.bench.logger().WithError(err).Error("Wasn't possible to write queue")
+	}
+}
+
+// Saves the queue and checks it again, must be called holding the mutex
+func (queue *ExperimentQueue) changed() {
+	queue.save()
+
+	select {
+	case queue.wakeCh <- true:
+	default:
+	}
+}
+
+// Adds an experiment at the end of the queue
+func (queue *ExperimentQueue) Add(experiment QueuedExperiment) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	if queue.find(experiment.ExperimentID) >= 0 {
+		return fmt.Errorf("experiment %v already queued", experiment.ExperimentID)
+	}
+
+	queue.experiments = append(queue.experiments, experiment)
+	queue.changed()
+
+	return nil
+}
+
+// Removes an experiment which hasn't started yet
+func (queue *ExperimentQueue) Cancel(id int) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	position := queue.find(id)
+	if position < 0 {
+		return fmt.Errorf("experiment %v not queued", id)
+	}
+
+	queue.experiments = append(queue.experiments[:position], queue.experiments[position+1:]...)
+	queue.changed()
+
+	return nil
+}
+
+// Moves an experiment to the position given, starting from 1
+func (queue *ExperimentQueue) Move(id, position int) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	current := queue.find(id)
+	if current < 0 {
+		return fmt.Errorf("experiment %v not queued", id)
+	}
+
+	if position < 1 || position > len(queue.experiments) {
+		return fmt.Errorf("position must be between 1 and %v", len(queue.experiments))
+	}
+
+	experiment := queue.experiments[current]
+	queue.experiments = append(queue.experiments[:current], queue.experiments[current+1:]...)
+	queue.experiments = append(queue.experiments[:position-1], append([]QueuedExperiment{experiment}, queue.experiments[position-1:]...)...)
+	queue.changed()
+
+	return nil
+}
+
+// Sets when an experiment may start, nil starts it as soon as it's its turn
+func (queue *ExperimentQueue) Schedule(id int, startAt *time.Time) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	position := queue.find(id)
+	if position < 0 {
+		return fmt.Errorf("experiment %v not queued", id)
+	}
+
+	queue.experiments[position].StartAt = startAt
+	queue.changed()
+
+	return nil
+}
+
+// Sets how long an experiment waits after the previous one finishes
+func (queue *ExperimentQueue) SetCooldown(id int, cooldown time.Duration) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	position := queue.find(id)
+	if position < 0 {
+		return fmt.Errorf("experiment %v not queued", id)
+	}
+
+	if cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+
+	queue.experiments[position].Cooldown = cooldown.Seconds()
+	queue.changed()
+
+	return nil
+}
+
+// Position of the experiment on the queue, -1 if it isn't queued.
+// Must be called holding the mutex
+func (queue *ExperimentQueue) find(id int) int {
+	for position, experiment := range queue.experiments {
+		if experiment.ExperimentID == id {
+			return position
+		}
+	}
+	return -1
+}
+
+// Records that an experiment finished, the cooldown of the next one starts now
+func (queue *ExperimentQueue) finished() {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	queue.lastFinished = time.Now()
+
+	select {
+	case queue.wakeCh <- true:
+	default:
+	}
+}
+
+// Puts back an experiment removed by popReady, as the first one
+func (queue *ExperimentQueue) pushFront(experiment QueuedExperiment) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	queue.experiments = append([]QueuedExperiment{experiment}, queue.experiments...)
+	queue.save()
+}
+
+// Removes and returns the first experiment if its start time and cooldown
+// have passed, nil if it must wait. The queue is strictly in order, so the
+// first one holds the others
+func (queue *ExperimentQueue) popReady(now time.Time) *QueuedExperiment {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	if len(queue.experiments) == 0 {
+		return nil
+	}
+
+	next := queue.experiments[0]
+	if next.StartAt != nil && now.Before(*next.StartAt) {
+		return nil
+	}
+
+	cooldown := time.Duration(next.Cooldown * float64(time.Second))
+	if !queue.lastFinished.IsZero() && now.Before(queue.lastFinished.Add(cooldown)) {
+		return nil
+	}
+
+	queue.experiments = queue.experiments[1:]
+	queue.save()
+
+	return &next
+}
+
+// Experiments waiting, without their payloads
+func (queue *ExperimentQueue) List() []QueuedExperiment {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	experiments := make([]QueuedExperiment, len(queue.experiments))
+	for i, experiment := range queue.experiments {
+		experiment.Payload = nil
+		experiments[i] = experiment
+	}
+	return experiments
+}
+
+// Len is the number of experiments waiting
+func (queue *ExperimentQueue) Len() int {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	return len(queue.experiments)
+}
+
+// Adds an experiment received to the queue of the bench, it's validated
+// now so the operator doesn't find out it's invalid only when its turn comes
+func (bench *Bench) enqueueExperiment(payload []byte) {
+	experiment, err := ExperimentFromJSON(bench, payload)
+	if err != nil {
+		bench.rejectExperiment(payload, err)
+		return
+	}
+
+	err = bench.queue.Add(QueuedExperiment{
+		ExperimentID: experiment.id,
+		Payload:      payload,
+		SubmittedAt:  time.Now(),
+	})
+	if err != nil {
+		experiment.logger().WithError(err).Warn("Experiment not queued")
+		bench.publishData("error: "+err.Error(), mqttSubchannelQueueStatus)
+		return
+	}
+
+	experiment.logger().WithFields(logrus.Fields{"parameters": experiment.String(), "position": bench.queue.Len()}).Info("Experiment queued")
+	bench.publishQueue()
+}
+
+// Starts the experiments of the queue when the bench is free, for as long
+// as the application runs
+func (bench *Bench) runQueue() {
+	for {
+		select {
+		case <-bench.queue.wakeCh:
+		case <-time.After(queuePollInterval):
+		}
+
+		bench.startNextQueued()
+	}
+}
+
+// Starts the next experiment of the queue if it's its time. An unfinished
+// experiment must be resumed or discarded by the operator before the queue goes on
+func (bench *Bench) startNextQueued() {
+	if !bench.isFree() || !bench.port.IsOpen() {
+		return
+	}
+
+	if _, err := os.Stat(bench.getCheckpointPath()); err == nil {
+		return
+	}
+
+	queued := bench.queue.popReady(time.Now())
+	if queued == nil {
+		return
+	}
+	bench.publishQueue()
+
+	experiment, err := ExperimentFromJSON(bench, queued.Payload)
+	if err != nil { // Changed on disk after being queued
+		bench.rejectExperiment(queued.Payload, err)
+		return
+	}
+
+	experiment.logger().WithField("parameters", experiment.String()).Info("Starting experiment from queue")
+	if !experiment.Run() { // Bench taken meanwhile, as by maintenance mode
+		bench.queue.pushFront(*queued)
+		bench.publishQueue()
+	}
+}
+
+// Publishes the experiments waiting on the bench
+func (bench *Bench) publishQueue() {
+	data, _ := json.Marshal(bench.queue.List())
+	bench.publishData(string(data), mqttSubchannelQueueStatus)
+}
+
+// Handles a command about the queue of the bench in text, as received from MQTT
+func (bench *Bench) handleQueueCommand(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	if args[0] == "list" {
+		return nil
+	}
+
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("invalid command: %v", command)
+	}
+
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid experiment: %v", args[1])
+	}
+
+	queue := &bench.queue
+
+	switch {
+	case args[0] == "cancel" && len(args) == 2:
+		return queue.Cancel(id)
+	case args[0] == "move" && len(args) == 3:
+		position, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid position: %v", args[2])
+		}
+		return queue.Move(id, position)
+	case args[0] == "schedule" && len(args) == 3:
+		if args[2] == "now" {
+			return queue.Schedule(id, nil)
+		}
+		startAt, err := time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return fmt.Errorf("invalid time, expected as 2006-01-02T22:00:00-03:00: %v", args[2])
+		}
+		return queue.Schedule(id, &startAt)
+	case args[0] == "cooldown" && len(args) == 3:
+		cooldown, err := time.ParseDuration(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid cooldown, expected as 30m: %v", args[2])
+		}
+		return queue.SetCooldown(id, cooldown)
+	default:
+		return fmt.Errorf("invalid command: %v", command)
+	}
+}
+
+// Receives commands about the queue of the bench from MQTT, answering with
+// the queue or the error
+func (bench *Bench) handleQueueReceiving() {
+	bench.subscribeMqtt(mqttSubchannelQueue, func(_ *emitter.Client, msg emitter.Message) {
+		if err := bench.handleQueueCommand(string(msg.Payload())); err != nil {
+			bench.logger().WithError(err).Warn("Invalid queue command")
+			bench.publishData("error: "+err.Error(), mqttSubchannelQueueStatus)
+			return
+		}
+
+		bench.publishQueue()
+	})
+}
+
+// Lists the queue of a bench by command line, as saved by the application
+func runQueueCommandLine(args []string) bool {
+	bench := mainBench()
+	if len(args) > 0 {
+		if bench = findBench(args[0]); bench == nil {
+			fmt.Printf("Bancada %v não configurada\n", args[0])
+			return false
+		}
+	}
+
+	if err := bench.queue.load(); err != nil {
+		fmt.Println("Não foi possível ler a fila: ", err)
+		return false
+	}
+
+	experiments := bench.queue.List()
+	if len(experiments) == 0 {
+		fmt.Println("Não há ensaios na fila")
+		return false
+	}
+
+	for position, experiment := range experiments {
+		fmt.Printf("%v. Ensaio %v, enviado em %v", position+1, experiment.ExperimentID, experiment.SubmittedAt.Format("02/01/2006 15:04:05"))
+		if experiment.StartAt != nil {
+			fmt.Printf(", agendado para %v", experiment.StartAt.Format("02/01/2006 15:04:05"))
+		}
+		if experiment.Cooldown > 0 {
+			fmt.Printf(", %.0f s após o anterior", experiment.Cooldown)
+		}
+		fmt.Println()
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files stored on the folder of each experiment
+const (
+	experimentFileName = "experiment.json"
+	runInfoFileName    = "run.json"
+	samplesFileName    = "samples.csv"
+	eventsFileName     = "events.jsonl"
+)
+
+// Status of the run of an experiment
+const (
+	runningStatus  = "running"
+	finishedStatus = "finished"
+	abortedStatus  = "aborted"
+)
+
+// Channels recorded on samples file, converted to engineering units
+var recordedChannels = []int{
+	frequencyIdx,
+	temperature1Idx,
+	temperature2Idx,
+	brakingForce1Idx,
+	brakingForce2Idx,
+	vibrationIdx,
+	pressureIdx,
+}
+
+// RunInfo identifies when and with what an experiment was run, for traceability
+type RunInfo struct {
+	Bench          string    `json:"bench"`
+	AgentVersion   string    `json:"agent_version"`
+	FirmwareBanner string    `json:"firmware_banner"` // Identification sent by the firmware, it has no version
+	Status         string    `json:"status"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+}
+
+// Event is something which happened during an experiment
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Data        EventData `json:"data,omitempty"`
+}
+
+// Prepares the folder of experiment to record its data, if the experiment
+// is not being resumed, data of a previous run is discarded
+func (experiment *Experiment) startRecording() {
+	folder := getExperimentFolder(experiment.id)
+
+	if experiment.snub.completed == 0 {
+		for _, name := range []string{snubMetricsFileName, analysisFileName, samplesFileName, eventsFileName, runInfoFileName} {
+			os.Remove(path.Join(folder, name))
+		}
+	}
+
+	os.MkdirAll(folder, os.ModePerm)
+
+	if err := ioutil.WriteFile(path.Join(folder, experimentFileName), experiment.payload, 0666); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to store experiment")
+	}
+
+	experiment.saveRunInfo(runningStatus)
+	experiment.bench.journal.open(experiment.id)
+}
+
+// Saves current status of the run of experiment
+func (experiment *Experiment) saveRunInfo(status string) {
+	filePath := path.Join(getExperimentFolder(experiment.id), runInfoFileName)
+
+	info, err := readRunInfo(filePath)
+	if err != nil { // First run
+		info = &RunInfo{StartedAt: time.Now()}
+	}
+
+	info.AgentVersion = version
+	info.Bench = experiment.bench.name
+	info.FirmwareBanner = experiment.bench.getFirmwareBanner()
+	info.Status = status
+	if status != runningStatus {
+		info.FinishedAt = time.Now()
+	}
+
+	data, _ := json.Marshal(info)
+	if err = ioutil.WriteFile(filePath, data, 0666); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to store run information")
+	}
+}
+
+func readRunInfo(filePath string) (*RunInfo, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var info RunInfo
+	return &info, json.Unmarshal(data, &info)
+}
+
+func readEvents(filePath string) ([]Event, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err = json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+
+	return events, scanner.Err()
+}
+
+// Records a sample as a line of "time,<channels...>,state"
+func (experiment *Experiment) recordSample(sample metricsSample, state string) {
+	fields := []string{strconv.FormatFloat(float64(sample.time.UnixNano())/1e9, 'f', 3, 64)}
+	for _, idx := range recordedChannels {
+		fields = append(fields, strconv.FormatFloat(sample.values[idx], 'f', 3, 64))
+	}
+	fields = append(fields, byteToStateName[state])
+
+	filePath := path.Join(getExperimentFolder(experiment.id), samplesFileName)
+	if err := appendLine(filePath, []byte(strings.Join(fields, ","))); err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to record sample")
+	}
+}
+
+// RecordedSample is a sample read back from the samples file
+type RecordedSample struct {
+	Time   time.Time
+	Values map[int]float64 // By index of data from serial
+	State  string
+}
+
+func readSamples(filePath string) ([]RecordedSample, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var samples []RecordedSample
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) != len(recordedChannels)+2 {
+			continue
+		}
+
+		seconds, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+
+		sample := RecordedSample{
+			Time:   time.Unix(0, int64(seconds*1e9)),
+			Values: map[int]float64{},
+			State:  fields[len(fields)-1],
+		}
+		for i, idx := range recordedChannels {
+			sample.Values[idx], _ = strconv.ParseFloat(fields[i+1], 64)
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, scanner.Err()
+}
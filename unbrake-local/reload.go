@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const configWatchInterval = time.Second * 2
+
+// Parameters grouped by what must be done when they change
+var (
+	mqttConfig    = []string{"MqttHost", "MqttPort", "MqttKey", "MqttChannelPrefix"}
+	serialConfig  = []string{"AcquisitionMode", "StreamingBaudRate", "BaudRate"} // Port is opened again
+	filtersConfig = []string{"Filters", "FilterWindow", "AcquisitionMode", "StreamingRate", "ReadingFrequency"}
+	metricsConfig = []string{"MetricsAddress"}
+	restartConfig = []string{"SerialPort", "BenchName", "Benches", "InterfaceLanguage"} // Only applied when application starts
+	unitsConfig   = []string{"SpeedUnit", "TemperatureUnit", "ForceUnit"}               // Published for the frontends
+)
+
+// Parameters which can't change while an experiment or the maintenance
+// mode is running, as they would change the readings or the connection
+var unsafeWhileRunningConfig = []string{
+	"MqttHost", "MqttPort", "MqttKey", "MqttChannelPrefix",
+	"AcquisitionMode", "StreamingRate", "StreamingBaudRate", "BaudRate", "BufferSize", "ReadingFrequency",
+	"Filters", "FilterWindow", "ControlDecimation",
+}
+
+// Held while reloading and while a bench becomes busy, so an experiment
+// can't start between the check of busy benches and the changes applied
+var reloadMux sync.Mutex
+
+// Reloads configuration when its file changes or on SIGHUP
+func watchConfig() {
+	hangupCh := make(chan os.Signal, 1)
+	signal.Notify(hangupCh, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	lastStamp := configFileStamp()
+	for {
+		select {
+		case <-hangupCh:
+			logger.Info("Reloading configuration by signal")
+		case <-ticker.C:
+			stamp := configFileStamp()
+			if stamp == lastStamp {
+				continue
+			}
+			lastStamp = stamp
+			logger.Info("Configuration file changed, reloading")
+		}
+
+		if err := reloadConfig(); err != nil {
+			logger.WithError(err).Error("Configuration not reloaded, keeping current one")
+		}
+	}
+}
+
+// Identifies the content of the configuration file by its path, size and
+// time of modification
+func configFileStamp() string {
+	configMux.RLock()
+	args := configArgs
+	configMux.RUnlock()
+
+	flags := newConfigFlags()
+	flags.Parse(args)
+
+	filePath := findConfigFile(flags)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return filePath
+	}
+	return fmt.Sprint(filePath, info.Size(), info.ModTime().UnixNano())
+}
+
+// Reads configuration again and applies what changed. Nothing is applied if
+// the new configuration is invalid or changes a parameter which is unsafe
+// while an experiment is running
+func reloadConfig() error {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	configMux.RLock()
+	args := configArgs
+	currentSources := configSources
+	configMux.RUnlock()
+
+	config, sources, filePath, _, err := readConfig(args)
+	if err != nil {
+		return err
+	}
+
+	current := getConfig()
+	changed := changedConfig(&current, &config)
+	keepConfig(&current, &config, currentSources, sources, restartConfig)
+
+	if isAnyBenchBusy() {
+		var unsafe []string
+		for _, name := range changed {
+			if isConfigIn(name, unsafeWhileRunningConfig) {
+				unsafe = append(unsafe, configKey(name))
+			}
+		}
+		if len(unsafe) > 0 {
+			return fmt.Errorf("can't change %v while an experiment is running", strings.Join(unsafe, ", "))
+		}
+	}
+
+	setConfig(config, sources, filePath)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(changed))
+	for i, name := range changed {
+		keys[i] = configKey(name)
+	}
+	logger.WithField("changed", strings.Join(keys, ",")).Info("Configuration reloaded")
+	recordEventOnBenches(configEvent, configSnapshot(config), "Configuração recarregada, alterados: %v", strings.Join(keys, ", "))
+
+	configureLogging()
+
+	if isAnyConfigIn(changed, filtersConfig) {
+		configureFilters()
+	}
+	if isAnyConfigIn(changed, metricsConfig) {
+		restartMetrics()
+	}
+	if isAnyConfigIn(changed, serialConfig) {
+		for _, bench := range benches {
+			bench.reopenSerialPort()
+		}
+	}
+	if isAnyConfigIn(changed, mqttConfig) {
+		reconnectMqtt()
+	}
+	if isAnyConfigIn(changed, unitsConfig) {
+		for _, bench := range benches {
+			go bench.publishDisplayUnits()
+		}
+	}
+	if isAnyConfigIn(changed, restartConfig) {
+		logger.Warn("Serial ports, benches and language set on configuration are only applied when application starts")
+	}
+
+	return nil
+}
+
+// Keeps the current value of the fields named, and where they came from, on
+// the new configuration
+func keepConfig(current, config *ConfigFile, currentSources, sources map[string]string, names []string) {
+	currentValue, value := reflect.ValueOf(current).Elem(), reflect.ValueOf(config).Elem()
+
+	for _, name := range names {
+		value.FieldByName(name).Set(currentValue.FieldByName(name))
+		sources[name] = currentSources[name]
+	}
+}
+
+// Names of the fields which differ between both configurations
+func changedConfig(current, config *ConfigFile) []string {
+	currentValue, value := reflect.ValueOf(current).Elem(), reflect.ValueOf(config).Elem()
+
+	var changed []string
+	for _, field := range configFields() {
+		if !reflect.DeepEqual(currentValue.FieldByName(field.Name).Interface(), value.FieldByName(field.Name).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
+
+func isConfigIn(name string, group []string) bool {
+	for _, member := range group {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isAnyConfigIn(names, group []string) bool {
+	for _, name := range names {
+		if isConfigIn(name, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the serial port of the bench again, so it uses the current configuration
+func (bench *Bench) reopenSerialPort() {
+	if !bench.port.IsOpen() {
+		return
+	}
+
+	name := bench.port.Name()
+	bench.port.Close()
+	bench.serialPortNameCh <- name
+}
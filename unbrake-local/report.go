@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+const (
+	reportHTMLFileName = "report.html"
+	reportPDFFileName  = "report.pdf"
+	maxChartPoints     = 1000 // Samples are decimated above it
+)
+
+// Report gathers everything recorded from an experiment
+type Report struct {
+	ID          int
+	Operator    string
+	Info        RunInfo
+	Experiment  *Experiment
+	Metrics     []SnubMetrics
+	Analysis    *ExperimentAnalysis
+	Samples     []RecordedSample
+	Events      []Event
+	GeneratedAt time.Time
+}
+
+// Series of a chart, values by seconds since start of experiment
+type chartSeries struct {
+	name   string
+	color  string
+	points [][2]float64
+}
+
+type chart struct {
+	title  string
+	unit   string
+	series []chartSeries
+}
+
+// Loads everything recorded on the folder of an experiment
+func loadReport(id int) (*Report, error) {
+	folder := getExperimentFolder(id)
+
+	payload, err := ioutil.ReadFile(path.Join(folder, experimentFileName))
+	if err != nil {
+		return nil, fmt.Errorf("experiment %v not recorded: %v", id, err)
+	}
+
+	experiment, err := ExperimentFromJSON(nil, payload) // Only its parameters are shown
+	if err != nil {
+		return nil, fmt.Errorf("experiment %v recorded is invalid: %v", id, err)
+	}
+
+	report := Report{
+		ID:          id,
+		Operator:    experiment.operator,
+		Experiment:  experiment,
+		GeneratedAt: time.Now(),
+	}
+
+	if info, err := readRunInfo(path.Join(folder, runInfoFileName)); err == nil {
+		report.Info = *info
+	}
+
+	report.Metrics, _ = readSnubMetrics(path.Join(folder, snubMetricsFileName))
+	report.Samples, _ = readSamples(path.Join(folder, samplesFileName))
+	events, _ := readEvents(path.Join(folder, eventsFileName))
+	for _, event := range events {
+		if !journalOnlyEvents[event.Type] {
+			report.Events = append(report.Events, event)
+		}
+	}
+
+	if len(report.Metrics) > 0 {
+		analysis := analyzeExperiment(report.Metrics)
+		report.Analysis = &analysis
+	}
+
+	return &report, nil
+}
+
+// Charts of the samples, on the units configured
+func (report *Report) charts() []chart {
+	series := func(name, color string, idx int, unit DisplayUnit) chartSeries {
+		step := len(report.Samples)/maxChartPoints + 1
+
+		var points [][2]float64
+		for i := 0; i < len(report.Samples); i += step {
+			sample := report.Samples[i]
+			points = append(points, [2]float64{sample.Time.Sub(report.Samples[0].Time).Seconds(), unit.convert(sample.Values[idx])})
+		}
+		return chartSeries{name: name, color: color, points: points}
+	}
+
+	speed, temperature, force := speedUnit(report.Experiment.tireRadius), temperatureUnit(), forceUnit()
+	return []chart{
+		{"Velocidade", speed.symbol, []chartSeries{series("Velocidade", "#1f77b4", frequencyIdx, speed)}},
+		{"Temperatura", temperature.symbol, []chartSeries{
+			series("Sensor 1", "#d62728", temperature1Idx, temperature),
+			series("Sensor 2", "#ff7f0e", temperature2Idx, temperature),
+		}},
+		{"Força de frenagem", force.symbol, []chartSeries{
+			series("Sensor 1", "#2ca02c", brakingForce1Idx, force),
+			series("Sensor 2", "#9467bd", brakingForce2Idx, force),
+		}},
+	}
+}
+
+// Limits of all points of a chart, as minX, maxX, minY, maxY
+func (chart *chart) bounds() (float64, float64, float64, float64) {
+	minX, maxX, minY, maxY := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	for _, series := range chart.series {
+		for _, point := range series.points {
+			minX, maxX = math.Min(minX, point[0]), math.Max(maxX, point[0])
+			minY, maxY = math.Min(minY, point[1]), math.Max(maxY, point[1])
+		}
+	}
+
+	if maxX <= minX {
+		maxX = minX + 1
+	}
+	if maxY <= minY {
+		maxY = minY + 1
+	}
+
+	return minX, maxX, minY, maxY
+}
+
+// Renders chart as inline SVG
+func (chart *chart) svg() template.HTML {
+	const width, height, margin = 800.0, 250.0, 50.0
+
+	if len(chart.series) == 0 || len(chart.series[0].points) == 0 {
+		return template.HTML("<p>Sem dados</p>")
+	}
+
+	minX, maxX, minY, maxY := chart.bounds()
+	scale := func(point [2]float64) (float64, float64) {
+		x := margin + (point[0]-minX)/(maxX-minX)*(width-2*margin)
+		y := height - margin - (point[1]-minY)/(maxY-minY)*(height-2*margin)
+		return x, y
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg viewBox="0 0 %v %v" width="100%%">`, width, height)
+	fmt.Fprintf(&svg, `<rect x="%v" y="%v" width="%v" height="%v" fill="none" stroke="#999"/>`, margin, margin, width-2*margin, height-2*margin)
+	fmt.Fprintf(&svg, `<text x="%v" y="%v" font-size="12">%.1f %s</text>`, 2, margin, maxY, template.HTMLEscapeString(chart.unit))
+	fmt.Fprintf(&svg, `<text x="%v" y="%v" font-size="12">%.1f</text>`, 2, height-margin, minY)
+	fmt.Fprintf(&svg, `<text x="%v" y="%v" font-size="12" text-anchor="end">%.0f s</text>`, width-margin, height-margin+15, maxX)
+
+	for i, series := range chart.series {
+		var points []string
+		for _, point := range series.points {
+			x, y := scale(point)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		fmt.Fprintf(&svg, `<polyline fill="none" stroke="%s" stroke-width="1" points="%s"/>`, series.color, strings.Join(points, " "))
+		fmt.Fprintf(&svg, `<text x="%v" y="%v" font-size="12" fill="%s">%s</text>`, margin+float64(i)*120, margin-10, series.color, template.HTMLEscapeString(series.name))
+	}
+
+	svg.WriteString("</svg>")
+
+	return template.HTML(svg.String())
+}
+
+// Configuration of the experiment as label and value pairs
+func (report *Report) configuration() [][2]string {
+	experiment := report.Experiment
+
+	configuration := [][2]string{
+		{"Total de snubs", strconv.Itoa(experiment.totalOfSnubs)},
+		{"Raio do pneu", fmt.Sprintf("%.4f m", experiment.tireRadius)},
+		{"Pressão máxima", fmt.Sprintf("%v bar", experiment.maxPressure)},
+		{"Raio do braço de força", fmt.Sprintf("%v m", experiment.brakeParameters.leverRadius)},
+		{"Raio efetivo", fmt.Sprintf("%v m", experiment.brakeParameters.effectiveRadius)},
+		{"Área dos pistões", fmt.Sprintf("%v cm²", experiment.brakeParameters.pistonArea)},
+		{"Inércia", fmt.Sprintf("%v kg·m²", experiment.brakeParameters.inertia)},
+	}
+
+	speed := speedUnit(experiment.tireRadius)
+	for i, phase := range experiment.phases {
+		configuration = append(configuration, [2]string{
+			fmt.Sprintf("Fase %v: %v", i+1, phase.name),
+			fmt.Sprintf("%v snubs de %v a %v, cooldown %v s, limite %v, frenagem %v",
+				phase.totalOfSnubs, speed.format(phase.upperSpeedLimit), speed.format(phase.lowerSpeedLimit),
+				phase.timeCooldown, formatTemperature(phase.temperatureLimit), phase.brakeMode),
+		})
+	}
+
+	for i, curve := range experiment.calibration.curves {
+		if curve != nil {
+			configuration = append(configuration, [2]string{"Calibração " + mqttSubchannelSerialAttrs[i], curve.String()})
+		}
+	}
+
+	return configuration
+}
+
+// Header of the table of snubs and the values of each row, speeds and
+// temperatures on the units configured
+func snubsTableHeader(speed DisplayUnit) []string {
+	temperature := temperatureUnit().symbol
+	return []string{"Snub", "Fase", "V0 (" + speed.symbol + ")", "Torque (N·m)", "µ", "MFDD (m/s²)", "Tempo (s)", "Dist. (m)", "Energia (kJ)",
+		"T0 (" + temperature + ")", "Tmax (" + temperature + ")"}
+}
+
+func snubsTableRow(metrics SnubMetrics, speed DisplayUnit) []string {
+	temperature := temperatureUnit()
+	return []string{
+		strconv.Itoa(metrics.Snub),
+		metrics.Phase,
+		strconv.FormatFloat(speed.convert(metrics.InitialSpeed), 'f', speed.decimals, 64),
+		fmt.Sprintf("%.1f", metrics.MeanTorque),
+		fmt.Sprintf("%.3f", metrics.Friction),
+		fmt.Sprintf("%.2f", metrics.MFDD),
+		fmt.Sprintf("%.2f", metrics.StoppingTime),
+		fmt.Sprintf("%.1f", metrics.StoppingDistance),
+		fmt.Sprintf("%.1f", metrics.Energy/1000),
+		fmt.Sprintf("%.0f", temperature.convert(metrics.InitialTemperature)),
+		fmt.Sprintf("%.0f", temperature.convert(metrics.PeakTemperature)),
+	}
+}
+
+// Analysis as label and value pairs
+func (report *Report) analysis() [][2]string {
+	if report.Analysis == nil {
+		return nil
+	}
+	analysis := report.Analysis
+
+	return [][2]string{
+		{"µ de baseline", fmt.Sprintf("%.3f", analysis.BaselineFriction)},
+		{"µ médio (mín/máx)", fmt.Sprintf("%.3f (%.3f/%.3f)", analysis.Friction.Mean, analysis.Friction.Min, analysis.Friction.Max)},
+		{"Desvio padrão de µ", fmt.Sprintf("%.3f", analysis.Friction.StdDev)},
+		{"Fade", fmt.Sprintf("%.1f %%", analysis.Fade)},
+		{"Recuperação", fmt.Sprintf("%.1f %%", analysis.Recovery)},
+		{"Energia total", fmt.Sprintf("%.1f kJ", analysis.TotalEnergy/1000)},
+		{"Tempo total de frenagem", fmt.Sprintf("%.1f s", analysis.TotalBrakingTime)},
+	}
+}
+
+const reportTemplate = `<!DOCTYPE html>
+<html lang="pt-BR">
+<head>
+<meta charset="utf-8">
+<title>Relatório do ensaio {{.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; font-size: 13px; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>Relatório do ensaio {{.ID}}</h1>
+<table>
+<tr><th>Operador</th><td>{{.Operator}}</td></tr>
+<tr><th>Início</th><td>{{date .Info.StartedAt}}</td></tr>
+<tr><th>Fim</th><td>{{date .Info.FinishedAt}}</td></tr>
+<tr><th>Situação</th><td>{{.Info.Status}}</td></tr>
+<tr><th>Bancada</th><td>{{.Info.Bench}}</td></tr>
+<tr><th>Versão do UnBrake</th><td>{{.Info.AgentVersion}}</td></tr>
+<tr><th>Identificação do firmware</th><td>{{.Info.FirmwareBanner}}</td></tr>
+<tr><th>Gerado em</th><td>{{date .GeneratedAt}}</td></tr>
+</table>
+
+<h2>Configuração e calibração</h2>
+<table>{{range .Configuration}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>{{end}}</table>
+
+<h2>Análise</h2>
+{{if .AnalysisRows}}<table>{{range .AnalysisRows}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>{{end}}</table>{{else}}<p>Sem snubs concluídos</p>{{end}}
+
+<h2>Snubs</h2>
+<table>
+<tr>{{range .SnubsHeader}}<th>{{.}}</th>{{end}}</tr>
+{{range .SnubsRows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>{{end}}
+</table>
+
+<h2>Gráficos</h2>
+{{range .Charts}}<h3>{{.Title}}</h3>{{.SVG}}{{end}}
+
+<h2>Eventos</h2>
+<table>{{range .Events}}<tr><td>{{date .Time}}</td><td>{{.Description}}</td></tr>{{end}}</table>
+</body>
+</html>
+`
+
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return "-"
+	}
+	return date.Format("02/01/2006 15:04:05")
+}
+
+// Renders the self contained HTML report
+func (report *Report) writeHTML(filePath string) error {
+	tmpl, err := template.New("report").Funcs(template.FuncMap{"date": formatDate}).Parse(reportTemplate)
+	if err != nil {
+		return err
+	}
+
+	type renderedChart struct {
+		Title string
+		SVG   template.HTML
+	}
+
+	var charts []renderedChart
+	for _, chart := range report.charts() {
+		charts = append(charts, renderedChart{chart.title, chart.svg()})
+	}
+
+	speed := speedUnit(report.Experiment.tireRadius)
+	var rows [][]string
+	for _, metrics := range report.Metrics {
+		rows = append(rows, snubsTableRow(metrics, speed))
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return tmpl.Execute(file, struct {
+		*Report
+		Configuration [][2]string
+		AnalysisRows  [][2]string
+		SnubsHeader   []string
+		SnubsRows     [][]string
+		Charts        []renderedChart
+	}{report, report.configuration(), report.analysis(), snubsTableHeader(speed), rows, charts})
+}
+
+// Renders the report as PDF, with the same content of HTML
+func (report *Report) writePDF(filePath string) error {
+	pdf := gofpdf.New("L", "mm", "A4", "")
+	encode := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetAutoPageBreak(true, 10)
+	pdf.AddPage()
+
+	title := func(text string) {
+		pdf.SetFont("Helvetica", "B", 13)
+		pdf.Ln(4)
+		pdf.CellFormat(0, 8, encode(text), "", 1, "L", false, 0, "")
+	}
+
+	pairs := func(rows [][2]string) {
+		pdf.SetFont("Helvetica", "", 9)
+		for _, row := range rows {
+			pdf.CellFormat(70, 5, encode(row[0]), "1", 0, "L", false, 0, "")
+			pdf.CellFormat(0, 5, encode(row[1]), "1", 1, "L", false, 0, "")
+		}
+	}
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, encode(fmt.Sprintf("Relatório do ensaio %v", report.ID)), "", 1, "L", false, 0, "")
+
+	pairs([][2]string{
+		{"Operador", report.Operator},
+		{"Início", formatDate(report.Info.StartedAt)},
+		{"Fim", formatDate(report.Info.FinishedAt)},
+		{"Situação", report.Info.Status},
+		{"Bancada", report.Info.Bench},
+		{"Versão do UnBrake", report.Info.AgentVersion},
+		{"Identificação do firmware", report.Info.FirmwareBanner},
+		{"Gerado em", formatDate(report.GeneratedAt)},
+	})
+
+	title("Configuração e calibração")
+	pairs(report.configuration())
+
+	title("Análise")
+	pairs(report.analysis())
+
+	title("Snubs")
+	widths := []float64{12, 40, 22, 25, 18, 25, 20, 22, 25, 20, 20}
+	pdf.SetFont("Helvetica", "B", 8)
+	speed := speedUnit(report.Experiment.tireRadius)
+	for i, header := range snubsTableHeader(speed) {
+		pdf.CellFormat(widths[i], 5, encode(header), "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 8)
+	for _, metrics := range report.Metrics {
+		for i, value := range snubsTableRow(metrics, speed) {
+			pdf.CellFormat(widths[i], 5, encode(value), "1", 0, "R", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	for _, chart := range report.charts() {
+		pdf.AddPage()
+		title(chart.title + " (" + chart.unit + ")")
+		report.drawChart(pdf, &chart, encode)
+	}
+
+	pdf.AddPage()
+	title("Eventos")
+	pdf.SetFont("Helvetica", "", 9)
+	for _, event := range report.Events {
+		pdf.CellFormat(40, 5, formatDate(event.Time), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 5, encode(event.Description), "1", 1, "L", false, 0, "")
+	}
+
+	return pdf.OutputFileAndClose(filePath)
+}
+
+func (report *Report) drawChart(pdf *gofpdf.Fpdf, chart *chart, encode func(string) string) {
+	const left, top, width, height = 30.0, 35.0, 240.0, 140.0
+
+	if len(chart.series) == 0 || len(chart.series[0].points) == 0 {
+		pdf.CellFormat(0, 8, "Sem dados", "", 1, "L", false, 0, "")
+		return
+	}
+
+	minX, maxX, minY, maxY := chart.bounds()
+
+	pdf.SetDrawColor(150, 150, 150)
+	pdf.Rect(left, top, width, height, "D")
+	pdf.SetFont("Helvetica", "", 8)
+	pdf.Text(left-20, top+3, fmt.Sprintf("%.1f", maxY))
+	pdf.Text(left-20, top+height, fmt.Sprintf("%.1f", minY))
+	pdf.Text(left+width-10, top+height+5, fmt.Sprintf("%.0f s", maxX))
+
+	for i, series := range chart.series {
+		var r, g, b int
+		fmt.Sscanf(series.color, "#%02x%02x%02x", &r, &g, &b)
+		pdf.SetDrawColor(r, g, b)
+		pdf.SetTextColor(r, g, b)
+		pdf.Text(left+float64(i)*50, top-3, encode(series.name))
+
+		for j := 1; j < len(series.points); j++ {
+			x0 := left + (series.points[j-1][0]-minX)/(maxX-minX)*width
+			y0 := top + height - (series.points[j-1][1]-minY)/(maxY-minY)*height
+			x1 := left + (series.points[j][0]-minX)/(maxX-minX)*width
+			y1 := top + height - (series.points[j][1]-minY)/(maxY-minY)*height
+			pdf.Line(x0, y0, x1, y1)
+		}
+	}
+
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetDrawColor(0, 0, 0)
+}
+
+// Generates HTML and PDF reports of an experiment, on its folder
+func generateReport(id int) ([]string, error) {
+	report, err := loadReport(id)
+	if err != nil {
+		return nil, err
+	}
+
+	folder := getExperimentFolder(id)
+	htmlPath, pdfPath := path.Join(folder, reportHTMLFileName), path.Join(folder, reportPDFFileName)
+
+	var errs []string
+	if err = report.writeHTML(htmlPath); err != nil {
+		errs = append(errs, "HTML: "+err.Error())
+	}
+	if err = report.writePDF(pdfPath); err != nil {
+		errs = append(errs, "PDF: "+err.Error())
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, ", "))
+	}
+
+	return []string{htmlPath, pdfPath}, nil
+}
+
+// Generates report of the experiment just finished
+func (experiment *Experiment) generateReport() {
+	paths, err := generateReport(experiment.id)
+	if err != nil {
+		experiment.logger().WithError(err).Error("Wasn't possible to generate report")
+		return
+	}
+
+	experiment.logger().WithField("files", strings.Join(paths, ",")).Info("Report generated")
+}
+
+// Report by command line of a recorded experiment
+func runReportCommandLine(args []string) bool {
+	if len(args) != 1 {
+		fmt.Println("Uso: unbrake-local report <id do ensaio>")
+		return false
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Println("Id de ensaio inválido: ", args[0])
+		return false
+	}
+
+	paths, err := generateReport(id)
+	if err != nil {
+		fmt.Println("Não foi possível gerar o relatório: ", err)
+		return false
+	}
+
+	fmt.Println("Relatório gerado:")
+	for _, reportPath := range paths {
+		fmt.Println("  " + reportPath)
+	}
+
+	return false
+}
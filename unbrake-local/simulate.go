@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	emitter "github.com/icaropires/go/v2"
+)
+
+const (
+	mqttSubchannelSimulate   = "/simulate"
+	mqttSubchannelSimulation = "/simulation"
+)
+
+// Model of the bench used by simulations, rough values of a brake dynamometer
+const (
+	simulationStep              = 0.1             // s
+	simulationMaxDuration       = 7 * 24 * 3600.0 // s, stops experiments which would never end
+	simulatedAcceleration       = 1.0             // m/s², motor at full duty cycle
+	simulatedDeceleration       = 4.0             // m/s², on/off braking
+	simulatedCoastDeceleration  = 0.1             // m/s², motor off and brake released
+	simulatedFriction           = 0.4             // µ, for braking by pressure
+	simulatedMass               = 300.0           // kg, equivalent of the flywheel when its inertia isn't known
+	simulatedHeatCapacity       = 5000.0          // J/°C, of the disc
+	simulatedAmbientTemperature = 25.0            // °C
+	simulatedCooling            = 0.002           // 1/s, fraction of the heat above ambient lost by second
+	simulatedWaterCooling       = 0.05            // 1/s, while throwing water
+	simulatedStoppedSpeed       = 0.01            // km/h, disc considered stopped
+)
+
+// PhaseSimulation is the estimate of a phase of the procedure
+type PhaseSimulation struct {
+	Name            string  `json:"name"`
+	Snubs           int     `json:"snubs"`    // Run, less than the ones of phase when heating temperature is reached
+	Duration        float64 `json:"duration"` // s
+	Distance        float64 `json:"distance"` // km
+	PeakTemperature float64 `json:"peak_temperature"`
+}
+
+// SimulationReport is the estimate of running an experiment on the bench
+type SimulationReport struct {
+	Valid            bool              `json:"valid"`
+	Snubs            int               `json:"snubs"`
+	Duration         float64           `json:"duration"` // s
+	Distance         float64           `json:"distance"` // km
+	PeakTemperature  float64           `json:"peak_temperature"`
+	WaterActivations int               `json:"water_activations"`
+	Phases           []PhaseSimulation `json:"phases"`
+	Violations       []string          `json:"violations"` // Validation errors and safety limits exceeded
+}
+
+// State of the simulated bench
+type benchSimulation struct {
+	experiment  *Experiment
+	report      SimulationReport
+	phase       *PhaseSimulation
+	time        float64         // s
+	speed       float64         // km/h
+	temperature float64         // °C
+	waterUntil  float64         // s
+	reported    map[string]bool // Safety violations of current phase, each one is reported only on the first snub
+}
+
+// Runs the experiment on a model of the bench, as fast as possible,
+// estimating how it would go on the real one. Snubs and phases change by the
+// same predicates of experiments
+func simulateExperiment(data []byte) SimulationReport {
+	experiment, err := ExperimentFromJSON(nil, data)
+	if err != nil {
+		errs, _ := err.(ExperimentError)
+		return SimulationReport{Violations: errs}
+	}
+
+	simulation := benchSimulation{
+		experiment:  experiment,
+		report:      SimulationReport{Valid: true, Violations: []string{}},
+		temperature: simulatedAmbientTemperature,
+	}
+	simulation.report.PeakTemperature = simulation.temperature
+
+	for i := range experiment.phases {
+		if !simulation.runPhase(&experiment.phases[i]) {
+			break
+		}
+	}
+
+	simulation.report.Duration = simulation.time
+	return simulation.report
+}
+
+func (simulation *benchSimulation) violation(format string, args ...interface{}) {
+	simulation.report.Violations = append(simulation.report.Violations, fmt.Sprintf(format, args...))
+}
+
+// Reports a safety violation only on the first snub of the phase it happens
+func (simulation *benchSimulation) safetyViolation(format string, args ...interface{}) {
+	if !simulation.reported[format] {
+		simulation.reported[format] = true
+		simulation.violation(format, args...)
+	}
+}
+
+// Runs the snubs of a phase, returns false if the experiment can't go on
+func (simulation *benchSimulation) runPhase(phase *Phase) bool {
+	simulation.report.Phases = append(simulation.report.Phases, PhaseSimulation{Name: phase.name, PeakTemperature: simulation.temperature})
+	simulation.phase = &simulation.report.Phases[len(simulation.report.Phases)-1]
+	simulation.reported = map[string]bool{}
+
+	start, distance := simulation.time, simulation.report.Distance
+	defer func() {
+		simulation.phase.Duration = simulation.time - start
+		simulation.phase.Distance = simulation.report.Distance - distance
+	}()
+
+	for snub := 1; snub <= phase.totalOfSnubs; snub++ {
+		if !simulation.runSnub(phase) {
+			return false
+		}
+
+		simulation.phase.Snubs++
+		simulation.report.Snubs++
+
+		if phase.isHeatingOver(simulation.temperatures()) {
+			break
+		}
+	}
+
+	return true
+}
+
+// Runs a cycle of acceleration, braking and cooldown, returns false if it
+// would never end
+func (simulation *benchSimulation) runSnub(phase *Phase) bool {
+	for !isBrakingSpeed(simulation.speed, phase.upperSpeedLimit) {
+		if !simulation.step(phase, simulatedAcceleration, false) {
+			return false
+		}
+	}
+
+	for end := simulation.time + float64(phase.delayAcelerateToBrake); simulation.time < end; {
+		simulation.step(phase, 0, false)
+	}
+
+	deceleration := simulation.deceleration(phase)
+	for !isReleaseSpeed(simulation.speed, phase.lowerSpeedLimit) {
+		if simulation.speed < simulatedStoppedSpeed {
+			simulation.violation("Fase %v: o disco para sem atingir a velocidade inferior de %v km/h, o ensaio não terminaria", phase.name, phase.lowerSpeedLimit)
+			return false
+		}
+		if !simulation.step(phase, -deceleration, true) {
+			return false
+		}
+	}
+
+	for end := simulation.time + float64(phase.delayBrakeToCooldown); simulation.time < end; {
+		simulation.step(phase, -deceleration, true)
+	}
+
+	if phase.cooldownTemperature <= 0 {
+		for end := simulation.time + float64(phase.timeCooldown); simulation.time < end; {
+			simulation.step(phase, -simulatedCoastDeceleration, false)
+		}
+		return true
+	}
+
+	end := simulation.time + float64(phase.maxTimeCooldown)
+	for !phase.isCooldownOver(simulation.temperatures()) {
+		if simulation.time >= end {
+			simulation.safetyViolation("Fase %v, snub %v: temperatura de %.0f °C não atingida no resfriamento em %v s", phase.name, simulation.phase.Snubs+1, phase.cooldownTemperature, phase.maxTimeCooldown)
+			break
+		}
+		simulation.step(phase, -simulatedCoastDeceleration, false)
+	}
+
+	return true
+}
+
+// Readings of both sensors, the model has a single disc temperature
+func (simulation *benchSimulation) temperatures() [2]float64 {
+	return [2]float64{simulation.temperature, simulation.temperature}
+}
+
+// Deceleration while braking, in m/s²
+func (simulation *benchSimulation) deceleration(phase *Phase) float64 {
+	parameters := simulation.experiment.brakeParameters
+
+	switch phase.brakeMode {
+	case decelerationBraking:
+		return phase.targetDeceleration
+	case pressureBraking:
+		if parameters.inertia > 0 && parameters.wheelRadius > 0 && parameters.pistonArea > 0 && parameters.effectiveRadius > 0 {
+			clampForce := phase.targetPressure * parameters.pistonArea * 10 // bar·cm² to N
+			torque := 2 * simulatedFriction * clampForce * parameters.effectiveRadius
+			return torque / parameters.inertia * parameters.wheelRadius
+		}
+		return simulatedDeceleration * phase.targetPressure / simulation.experiment.maxPressure
+	default:
+		return simulatedDeceleration
+	}
+}
+
+// Kinetic energy of the flywheel at speed, in J
+func (simulation *benchSimulation) energy(speed float64) float64 {
+	parameters := simulation.experiment.brakeParameters
+	speed /= 3.6
+
+	if parameters.inertia > 0 && parameters.wheelRadius > 0 {
+		angularSpeed := speed / parameters.wheelRadius
+		return parameters.inertia * angularSpeed * angularSpeed / 2
+	}
+	return simulatedMass * speed * speed / 2
+}
+
+// Advances the simulation by a step with the given acceleration, in m/s².
+// Returns false when the experiment takes too long to be real
+func (simulation *benchSimulation) step(phase *Phase, acceleration float64, isBraking bool) bool {
+	speed := math.Max(simulation.speed+acceleration*3.6*simulationStep, 0)
+
+	if isBraking {
+		simulation.temperature += (simulation.energy(simulation.speed) - simulation.energy(speed)) / simulatedHeatCapacity
+	}
+
+	cooling := simulatedCooling
+	if simulation.time < simulation.waterUntil {
+		cooling = simulatedWaterCooling
+	}
+	simulation.temperature -= (simulation.temperature - simulatedAmbientTemperature) * cooling * simulationStep
+
+	simulation.report.Distance += travelledDistance((simulation.speed+speed)/2, time.Duration(simulationStep*float64(time.Second)))
+	simulation.speed = speed
+	simulation.time += simulationStep
+
+	simulation.checkTemperature(phase)
+
+	if simulation.time > simulationMaxDuration {
+		simulation.violation("O ensaio não terminaria em %v", time.Duration(simulationMaxDuration*float64(time.Second)))
+		return false
+	}
+	return true
+}
+
+// Throws water as the experiment does, or reports that the limit was exceeded
+func (simulation *benchSimulation) checkTemperature(phase *Phase) {
+	simulation.phase.PeakTemperature = math.Max(simulation.phase.PeakTemperature, simulation.temperature)
+	simulation.report.PeakTemperature = math.Max(simulation.report.PeakTemperature, simulation.temperature)
+
+	if !isAboveTemperatureLimit(simulation.temperatures(), phase.temperatureLimit) {
+		return
+	}
+
+	if phase.doEnableWater {
+		if simulation.time >= simulation.waterUntil {
+			simulation.waterUntil = simulation.time + phase.timeSleepWater
+			simulation.report.WaterActivations++
+		}
+	} else {
+		simulation.safetyViolation("Fase %v, snub %v: temperatura de %.0f °C acima do limite de %v °C, sem água habilitada", phase.name, simulation.phase.Snubs+1, simulation.temperature, phase.temperatureLimit)
+	}
+}
+
+// Simulates experiments received from MQTT, publishing the report
+func (bench *Bench) handleSimulationReceiving() {
+	bench.subscribeMqtt(mqttSubchannelSimulate, func(_ *emitter.Client, msg emitter.Message) {
+		go func() {
+			report := simulateExperiment(msg.Payload())
+			bench.logger().WithField("valid", report.Valid).Info("Experiment simulated")
+
+			data, _ := json.Marshal(report)
+			bench.publishData(string(data), mqttSubchannelSimulation)
+		}()
+	})
+}
+
+// Simulates an experiment from a file by command line
+func runSimulationCommandLine(args []string) bool {
+	if len(args) != 1 {
+		fmt.Println("Uso: unbrake-local simulate <arquivo do ensaio>")
+		return false
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Println("Não foi possível ler o ensaio: ", err)
+		return false
+	}
+
+	report := simulateExperiment(data)
+
+	if report.Valid {
+		fmt.Println("Ensaio válido")
+		for i, phase := range report.Phases {
+			fmt.Printf("Fase %v (%v): %v snubs, %v, %.3f km, até %v\n", i+1, phase.Name, phase.Snubs,
+				formatSimulatedDuration(phase.Duration), phase.Distance, formatTemperature(phase.PeakTemperature))
+		}
+		fmt.Printf("Total: %v snubs, %v, %.3f km, até %v, água acionada %v vezes\n", report.Snubs,
+			formatSimulatedDuration(report.Duration), report.Distance, formatTemperature(report.PeakTemperature), report.WaterActivations)
+	} else {
+		fmt.Println("Ensaio inválido")
+	}
+
+	for _, violation := range report.Violations {
+		fmt.Println("* " + violation)
+	}
+
+	return false
+}
+
+func formatSimulatedDuration(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"strconv"
 	"sync"
 	"time"
@@ -20,6 +19,9 @@ const (
 	aceleratingBrakingWater                      //'+'
 )
 
+// Interval between checks of the end condition of cooldown
+const cooldownCheckInterval = time.Millisecond * 500
+
 // Mapping current state to next state
 var currentToNextState = map[string]string{
 	acelerating:      braking,
@@ -74,6 +76,12 @@ type Snub struct {
 	isWaterOn             bool
 	isStabilizing         bool
 	timeCooldown          int
+	completed             int // Number of snubs already finished
+	experimentID          int
+	bench                 *Bench
+	isCooldownOver        func() bool
+	maxTimeCooldown       int       // When isCooldownOver is set, max time waiting on cooldown
+	stopCh                chan bool // Closed when the experiment stops, no state is changed after it
 	mux                   sync.Mutex
 }
 
@@ -82,38 +90,100 @@ func (snub *Snub) NextState() {
 	snub.mux.Lock()
 	defer snub.mux.Unlock()
 
+	if snub.isStopped() {
+		return
+	}
+
 	switch snub.state {
 
 	case acelerating, aceleratingWater: // Next is Braking
 		snub.isStabilizing = true
 
-		log.Println("Stabilizing...")
-		time.Sleep(time.Second * time.Duration(snub.delayAcelerateToBrake))
-		snub.changeState() // Acelerate ---> braking
+		snub.logger().Debug("Stabilizing")
+		if snub.sleep(time.Second * time.Duration(snub.delayAcelerateToBrake)) {
+			snub.changeState() // Acelerate ---> braking
+		}
 
 		snub.isStabilizing = false
 
 	case braking, brakingWater: // Next is Cooldown
 		snub.isStabilizing = true
-		log.Println("Stabilizing...")
-		time.Sleep(time.Second * time.Duration(snub.delayBrakeToCooldown))
+		snub.logger().Debug("Stabilizing")
+		if !snub.sleep(time.Second * time.Duration(snub.delayBrakeToCooldown)) {
+			snub.isStabilizing = false
+			return
+		}
 
 		snub.changeState() // Brake ---> Cooldown
 		snub.isStabilizing = false
-		time.Sleep(time.Second * time.Duration(snub.timeCooldown))
+		snub.waitCooldown()
 
 	case cooldown, cooldownWater: // Next is acelerate, end of a cycle
-		log.Println("---> End of snub <---")
+		snub.logger().Info("End of snub")
 		snub.changeState()
-		counter, isOpen := <-snub.counterCh
+
+		var counter int
+		isOpen := false
+		select {
+		case counter, isOpen = <-snub.counterCh:
+		case <-snub.stopCh:
+		}
 
 		if isOpen {
-			snub.counterCh <- counter + 1
-			publishData(strconv.Itoa(counter), mqttSubchannelCurrentSnub)
+			snub.completed = counter
+			completedSnubsMetric.WithLabelValues(snub.bench.name).Set(float64(counter))
+			select {
+			case snub.counterCh <- counter + 1:
+			case <-snub.stopCh: // Nobody reads the counter anymore
+				return
+			}
+			snub.bench.publishData(strconv.Itoa(counter), mqttSubchannelCurrentSnub)
 		}
 
 	default:
-		log.Printf("Invalid state: %v", snub.state)
+		snub.logger().Error("Invalid state")
+		snub.recordEvent(faultEvent, EventData{"state": snub.state}, "Estado inválido")
+	}
+}
+
+// Waits a fixed time on cooldown or, if there is an end condition,
+// until it's satisfied or the max time is reached
+func (snub *Snub) waitCooldown() {
+	if snub.isCooldownOver == nil {
+		snub.sleep(time.Second * time.Duration(snub.timeCooldown))
+		return
+	}
+
+	timeout := time.After(time.Second * time.Duration(snub.maxTimeCooldown))
+	for !snub.isCooldownOver() {
+		select {
+		case <-timeout:
+			snub.logger().Warn("Cooldown condition not reached, max time of cooldown exceeded")
+			snub.recordEvent(faultEvent, EventData{"max_time": snub.maxTimeCooldown}, "Resfriamento não atingiu a temperatura em %v s", snub.maxTimeCooldown)
+			return
+		case <-time.After(cooldownCheckInterval):
+		case <-snub.stopCh:
+			return
+		}
+	}
+}
+
+// Waits for duration, returning false when the experiment stopped meanwhile
+func (snub *Snub) sleep(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-snub.stopCh:
+		return false
+	}
+}
+
+func (snub *Snub) isStopped() bool {
+	select {
+	case <-snub.stopCh:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -133,8 +203,12 @@ func (snub *Snub) setStateNonExclusion(state string) {
 	oldState := snub.state
 	snub.state = state
 
-	port.Write([]byte(snub.state))
+	if snub.bench.port.Write([]byte(snub.state)) < 0 {
+		snub.recordEvent(faultEvent, EventData{"state": byteToStateName[snub.state]}, "Falha ao enviar o estado pela porta serial")
+	}
 
-	publishData(byteToStateName[snub.state], mqttSubchannelSnubState)
-	log.Printf("Change state: %v ---> %v\n", byteToStateName[oldState], byteToStateName[snub.state])
+	snub.bench.publishData(byteToStateName[snub.state], mqttSubchannelSnubState)
+	snub.bench.setSnubStateMetric(snub.state)
+	snub.logger().WithField("from", byteToStateName[oldState]).Info("Change state")
+	snub.recordEvent(stateEvent, EventData{"from": byteToStateName[oldState], "to": byteToStateName[snub.state], "snub": snub.completed + 1}, "Estado %v → %v", byteToStateName[oldState], byteToStateName[snub.state])
 }
@@ -14,231 +14,204 @@ interact with the application.
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/systray"
-	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
 )
 
+// Version of the application, set on compile time with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
+
 // Channels general for controlling execution
 var (
-	wgQuit                      sync.WaitGroup
-	wgGeneral                   sync.WaitGroup
-	wgHandleExperimentReceiving sync.WaitGroup
-	stopCollectingDataCh        chan bool
-	sigsCh                      chan os.Signal
+	wgGeneral            sync.WaitGroup
+	stopCollectingDataCh chan bool
+	sigsCh               chan os.Signal
 )
 
 var (
-	connectStatusCh        = make(chan string, 1)
-	aplicationStatusCh     = make(chan string)
-	mqttKeyStatusCh        = make(chan string)
-	quitExperimentEnableCh = make(chan bool)
-	quitExperimentCh       = make(chan bool)
-	idRunningExperiment    = make(chan int)
-	changeIcon             = make(chan bool)
-	clientWriting          *emitter.Client
-	clientReading          *emitter.Client
+	connectStatusCh = make(chan string, 1)
+	mqttKeyStatusCh = make(chan string)
+	changeIcon      = make(chan bool)
+	isTrayReady     int32 // Set to 1 once systray runs
 )
 
 func main() {
+	setAppDirs(os.Args[1:])
+	migrated, migrationErr := migrateLegacyFolder()
+
 	logFile := getLogFile()
 	defer logFile.Close()
 
-	loadConfigFile()
+	if len(migrated) > 0 {
+		logger.WithField("files", strings.Join(migrated, ",")).Info("Files moved from legacy folder")
+	}
+	if migrationErr != nil {
+		logger.WithError(migrationErr).Error("Wasn't possible to move every file from legacy folder")
+	}
 
-	log.Println("--------------------------------------------")
-	log.Println("Initializing application...")
+	args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		printUsage()
+		return
+	} else if err != nil {
+		logger.WithError(err).Error("Invalid configuration")
+		fmt.Fprintf(os.Stderr, "%v\n%v\n", tr("Configuração inválida:"), err)
+		os.Exit(2)
+	}
 
-	sigsCh = make(chan os.Signal, 1)
-	signal.Notify(sigsCh, os.Interrupt)
+	setupBenches()
+	setupLanguage()
 
-	for i, subChannel := range mqttSubchannelSerialAttrs {
-		serialAttrs[i].mqttSubchannel = subChannel
-		serialAttrs[i].publishCh = make(chan string)
-		serialAttrs[i].handleCh = make(chan float64)
+	if !handleCommandLine(args) {
+		return
 	}
 
-	clientWriting, _ = emitter.Connect(
-		getMqttHost(),
-		func(_ *emitter.Client, msg emitter.Message) {},
-		emitter.WithConnectTimeout(time.Second*2),
-		emitter.WithAutoReconnect(true),
-		emitter.WithPingTimeout(time.Second*2),
-	)
-
-	clientReading, _ = emitter.Connect(
-		getMqttHost(),
-		func(_ *emitter.Client, msg emitter.Message) {},
-		emitter.WithConnectTimeout(time.Second*2),
-		emitter.WithAutoReconnect(true),
-		emitter.WithPingTimeout(time.Second*2),
-	)
-
-	clientWriting.OnConnect(func(_ *emitter.Client) {
-		wgHandleExperimentReceiving.Done()
-		wgQuit.Done()
-		connectStatusCh <- "Conectado"
-		log.Println("Connected with writing broker successfully")
-	})
-
-	clientReading.OnConnect(func(_ *emitter.Client) {
-		log.Println("Connected with reading broker successfully")
-	})
-
-	clientWriting.OnDisconnect(func(_ *emitter.Client, err error) {
-		connectStatusCh <- "Desconectado"
-		log.Println("Disconnected from writing from broker: ", err)
-	})
-
-	clientReading.OnDisconnect(func(_ *emitter.Client, err error) {
-		connectStatusCh <- "Desconectado"
-		log.Println("Disconnected from reading from broker: ", err)
-	})
-
-	if clientWriting.IsConnected() {
-		connectStatusCh <- "Conectado"
-	} else {
-		connectStatusCh <- "Desconectado"
-	}
+	logger.WithFields(logrus.Fields{"version": version, "benches": len(benches)}).Info("Initializing application")
+
+	sigsCh = make(chan os.Signal, 1)
+	signal.Notify(sigsCh, os.Interrupt)
+
+	connectMqtt()
+	go watchConfig()
 
 	onExit := func() {
-		log.Println("Exiting...")
+		logger.Info("Exiting")
 	}
 	systray.Run(onReady, onExit)
 
-	log.Println("Application finished!")
-	log.Println("--------------------------------------------")
+	logger.Info("Application finished")
 }
 
 // Required by systray (GUI)
 func onReady() {
+	atomic.StoreInt32(&isTrayReady, 1)
 	systray.SetIcon(IconDisabled)
 	systray.SetTitle("UnBrake")
 	systray.SetTooltip("UnBrake")
 
-	statusTitle := systray.AddMenuItem("Status", "Seção para visualização do status da aplicação")
+	statusTitle := systray.AddMenuItem(tr("Status"), tr("Seção para visualização do status da aplicação"))
 	statusTitle.Disable()
-	statusCollecting := systray.AddMenuItem("Status de arquisição", "Não iniciada")
-	mqttKeyStatus := systray.AddMenuItem("Chave de acesso: Não avaliada", "Status da chave do MQTT")
-
-	connectStatus := systray.AddMenuItem("Deconectado", "Status de conecção")
+	mqttKeyStatus := systray.AddMenuItem(tr("Chave de acesso: Não avaliada"), tr("Status da chave do MQTT"))
 
-	handlePortsSectionGUI()
+	connectStatus := systray.AddMenuItem(tr("Desconectado"), tr("Status de conexão"))
 
-	quitExperiment := systray.AddMenuItem("Encerrar ensaio", "Finaliza o ensaio atual")
-	quitExperiment.Disable()
+	for _, bench := range benches {
+		handleBenchSectionGUI(bench)
+	}
 
-	mQuitOrig := systray.AddMenuItem("Sair", "Fechar UnBrake")
+	mQuitOrig := systray.AddMenuItem(tr("Sair"), tr("Fechar UnBrake"))
 
 	go func() {
 		for {
 			select {
 			case connectStatusAux := <-connectStatusCh:
 				connectStatus.SetTitle(connectStatusAux)
-			case aplicationStatusAux := <-aplicationStatusCh:
-				statusCollecting.SetTitle(aplicationStatusAux)
 			case mqttKeyStatusChAux := <-mqttKeyStatusCh:
 				mqttKeyStatus.SetTitle(mqttKeyStatusChAux)
-			case quitExperimentAux := <-quitExperimentEnableCh:
-				if quitExperimentAux {
-					quitExperiment.Disable()
-				} else {
-					quitExperiment.Enable()
-				}
-			case <-quitExperiment.ClickedCh:
-				quitExperimentCh <- true
-				quitExperiment.Disable()
-				isAvailable = true
-				systray.SetIcon(IconDisabled)
-				log.Println("Experiment finished by user")
 			}
 		}
 	}()
 
 	go testKeys()
+	go handleLogLevelReceiving()
 
-	go func() {
-		for {
-			wgQuit.Add(1)
-			key := getMqttKey()
-
-			channel := getMqttChannelPrefix() + "/quitExperiment"
-
-			clientReading.Subscribe(key, channel, func(_ *emitter.Client, msg emitter.Message) {
-				if !isAvailable {
-					log.Println("Experiment finished by user")
-
-					quitExperimentCh <- true
-					quitExperiment.Disable()
-					isAvailable = true
-					systray.SetIcon(IconDisabled)
-					wgQuit.Done()
-					wgHandleExperimentReceiving.Done()
-				}
-			})
-
-			wgQuit.Wait()
-		}
-	}()
-
-	stopCollectingDataCh = make(chan bool, 1)
+	stopCollectingDataCh = make(chan bool)
 
 	// Wait for quitting
 	go func() {
+		source := "interface"
 		select {
 		case <-mQuitOrig.ClickedCh:
-			log.Println("Quitting request by interface")
-			port.Write([]byte(cooldown))
-			log.Println("Application finished by user")
-			log.Println("Change state: _ ---> cooldown")
 		case <-sigsCh:
-			log.Println("Quitting request by signal")
-			port.Write([]byte(cooldown))
-			log.Println("Application finished by user")
-			log.Println("Change state: _ ---> cooldown")
+			source = "signal"
 		}
 
-		stopCollectingDataCh <- true
+		for _, bench := range benches {
+			bench.port.Write([]byte(cooldown))
+			bench.logger().WithField(stateField, byteToStateName[cooldown]).Info("Application finished by user from " + source)
+		}
+
+		close(stopCollectingDataCh)
 
 		systray.Quit()
-		log.Println("Finished systray")
+		logger.Info("Finished systray")
 	}()
 
+	go serveMetrics()
+	for _, bench := range benches {
+		bench.start()
+	}
+
+	wgGeneral.Wait()
+}
+
+// Adds an item to the menu of a bench
+type menuAdder func(title, tooltip string) *systray.MenuItem
+
+// Status and controls of the bench, on the root of the menu when there is
+// only one bench, otherwise on a submenu of its own
+func handleBenchSectionGUI(bench *Bench) {
+	addMenuItem := menuAdder(systray.AddMenuItem)
+	if len(benches) > 1 {
+		systray.AddSeparator()
+		addMenuItem = systray.AddMenuItem(tr("Bancada %v", bench.name), tr("Status e operação da bancada")).AddSubMenuItem
+	}
+
+	statusCollecting := addMenuItem(tr("Status de aquisição"), tr("Não iniciada"))
+
+	handlePortsSectionGUI(bench, addMenuItem)
+	handleMaintenanceSectionGUI(bench, addMenuItem)
+
+	quitExperiment := addMenuItem(tr("Encerrar ensaio"), tr("Finaliza o ensaio atual"))
+	quitExperiment.Disable()
+
+	resumeExperimentItem := addMenuItem(tr("Retomar ensaio interrompido"), tr("Retoma o ensaio interrompido, se a bancada estiver segura"))
+	resumeExperimentItem.Disable()
+
+	queueItem := addMenuItem(tr("Fila: vazia"), tr("Ensaios aguardando a bancada"))
+	queueItem.Disable()
+
 	go func() {
 		for {
 			select {
-			case idAux := <-idRunningExperiment:
-
-				if !isAvailable {
-					publishData("false: "+strconv.Itoa(idAux), mqttSubchannelIsAvailable)
+			case <-time.After(queuePollInterval):
+				if length := bench.queue.Len(); length > 0 {
+					queueItem.SetTitle(tr("Fila: %v ensaio(s)", length))
+				} else {
+					queueItem.SetTitle(tr("Fila: vazia"))
 				}
-			default:
-
-				if isAvailable {
-					publishData("true", mqttSubchannelIsAvailable)
-					time.Sleep(time.Millisecond * 500)
+			case aplicationStatusAux := <-bench.statusCh:
+				statusCollecting.SetTitle(aplicationStatusAux)
+			case quitExperimentAux := <-bench.quitEnableCh:
+				if quitExperimentAux {
+					quitExperiment.Disable()
+				} else {
+					quitExperiment.Enable()
+				}
+			case resumeExperimentAux := <-bench.resumeEnableCh:
+				if resumeExperimentAux {
+					resumeExperimentItem.Enable()
+				} else {
+					resumeExperimentItem.Disable()
 				}
+			case <-resumeExperimentItem.ClickedCh:
+				go bench.resumeExperiment()
+			case <-quitExperiment.ClickedCh:
+				quitExperiment.Disable()
+				go bench.quitExperiment(systraySource)
 			}
 		}
 	}()
-
-	wgGeneral.Add(1)
-	go CollectData()
-	go HandleExperimentsReceiving()
-
-	if getMqttKey() != "" {
-		go publishSerialAttrs()
-	} else {
-		log.Println("MQTT key not set!!! Data will not be published...")
-	}
-
-	wgGeneral.Wait()
 }
 
 var ever = true
@@ -1,7 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 func TestUpdateStateWater(t *testing.T) {
@@ -25,3 +40,1667 @@ func TestUpdateStateWater(t *testing.T) {
 		t.Errorf("Wrong state %v != %v", byteToStateName[snub.state], byteToStateName[aceleratingWater])
 	}
 }
+
+func TestPhaseOfSnub(t *testing.T) {
+
+	experiment := Experiment{phases: []Phase{{totalOfSnubs: 2}, {totalOfSnubs: 3}, {totalOfSnubs: 1}}}
+
+	expected := []int{0, 0, 1, 1, 1, 2}
+	for i, phase := range expected {
+		if got := experiment.phaseOfSnub(i + 1); got != phase {
+			t.Errorf("Wrong phase of snub %v: %v != %v", i+1, got, phase)
+		}
+	}
+}
+
+func TestTemperatureReached(t *testing.T) {
+
+	cases := []struct {
+		temperatures [2]float64
+		condition    string
+		above        bool
+		expected     bool
+	}{
+		{[2]float64{90, 50}, anySensor, true, true},
+		{[2]float64{90, 50}, bothSensors, true, false},
+		{[2]float64{90, 85}, bothSensors, true, true},
+		{[2]float64{80, 70}, anySensor, true, true}, // Target itself is reached
+		{[2]float64{70, 90}, anySensor, false, true},
+		{[2]float64{70, 90}, bothSensors, false, false},
+		{[2]float64{70, 60}, bothSensors, false, true},
+		{[2]float64{81, 90}, anySensor, false, false},
+	}
+
+	for _, c := range cases {
+		if reached := isTemperatureReached(c.temperatures, 80, c.condition, c.above); reached != c.expected {
+			t.Errorf("Temperatures %v, %v, above %v: reached %v, expected %v", c.temperatures, c.condition, c.above, reached, c.expected)
+		}
+	}
+
+	phase := Phase{cooldownTemperature: 80, temperatureCondition: bothSensors}
+	if phase.isHeatingOver([2]float64{500, 500}) {
+		t.Error("Heating over on a phase without heating temperature")
+	}
+	if !phase.isCooldownOver([2]float64{80, 60}) || phase.isCooldownOver([2]float64{60, 90}) {
+		t.Error("Wrong end of cooldown on both sensors")
+	}
+}
+
+func TestWaitCooldown(t *testing.T) {
+
+	cases := []struct {
+		name         string
+		checksToCool int // Checks until cooldown is over, 0 never
+		maxTime      int
+		minDuration  time.Duration
+		maxDuration  time.Duration
+	}{
+		{"already cool", 1, 5, 0, cooldownCheckInterval / 2},
+		{"cools down", 3, 5, 2 * cooldownCheckInterval, 3 * cooldownCheckInterval},
+		{"max time", 0, 1, time.Second, time.Second + cooldownCheckInterval},
+	}
+
+	for _, c := range cases {
+		checks := 0
+		snub := Snub{maxTimeCooldown: c.maxTime, stopCh: make(chan bool)}
+		snub.isCooldownOver = func() bool {
+			checks++
+			return c.checksToCool > 0 && checks >= c.checksToCool
+		}
+
+		start := time.Now()
+		snub.waitCooldown()
+		if elapsed := time.Since(start); elapsed < c.minDuration || elapsed > c.maxDuration {
+			t.Errorf("%v: cooldown took %v, expected between %v and %v", c.name, elapsed, c.minDuration, c.maxDuration)
+		}
+	}
+
+	snub := Snub{maxTimeCooldown: 60, stopCh: make(chan bool), isCooldownOver: func() bool { return false }}
+	close(snub.stopCh)
+	start := time.Now()
+	if snub.waitCooldown(); time.Since(start) > cooldownCheckInterval {
+		t.Error("Cooldown not finished when experiment stopped")
+	}
+}
+
+func TestCheckHeatingPhase(t *testing.T) {
+
+	cases := []struct {
+		name         string
+		temperatures [2]float64
+		condition    string
+		counter      int
+		expected     int // Counter after check
+	}{
+		{"not reached", [2]float64{70, 20}, anySensor, 10, 10},
+		{"reached on any", [2]float64{85, 20}, anySensor, 10, 54},
+		{"reached on one of both", [2]float64{85, 20}, bothSensors, 10, 10},
+		{"reached on both", [2]float64{85, 80}, bothSensors, 10, 54},
+		{"on last snub", [2]float64{85, 20}, anySensor, 53, 54},
+	}
+
+	for _, c := range cases {
+		experiment, err := ExperimentFromJSON(nil, []byte(testExperimentPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		experiment.currentPhase = 1 // Fade, from snub 4 to 53, ends at 80 °C
+		experiment.phases[1].temperatureCondition = c.condition
+		experiment.temperatures, experiment.hasTemperatures = c.temperatures, true
+		experiment.stopCh = make(chan bool)
+		experiment.snub.counterCh = make(chan int, 1)
+		experiment.snub.counterCh <- c.counter
+
+		experiment.checkHeatingPhase()
+
+		if counter := <-experiment.snub.counterCh; counter != c.expected {
+			t.Errorf("%v: counter %v, expected %v", c.name, counter, c.expected)
+		}
+		if c.expected != c.counter && experiment.snub.completed != 53 {
+			t.Errorf("%v: snubs of phase not skipped, completed %v", c.name, experiment.snub.completed)
+		}
+	}
+}
+
+func TestControllerSaturation(t *testing.T) {
+
+	controller := Controller{kp: 10, ki: 5, max: 100}
+
+	for i := 0; i < 10; i++ {
+		if output := controller.Update(50, 0, 1); output != 100 {
+			t.Errorf("Output not saturated: %v != 100", output)
+		}
+	}
+
+	if controller.integral != 0 {
+		t.Errorf("Integral accumulated while saturated: %v", controller.integral)
+	}
+
+	if output := controller.Update(0, 10, 1); output != 0 {
+		t.Errorf("Output not saturated: %v != 0", output)
+	}
+}
+
+func TestPressureCommand(t *testing.T) {
+
+	commands := []struct {
+		channel  int
+		percent  float64
+		expected string
+	}{
+		{0, 0, "0e"},
+		{1, 50, "1q"},
+		{3, 100, "3~"},
+		{9, 150, "9~"},
+		{2, -10, "2e"},
+	}
+
+	for _, command := range commands {
+		if encoded := pressureCommand(command.channel, command.percent); string(encoded) != command.expected {
+			t.Errorf("Wrong command of %v%% on channel %v: %q != %q", command.percent, command.channel, encoded, command.expected)
+		}
+	}
+}
+
+func TestCalibrationCurves(t *testing.T) {
+
+	polynomial := PolynomialCurve{coefficients: []float64{1, 2, 3}}
+	if value := polynomial.Convert(2); value != 17 {
+		t.Errorf("Wrong polynomial conversion: %v != 17", value)
+	}
+
+	table := newTableCurve([][2]float64{{100, 10}, {0, 0}, {200, 40}})
+	cases := map[float64]float64{0: 0, 50: 5, 150: 25, 250: 55, -100: -10}
+	for milliVolts, expected := range cases {
+		if value := table.Convert(milliVolts); value != expected {
+			t.Errorf("Wrong table conversion of %v: %v != %v", milliVolts, value, expected)
+		}
+	}
+}
+
+func TestTwoPointCalibration(t *testing.T) {
+
+	zero := calibrationPoint{Reference: 0, Noise: noiseStatistics([]float64{204.6, 204.6})} // 1000 mV
+	span := calibrationPoint{Reference: 100, Noise: noiseStatistics([]float64{409, 409.4})} // 2000 mV
+
+	factor, offset, err := twoPointCalibration(zero, span)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(factor-0.1) > 1e-9 || math.Abs(offset+100) > 1e-9 {
+		t.Errorf("Wrong calibration: factor %v != 0.1, offset %v != -100", factor, offset)
+	}
+
+	if _, _, err = twoPointCalibration(zero, zero); err == nil {
+		t.Error("Calibration without difference between points should fail")
+	}
+}
+
+func TestComputeSnubMetrics(t *testing.T) {
+
+	var samples []metricsSample
+	begin := time.Now()
+
+	// Constant deceleration from 100 km/h to 0 in 10 s
+	for i := 0; i <= 100; i++ {
+		values := make([]float64, numSerialAttrs)
+		values[frequencyIdx] = 100 - float64(i)
+		values[brakingForce1Idx], values[brakingForce2Idx] = 100, 100
+		values[pressureIdx] = 10
+		values[temperature1Idx], values[temperature2Idx] = 50+float64(i), 40
+
+		samples = append(samples, metricsSample{
+			time:      begin.Add(time.Millisecond * time.Duration(100*i)),
+			isBraking: true,
+			values:    values,
+		})
+	}
+
+	parameters := BrakeParameters{leverRadius: 0.5, effectiveRadius: 0.1, pistonArea: 10, inertia: 2, wheelRadius: 0.3}
+	metrics := computeSnubMetrics(samples, parameters)
+
+	expected := map[string][2]float64{
+		"mean torque":       {metrics.MeanTorque, 100},
+		"friction":          {metrics.Friction, 0.5},
+		"mfdd":              {metrics.MFDD, 100 / 3.6 / 10},
+		"stopping time":     {metrics.StoppingTime, 10},
+		"stopping distance": {metrics.StoppingDistance, 100 / 3.6 * 10 / 2},
+		"energy":            {metrics.Energy, 2 * math.Pow(100/3.6/0.3, 2) / 2},
+		"peak temperature":  {metrics.PeakTemperature, 150},
+	}
+
+	for name, values := range expected {
+		if math.Abs(values[0]-values[1]) > 1e-6*math.Max(1, values[1]) {
+			t.Errorf("Wrong %v: %v != %v", name, values[0], values[1])
+		}
+	}
+}
+
+func TestAnalyzeExperiment(t *testing.T) {
+
+	metrics := []SnubMetrics{
+		{Phase: "Baseline", Friction: 0.4, InitialTemperature: 60},
+		{Phase: "Baseline", Friction: 0.4, InitialTemperature: 70},
+		{Phase: "Fade", Friction: 0.3, InitialTemperature: 200},
+		{Phase: "Fade", Friction: 0.2, InitialTemperature: 320},
+		{Phase: "Recovery", Friction: 0.38, InitialTemperature: 90},
+	}
+
+	analysis := analyzeExperiment(metrics)
+
+	if math.Abs(analysis.BaselineFriction-0.4) > 1e-9 {
+		t.Errorf("Wrong baseline: %v != 0.4", analysis.BaselineFriction)
+	}
+
+	if math.Abs(analysis.Fade-50) > 1e-9 {
+		t.Errorf("Wrong fade: %v != 50", analysis.Fade)
+	}
+
+	if math.Abs(analysis.Recovery-95) > 1e-9 {
+		t.Errorf("Wrong recovery: %v != 95", analysis.Recovery)
+	}
+
+	if len(analysis.Phases) != 3 || len(analysis.FrictionByTemperature) != 3 {
+		t.Errorf("Wrong number of phases (%v) or temperature points (%v)", len(analysis.Phases), len(analysis.FrictionByTemperature))
+	}
+}
+
+func TestFilters(t *testing.T) {
+
+	newTestFilter := func(config FilterConfig) Filter {
+		filter, err := newFilter(config, defaultReadingFrequency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+
+	// Output after a step from 0 to 10 preceded by a spike
+	signal := []float64{0, 0, 0, 0, 100, 0, 0, 10, 10, 10, 10, 10}
+
+	cases := map[string]struct {
+		filter   Filter
+		expected float64
+	}{
+		"moving average": {newTestFilter(FilterConfig{Type: movingAverageFilter, Window: 4}), 10},
+		"median":         {newTestFilter(FilterConfig{Type: medianFilter, Window: 3}), 10},
+		"outlier":        {newTestFilter(FilterConfig{Type: outlierFilter, Window: 5, Threshold: 3}), 10},
+	}
+
+	for name, c := range cases {
+		var output float64
+		for _, value := range signal {
+			output = c.filter.Apply(value)
+		}
+		if math.Abs(output-c.expected) > 1e-9 {
+			t.Errorf("Wrong output of %v: %v != %v", name, output, c.expected)
+		}
+	}
+
+	median := newTestFilter(FilterConfig{Type: medianFilter, Window: 3})
+	for _, value := range signal[:6] {
+		if output := median.Apply(value); output != 0 {
+			t.Errorf("Median didn't remove spike: %v", output)
+		}
+	}
+
+	butterworth := newTestFilter(FilterConfig{Type: butterworthFilter, Cutoff: 5})
+	for i := 0; i < 200; i++ {
+		butterworth.Apply(10)
+	}
+	if output := butterworth.Apply(10); math.Abs(output-10) > 1e-6 {
+		t.Errorf("Butterworth has gain on steady state: %v != 10", output)
+	}
+
+	for _, config := range []FilterConfig{{Type: "kalman"}, {Type: exponentialFilter, Alpha: 2}, {Type: butterworthFilter, Cutoff: defaultReadingFrequency}} {
+		if _, err := newFilter(config, defaultReadingFrequency); err == nil {
+			t.Errorf("Invalid filter accepted: %+v", config)
+		}
+	}
+}
+
+func TestSampleRing(t *testing.T) {
+
+	ring := newSampleRing(4)
+	if ring.Latest() != nil {
+		t.Error("Empty ring has latest sample")
+	}
+
+	reader := ring.Reader()
+	for i := 0; i < 10; i++ {
+		ring.Push(&Sample{Raw: []float64{float64(i)}})
+	}
+
+	if latest := ring.Latest(); latest.Seq != 9 || latest.Raw[0] != 9 {
+		t.Errorf("Wrong latest sample: %+v", latest)
+	}
+
+	var read []uint64
+	for sample, ok := reader.Next(); ok; sample, ok = reader.Next() {
+		read = append(read, sample.Seq)
+	}
+
+	if len(read) != 4 || read[0] != 6 || read[3] != 9 || reader.dropped != 6 {
+		t.Errorf("Wrong samples read %v, dropped %v", read, reader.dropped)
+	}
+
+	if frame := parseLine("1, 2,3,4,5,6,7,8,9,,\r"); frame == nil || frame[1] != 2 {
+		t.Errorf("Valid line not parsed: %v", frame)
+	}
+
+	if frame := parseLine("1,2,x,4,5,6,7,8,9,,"); frame != nil {
+		t.Errorf("Invalid line parsed: %v", frame)
+	}
+}
+
+func TestSampleBus(t *testing.T) {
+
+	var bus SampleBus
+	every := func(n int) func() int { return func() int { return n } }
+
+	newest := bus.Subscribe("newest", dropNewestPolicy, 2, every(1))
+	oldest := bus.Subscribe("oldest", dropOldestPolicy, 1, every(1))
+	decimated := bus.Subscribe("decimated", dropNewestPolicy, 10, every(2))
+
+	for i := uint64(0); i < 5; i++ {
+		bus.Publish(&Sample{Seq: i})
+	}
+
+	expected := map[*Subscription][]uint64{newest: {0, 1}, oldest: {4}, decimated: {0, 2, 4}}
+	dropped := map[*Subscription]uint64{newest: 3, oldest: 4, decimated: 0}
+
+	for subscription, seqs := range expected {
+		if subscription.Dropped() != dropped[subscription] {
+			t.Errorf("Wrong drops of %v: %v != %v", subscription.name, subscription.Dropped(), dropped[subscription])
+		}
+
+		bus.Unsubscribe(subscription)
+
+		var received []uint64
+		for sample := range subscription.C {
+			received = append(received, sample.Seq)
+		}
+
+		if len(received) != len(seqs) || received[len(received)-1] != seqs[len(seqs)-1] {
+			t.Errorf("Wrong frames received by %v: %v != %v", subscription.name, received, seqs)
+		}
+	}
+
+	if len(bus.Stats()) != 0 {
+		t.Errorf("Subscriptions left: %v", bus.Stats())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	filePath := path.Join(folder, "config.yaml")
+	ioutil.WriteFile(filePath, []byte("mqttHost: broker\nmqttport: \"1883\"\nbaudRate: 9600\nfilters:\n  speed:\n    - type: median\n      window: 5\n"), 0666)
+
+	os.Setenv("MQTT_PORT", "1884")
+	defer os.Unsetenv("MQTT_PORT")
+
+	args, err := loadConfig([]string{"-config", filePath, "-baud-rate", "19200", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configFile = defaultConfig() }()
+
+	if len(args) != 1 || args[0] != "status" {
+		t.Errorf("Wrong arguments left: %v", args)
+	}
+
+	if configFile.MqttHost != "broker" || configFile.MqttPort != "1884" || configFile.BaudRate != 19200 || len(configFile.Filters["speed"]) != 1 {
+		t.Errorf("Wrong layering: %+v", configFile)
+	}
+
+	if configSources["MqttHost"] != "arquivo "+filePath || configSources["MqttPort"] != "variável de ambiente MQTT_PORT" ||
+		configSources["BaudRate"] != "opção -baud-rate" || configSources["LogLevel"] != defaultConfigSource {
+		t.Errorf("Wrong sources: %v", configSources)
+	}
+
+	ioutil.WriteFile(filePath, []byte("baudRate: 0\nacquisitionMode: push\nunknown: 1\n"), 0666)
+	if _, err := loadConfig([]string{"-config", filePath}); err == nil {
+		t.Error("Unknown parameter accepted")
+	}
+
+	ioutil.WriteFile(filePath, []byte("baudRate: 0\nacquisitionMode: push\n"), 0666)
+	_, err = loadConfig([]string{"-config", filePath})
+	if errs, ok := err.(ConfigError); !ok || len(errs) != 2 {
+		t.Errorf("Wrong validation: %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	filePath := path.Join(folder, "config.json")
+	ioutil.WriteFile(filePath, []byte(`{"mqttHost": "broker", "publishDecimation": 10}`), 0666)
+
+	if _, err := loadConfig([]string{"-config", filePath}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { configFile = defaultConfig() }()
+
+	setupBenches()
+	defer func() { benches = nil }()
+	mainBench().isAvailable = false
+
+	ioutil.WriteFile(filePath, []byte(`{"mqttHost": "other", "publishDecimation": 20}`), 0666)
+	if err := reloadConfig(); err == nil || getConfig().MqttHost != "broker" || getConfig().PublishDecimation != 10 {
+		t.Errorf("Unsafe change applied while running: %v", err)
+	}
+
+	ioutil.WriteFile(filePath, []byte(`{"mqttHost": "broker", "publishDecimation": 20}`), 0666)
+	if err := reloadConfig(); err != nil || getPublishDecimation() != 20 {
+		t.Errorf("Safe change not applied while running: %v", err)
+	}
+
+	benchName := getConfig().BenchName
+	ioutil.WriteFile(filePath, []byte(`{"mqttHost": "broker", "publishDecimation": 30, "benchName": "other"}`), 0666)
+	if err := reloadConfig(); err != nil || getPublishDecimation() != 30 {
+		t.Errorf("Change not applied with a parameter only applied on start: %v", err)
+	}
+	if getConfig().BenchName != benchName || configSources["BenchName"] != defaultConfigSource {
+		t.Errorf("Parameter only applied on start changed: %v, from %v", getConfig().BenchName, configSources["BenchName"])
+	}
+}
+
+func TestBenchesConfig(t *testing.T) {
+
+	config := defaultConfig()
+	config.SerialPort = "/dev/ttyACM0"
+	config.Benches = []BenchConfig{{Name: "b2", SerialPort: "/dev/ttyACM1"}, {Name: "b3", MqttChannelPrefix: "unbrake/b3"}}
+
+	if err := config.validate(); err != nil {
+		t.Fatalf("Valid benches refused: %v", err)
+	}
+
+	setConfig(config, nil, "")
+	defer func() { configFile = defaultConfig() }()
+
+	setupBenches()
+	defer func() { benches = nil }()
+
+	prefixes := []string{mqttChannelPrefixDefault, mqttChannelPrefixDefault + "/b2", "unbrake/b3"}
+	for i, bench := range benches {
+		if bench.getMqttChannelPrefix() != prefixes[i] {
+			t.Errorf("Wrong prefix of %v: %v != %v", bench.name, bench.getMqttChannelPrefix(), prefixes[i])
+		}
+	}
+
+	if bench, serialPort := commandLineBench("b2"); bench != benches[1] || serialPort != "/dev/ttyACM1" {
+		t.Errorf("Wrong bench from command line: %v %v", bench.name, serialPort)
+	}
+	if bench, serialPort := commandLineBench("/dev/ttyUSB0"); bench != mainBench() || serialPort != "/dev/ttyUSB0" {
+		t.Errorf("Wrong bench from command line: %v %v", bench.name, serialPort)
+	}
+
+	config.Benches = []BenchConfig{{Name: "b/2"}, {Name: defaultBenchName}, {Name: "b4", SerialPort: "/dev/ttyACM0"}, {Name: "b5", MqttChannelPrefix: mqttChannelPrefixDefault}}
+	if errs, ok := config.validate().(ConfigError); !ok || len(errs) != 4 {
+		t.Errorf("Wrong validation: %v", errs)
+	}
+}
+
+func TestMigrateFolder(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	legacy := path.Join(folder, "UnBrake")
+	for _, name := range []string{"config.json", "checkpoint.json", "logs/unbrake.log", "experiments/1/run.json"} {
+		os.MkdirAll(path.Dir(path.Join(legacy, name)), os.ModePerm)
+		ioutil.WriteFile(path.Join(legacy, name), []byte("{}"), 0666)
+	}
+
+	dirs := AppDirs{Config: path.Join(folder, "config"), State: path.Join(folder, "state"), Data: path.Join(folder, "data")}
+	moved, err := migrateFolder(legacy, dirs)
+	if err != nil || len(moved) != 4 {
+		t.Fatalf("Wrong migration: %v, %v", moved, err)
+	}
+
+	for _, filePath := range []string{"config/config.json", "state/checkpoint.json", "state/logs/unbrake.log", "data/experiments/1/run.json"} {
+		if _, err := os.Stat(path.Join(folder, filePath)); err != nil {
+			t.Errorf("File not migrated: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("Legacy folder not removed: %v", err)
+	}
+}
+
+func TestExperimentQueue(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	appDirs = singleAppDir(folder)
+	defer func() { appDirs = defaultAppDirs() }()
+
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+	bench.isMain = true
+	queue := &bench.queue
+
+	for _, id := range []int{1, 2, 3} {
+		if err := queue.Add(QueuedExperiment{ExperimentID: id, Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queue.Add(QueuedExperiment{ExperimentID: 2}) == nil {
+		t.Error("Experiment queued twice")
+	}
+
+	if err := bench.handleQueueCommand("move 3 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bench.handleQueueCommand("cancel 1"); err != nil {
+		t.Fatal(err)
+	}
+	if bench.handleQueueCommand("move 2 5") == nil || bench.handleQueueCommand("schedule 2 tonight") == nil {
+		t.Error("Invalid commands accepted")
+	}
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+	queue.Schedule(3, &later)
+	queue.SetCooldown(2, time.Minute*10)
+
+	if next := queue.popReady(now); next != nil {
+		t.Errorf("Scheduled experiment started early: %v", next.ExperimentID)
+	}
+	if next := queue.popReady(later); next == nil || next.ExperimentID != 3 {
+		t.Fatalf("Wrong experiment started: %v", next)
+	}
+
+	queue.lastFinished = later
+	if next := queue.popReady(later.Add(time.Minute)); next != nil {
+		t.Error("Experiment started before cooldown")
+	}
+
+	if err := queue.load(); err != nil || queue.Len() != 1 || queue.List()[0].Payload != nil {
+		t.Errorf("Wrong queue loaded: %v, %v", queue.List(), err)
+	}
+	if next := queue.popReady(later.Add(time.Minute * 10)); next == nil || next.ExperimentID != 2 || string(next.Payload) != "{}" {
+		t.Errorf("Wrong experiment started: %v", next)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	appDirs = singleAppDir(folder)
+	defer func() { appDirs = defaultAppDirs() }()
+
+	go func() {
+		for range mqttKeyStatusCh { // Published without MQTT key
+		}
+	}()
+
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+	bench.isMain = true
+
+	experiment, err := ExperimentFromJSON(bench, []byte(testExperimentPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	experiment.stopCh = make(chan bool)
+	experiment.continueRunning = true
+	experiment.snub.completed = 3
+	experiment.distance = 1.5
+	experiment.duration = time.Now().Add(-time.Minute)
+
+	experiment.saveCheckpoint()
+
+	checkpoint := bench.loadCheckpoint()
+	if checkpoint == nil || checkpoint.ExperimentID != 1 || checkpoint.CompletedSnubs != 3 || checkpoint.Distance != 1.5 {
+		t.Fatalf("Wrong checkpoint loaded: %+v", checkpoint)
+	}
+
+	resumed, err := checkpoint.experiment(bench)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.snub.completed != 3 || resumed.currentPhase != 1 || resumed.distance != 1.5 || resumed.elapsed < time.Minute {
+		t.Errorf("Wrong experiment resumed: snub %v, phase %v, distance %v, elapsed %v",
+			resumed.snub.completed, resumed.currentPhase, resumed.distance, resumed.elapsed)
+	}
+
+	if bench.resumeExperiment() || bench.loadCheckpoint() == nil {
+		t.Error("Experiment resumed without serial port or checkpoint lost")
+	}
+
+	experiment.stop()
+	experiment.saveCheckpoint()
+	if bench.loadCheckpoint() != nil {
+		t.Error("Checkpoint kept after experiment stopped")
+	}
+
+	experiment.continueRunning = true
+	experiment.stopCh = make(chan bool)
+	experiment.saveCheckpoint()
+	bench.removeCheckpoint()
+	if bench.loadCheckpoint() != nil {
+		t.Error("Checkpoint not discarded")
+	}
+}
+
+// Experiment with the fields checked, in two phases
+const testExperimentPayload = `{"pk": 1, "fields": {
+	"calibration": {
+		"relations": {"transversal_selection_width": 175, "heigth_width_relation": 70, "rim_diameter": 13, "sheave_move_diameter": 2, "sheave_motor_diameter": 1},
+		"temperature": [{"conversion_factor": 0.2}, {"conversion_factor": 0.2}],
+		"force": [{"conversion_factor": 1}, {"conversion_factor": 1}]
+	},
+	"procedure": [
+		{"name": "burnish", "number": 3, "upper_limit": 80, "inferior_limit": 30, "time_between_cycles": 10, "temperature": 300, "enable_output": true, "time": 5},
+		{"name": "fade", "number": 50, "upper_limit": 100, "inferior_limit": 10, "temperature": 60, "time": 5, "heating_temperature": 80}
+	]}}`
+
+func TestSimulateExperiment(t *testing.T) {
+
+	report := simulateExperiment([]byte(testExperimentPayload))
+	if !report.Valid || len(report.Phases) != 2 {
+		t.Fatalf("Wrong simulation: %+v", report)
+	}
+
+	if report.Phases[0].Snubs != 3 || report.Phases[1].Snubs >= 50 || report.Phases[1].PeakTemperature < 80 {
+		t.Errorf("Heating phase not ended by temperature: %+v", report.Phases)
+	}
+
+	if report.Duration <= report.Phases[0].Duration || report.Distance <= 0 || report.PeakTemperature < 80 {
+		t.Errorf("Wrong totals: %+v", report)
+	}
+
+	if len(report.Violations) != 1 { // Fade phase goes above its limit without water
+		t.Errorf("Wrong violations: %v", report.Violations)
+	}
+
+	invalid := strings.Replace(testExperimentPayload, `"upper_limit": 80`, `"upper_limit": 8000`, 1)
+	if report := simulateExperiment([]byte(invalid)); report.Valid || len(report.Violations) != 1 {
+		t.Errorf("Invalid experiment simulated: %+v", report)
+	}
+}
+
+func TestExperimentValidation(t *testing.T) {
+
+	if _, err := ExperimentFromJSON(nil, []byte(testExperimentPayload)); err != nil {
+		t.Fatalf("Valid experiment refused: %v", err)
+	}
+
+	invalids := []struct {
+		old, new string
+		errors   []string
+	}{
+		{`"pk": 1`, `"pk": "1"`, []string{"pk: must be integer, not string"}},
+		{`"pk": 1`, `"pk": 1, "extra": true`, []string{"extra: unknown field"}},
+		{`, {"conversion_factor": 1}]`, `]`, []string{"fields.calibration.force: must have 2 calibrations, one by sensor, not 1"}},
+		{`"rim_diameter": 13`, `"rim_diameter": 0`, []string{"fields.calibration.relations.rim_diameter: must be positive, not 0"}},
+		{`"sheave_motor_diameter": 1`, `"sheave_motor_diameter": 0`, []string{"fields.calibration.relations.sheave_motor_diameter: must be positive, not 0"}},
+		{`"number": 3, "upper_limit": 80, "inferior_limit": 30`, `"number": 0, "upper_limit": 80, "inferior_limit": 90`, []string{
+			"fields.procedure[0].number: must be positive, not 0",
+			"fields.procedure[0].upper_limit: must be greater than inferior_limit (90 km/h), not 80 km/h",
+		}},
+		{`"inferior_limit": 10`, `"inferior_limit": 0`, []string{"fields.procedure[1].inferior_limit: must be positive, not 0 km/h, braking would never end"}},
+		{`"temperature": 60`, `"temperature": 1200, "brake_mode": "pressure", "target_pressure": 20`, []string{
+			"fields.procedure[1].temperature: must be greater than 0 and up to 1000 °C, not 1200 °C",
+			"fields.procedure[1].target_pressure: must be greater than 0 and up to the max pressure of calibration (0 bar), not 20 bar",
+		}},
+	}
+
+	for _, invalid := range invalids {
+		payload := strings.Replace(testExperimentPayload, invalid.old, invalid.new, 1)
+
+		experiment, err := ExperimentFromJSON(nil, []byte(payload))
+		errs, _ := err.(ExperimentError)
+		if experiment != nil || strings.Join(errs, "\n") != strings.Join(invalid.errors, "\n") {
+			t.Errorf("Wrong errors of %v: %v", invalid.new, err)
+		}
+	}
+
+	if _, err := ExperimentFromJSON(nil, []byte(`{"pk": 1,`)); err == nil {
+		t.Error("Invalid JSON accepted")
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(experimentSchema), &schema); err != nil {
+		t.Fatalf("Invalid schema: %v", err)
+	}
+
+	// Schema must refuse what decoding refuses
+	payloads := map[string]bool{testExperimentPayload: true}
+	for _, invalid := range invalids {
+		payloads[strings.Replace(testExperimentPayload, invalid.old, invalid.new, 1)] = false
+	}
+	configuration := `"configuration": {"number": 3, "upper_limit": 80, "inferior_limit": 30, "temperature": 300, "time": 5}`
+	withConfiguration := regexp.MustCompile(`(?s)"procedure": \[.*\]`).ReplaceAllString(testExperimentPayload, configuration)
+	payloads[withConfiguration] = true
+	payloads[strings.Replace(withConfiguration, `, "inferior_limit": 30`, "", 1)] = false
+	payloads[strings.Replace(withConfiguration, configuration, `"configuration": {}`, 1)] = false
+	payloads[strings.Replace(testExperimentPayload, `"inferior_limit": 10, `, "", 1)] = false
+
+	for payload, isValid := range payloads {
+		_, err := ExperimentFromJSON(nil, []byte(payload))
+		if (err == nil) != isValid {
+			t.Errorf("Decoding of %v: %v, expected valid %v", payload, err, isValid)
+		}
+
+		var value interface{}
+		json.Unmarshal([]byte(payload), &value)
+		if matches := matchesSchema(schema, schema, value); matches != isValid {
+			t.Errorf("Schema matches %v: %v, expected %v", payload, matches, isValid)
+		}
+	}
+}
+
+// Checks value against the keywords of JSON Schema used by experimentSchema
+func matchesSchema(root, schema map[string]interface{}, value interface{}) bool {
+	if ref, exists := schema["$ref"].(string); exists {
+		definition := root["definitions"].(map[string]interface{})[strings.TrimPrefix(ref, "#/definitions/")]
+		return matchesSchema(root, definition.(map[string]interface{}), value)
+	}
+
+	subschemas := func(key string) []map[string]interface{} {
+		list, _ := schema[key].([]interface{})
+		subschemas := make([]map[string]interface{}, len(list))
+		for i, subschema := range list {
+			subschemas[i] = subschema.(map[string]interface{})
+		}
+		return subschemas
+	}
+
+	matched := 0
+	for _, subschema := range subschemas("oneOf") {
+		if matchesSchema(root, subschema, value) {
+			matched++
+		}
+	}
+	if _, exists := schema["oneOf"]; exists && matched != 1 {
+		return false
+	}
+
+	if anyOf := subschemas("anyOf"); len(anyOf) > 0 {
+		matchesAny := false
+		for _, subschema := range anyOf {
+			matchesAny = matchesAny || matchesSchema(root, subschema, value)
+		}
+		if !matchesAny {
+			return false
+		}
+	}
+
+	if expected, exists := schema["const"]; exists && expected != value {
+		return false
+	}
+	if enum, exists := schema["enum"].([]interface{}); exists {
+		isListed := false
+		for _, expected := range enum {
+			isListed = isListed || expected == value
+		}
+		if !isListed {
+			return false
+		}
+	}
+
+	number, isNumber := value.(float64)
+	switch schema["type"] {
+	case "object":
+		if _, isObject := value.(map[string]interface{}); !isObject {
+			return false
+		}
+	case "array":
+		if _, isArray := value.([]interface{}); !isArray {
+			return false
+		}
+	case "string":
+		if _, isString := value.(string); !isString {
+			return false
+		}
+	case "boolean":
+		if _, isBoolean := value.(bool); !isBoolean {
+			return false
+		}
+	case "integer":
+		if !isNumber || number != math.Trunc(number) {
+			return false
+		}
+	case "number":
+		if !isNumber {
+			return false
+		}
+	}
+
+	if isNumber {
+		if minimum, exists := schema["minimum"].(float64); exists && number < minimum {
+			return false
+		}
+		if minimum, exists := schema["exclusiveMinimum"].(float64); exists && number <= minimum {
+			return false
+		}
+		if maximum, exists := schema["maximum"].(float64); exists && number > maximum {
+			return false
+		}
+	}
+
+	if items, isArray := value.([]interface{}); isArray {
+		if minItems, exists := schema["minItems"].(float64); exists && float64(len(items)) < minItems {
+			return false
+		}
+		if maxItems, exists := schema["maxItems"].(float64); exists && float64(len(items)) > maxItems {
+			return false
+		}
+		if itemSchema, exists := schema["items"].(map[string]interface{}); exists {
+			for _, item := range items {
+				if !matchesSchema(root, itemSchema, item) {
+					return false
+				}
+			}
+		}
+	}
+
+	if object, isObject := value.(map[string]interface{}); isObject {
+		for _, key := range schemaStrings(schema["required"]) {
+			if _, exists := object[key]; !exists {
+				return false
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, property := range object {
+			propertySchema, exists := properties[key]
+			if !exists {
+				if schema["additionalProperties"] == false {
+					return false
+				}
+				continue
+			}
+			if !matchesSchema(root, propertySchema.(map[string]interface{}), property) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func schemaStrings(list interface{}) []string {
+	values, _ := list.([]interface{})
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = value.(string)
+	}
+	return keys
+}
+
+func TestExperimentDefinition(t *testing.T) {
+
+	decoded, errs := decodeExperiment([]byte(testExperimentPayload))
+	if decoded == nil || len(errs) > 0 {
+		t.Fatalf("Valid experiment refused: %v", errs)
+	}
+
+	converted, _ := json.Marshal(decoded.toDefinition())
+	legacy, _ := ExperimentFromJSON(nil, []byte(testExperimentPayload))
+	experiment, err := ExperimentFromJSON(nil, converted)
+	if err != nil {
+		t.Fatalf("Converted experiment refused: %v\n%s", err, converted)
+	}
+
+	if experiment.id != 1 || experiment.String() != legacy.String() || experiment.phases[1].name != "fade" ||
+		experiment.phases[0].upperSpeedLimit != 80 || experiment.tireRadius != legacy.tireRadius {
+		t.Errorf("Converted experiment differs from the legacy one: %v", experiment)
+	}
+
+	invalids := []struct {
+		old, new string
+		errors   []string
+	}{
+		{`"version":2`, `"version":3`, []string{"version: must be 2, or omitted on legacy experiments, not 3"}},
+		{`"id":1`, `"pk":1`, []string{"pk: unknown field"}},
+		{`"motor_diameter":1`, `"motor_diameter":0`, []string{"bench.sheaves.motor_diameter: must be positive, not 0"}},
+		{`"temperature":[{"factor":0.2}`, `"temperature":[{"offset":3}`, []string{"sensors.temperature[0].factor: must be set on a linear curve"}},
+		{`"upper_speed_kmh":80,"lower_speed_kmh":30`, `"upper_speed_kmh":80,"lower_speed_kmh":90`, []string{
+			"procedure[0].upper_speed_kmh: must be greater than lower_speed_kmh (90 km/h), not 80 km/h",
+		}},
+	}
+
+	for _, invalid := range invalids {
+		payload := strings.Replace(string(converted), invalid.old, invalid.new, 1)
+
+		experiment, err := ExperimentFromJSON(nil, []byte(payload))
+		errs, _ := err.(ExperimentError)
+		if experiment != nil || strings.Join(errs, "\n") != strings.Join(invalid.errors, "\n") {
+			t.Errorf("Wrong errors of %v: %v", invalid.new, err)
+		}
+	}
+
+	if id := experimentIDOf(converted); id != 1 {
+		t.Errorf("Wrong id of experiment: %v", id)
+	}
+}
+
+func TestConfigSnapshot(t *testing.T) {
+
+	config := defaultConfig()
+	config.MqttKey = "secret"
+
+	snapshot := configSnapshot(config)
+	if snapshot["mqttKey"] != "********" || snapshot["benchName"] != defaultBenchName || snapshot["baudRate"] != defaultBaudRate {
+		t.Errorf("Wrong snapshot of configuration: %v", snapshot)
+	}
+
+	encoded, _ := json.Marshal(Event{Type: configEvent, Data: snapshot})
+	if strings.Contains(string(encoded), "secret") {
+		t.Errorf("Secret recorded on journal: %s", encoded)
+	}
+}
+
+func TestTranslations(t *testing.T) {
+
+	verbs := regexp.MustCompile(`%[%v]`)
+	for message, translated := range translations[englishLanguage] {
+		if strings.Join(verbs.FindAllString(message, -1), "") != strings.Join(verbs.FindAllString(translated, -1), "") {
+			t.Errorf("Translation of %q doesn't have the same verbs: %q", message, translated)
+		}
+	}
+
+	defer func(original string) { language = original }(language)
+
+	language = englishLanguage
+	if message := tr("Fila: %v ensaio(s)", 2); message != "Queue: 2 experiment(s)" {
+		t.Errorf("Wrong translation: %v", message)
+	}
+	if message := tr("Mensagem sem tradução"); message != "Mensagem sem tradução" {
+		t.Errorf("Message without translation changed: %v", message)
+	}
+	if formatted := formatNumber(1.5, 2); formatted != "1.50" {
+		t.Errorf("Wrong number on english: %v", formatted)
+	}
+
+	language = portugueseLanguage
+	if formatted := formatNumber(1.5, 2); formatted != "1,50" {
+		t.Errorf("Wrong number on portuguese: %v", formatted)
+	}
+
+	if _, err := loadConfig([]string{"-interface-language", "en", "-baud-rate", "0"}); err == nil {
+		t.Fatal("Invalid configuration accepted")
+	}
+	if message := tr("Configuração inválida:"); message != "Invalid configuration:" {
+		t.Errorf("Invalid configuration not shown on its language: %v", message)
+	}
+
+	language = portugueseLanguage
+	if _, err := loadConfig([]string{"-interface-language", "xx", "-baud-rate", "0"}); err == nil || language != portugueseLanguage {
+		t.Errorf("Invalid language set: %v", language)
+	}
+}
+
+func TestDisplayUnits(t *testing.T) {
+
+	units := []struct {
+		unit     DisplayUnit
+		value    float64
+		expected float64
+	}{
+		{temperatureUnits[fahrenheitTemperatureUnit], 100, 212},
+		{forceUnits[kgfForceUnit], standardGravity, 1},
+		{speedUnits[msSpeedUnit], 36, 10},
+		{speedUnits[kmhSpeedUnit], 80, 80},
+	}
+
+	for _, unit := range units {
+		if value := unit.unit.convert(unit.value); math.Abs(value-unit.expected) > 1e-9 {
+			t.Errorf("Wrong conversion to %v: %v, expected %v", unit.unit.symbol, value, unit.expected)
+		}
+	}
+
+	config := defaultConfig()
+	config.SpeedUnit = rpmSpeedUnit
+	setConfig(config, nil, "")
+	defer func() { configFile = defaultConfig() }()
+
+	if unit := speedUnit(0); unit.symbol != "km/h" {
+		t.Errorf("Speed on rpm without radius of tire: %v", unit.symbol)
+	}
+
+	speed := 2 * math.Pi * 0.5 * 3.6 // km/h of one rotation by second
+	if value := speedUnit(0.5).convert(speed); math.Abs(value-60) > 1e-9 {
+		t.Errorf("Wrong speed on rpm: %v", value)
+	}
+}
+
+func TestMaintenanceSafety(t *testing.T) {
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+	maintenance := &bench.maintenance
+
+	maintenance.isActive = true
+	maintenance.lastActivity = time.Now()
+
+	if err := maintenance.SetDutyCycle(30); err == nil {
+		t.Error("Motor turned on without a calibration to watch temperatures")
+	}
+	if err := maintenance.SetBrake(true); err == nil {
+		t.Error("Brake on without a calibration to watch temperatures")
+	}
+
+	bench.setActiveCalibration(&Calibration{}) // Temperatures are not converted
+	if err := maintenance.SetDutyCycle(30); err != nil {
+		t.Errorf("Motor not turned on with a calibration: %v", err)
+	}
+
+	reading := make([]float64, numSerialAttrs)
+	reading[temperature2Idx] = maintenanceMaxTemperature + 1
+	bench.samples.Push(&Sample{Time: time.Now(), Filtered: reading})
+
+	if !maintenance.check(time.Now()) {
+		t.Fatal("Maintenance mode finished before the inactivity timeout")
+	}
+	if maintenance.dutyCycle != 0 || maintenance.isBraking || !maintenance.isWaterOn || !maintenance.isOverheated {
+		t.Errorf("Not cooling down above the temperature limit: %v", maintenance.status())
+	}
+	if err := maintenance.SetDutyCycle(30); err == nil {
+		t.Error("Motor turned on above the temperature limit")
+	}
+	if err := maintenance.SetWater(false); err == nil {
+		t.Error("Water turned off above the temperature limit")
+	}
+
+	reading = make([]float64, numSerialAttrs)
+	bench.samples.Push(&Sample{Time: time.Now(), Filtered: reading})
+	maintenance.check(time.Now())
+	if maintenance.isOverheated {
+		t.Error("Motor and brake still locked under the temperature limit")
+	}
+	if err := maintenance.SetBrake(true); err != nil {
+		t.Errorf("Brake not turned on under the temperature limit: %v", err)
+	}
+
+	if maintenance.check(time.Now().Add(maintenanceInactivityTimeout + time.Second)) {
+		t.Error("Maintenance mode not finished by inactivity")
+	}
+	if maintenance.IsActive() || maintenance.isBraking || !bench.isAvailable {
+		t.Errorf("Bench not back to cooldown after inactivity: %v", maintenance.status())
+	}
+}
+
+func TestExperimentLogs(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	appDirs = singleAppDir(folder)
+	defer func() { appDirs = defaultAppDirs() }()
+
+	hook := &experimentLogHook{files: map[int]*os.File{}}
+	testLogger := logrus.New()
+	testLogger.SetOutput(ioutil.Discard)
+	testLogger.AddHook(hook)
+
+	for _, id := range []int{1, 2} {
+		if err := hook.open(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testLogger.WithField(experimentField, 1).Info("first of 1")
+	testLogger.WithField(experimentField, 2).Info("first of 2")
+	testLogger.WithField(experimentField, 1).Info("second of 1")
+	testLogger.WithField(experimentField, 3).Info("not open")
+
+	hook.close(1)
+	testLogger.WithField(experimentField, 1).Info("after close")
+	testLogger.WithField(experimentField, 2).Info("second of 2")
+	hook.close(2)
+
+	if len(hook.files) != 0 {
+		t.Errorf("Log files still open: %v", len(hook.files))
+	}
+
+	expected := map[int][]string{
+		1: {"first of 1", "second of 1"},
+		2: {"first of 2", "second of 2"},
+		3: nil,
+	}
+	for id, messages := range expected {
+		data, _ := ioutil.ReadFile(path.Join(getExperimentFolder(id), experimentLogFileName))
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(messages) == 0 && len(data) == 0 {
+			continue
+		}
+		if len(lines) != len(messages) {
+			t.Errorf("Wrong lines on log of experiment %v: %q", id, lines)
+			continue
+		}
+		for i, message := range messages {
+			if !strings.Contains(lines[i], message) {
+				t.Errorf("Line %v of experiment %v: %q, expected %q", i, id, lines[i], message)
+			}
+		}
+	}
+}
+
+func TestReportGeneration(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	appDirs = singleAppDir(folder)
+	defer func() { appDirs = defaultAppDirs() }()
+
+	const id = 7
+	experimentFolder := getExperimentFolder(id)
+	os.MkdirAll(experimentFolder, os.ModePerm)
+
+	if _, err := generateReport(id); err == nil {
+		t.Error("Report generated without experiment recorded")
+	}
+
+	ioutil.WriteFile(path.Join(experimentFolder, experimentFileName), []byte(testExperimentPayload), 0666)
+
+	start := time.Date(2019, 6, 1, 10, 0, 0, 0, time.Local)
+	info, _ := json.Marshal(RunInfo{Bench: defaultBenchName, AgentVersion: "1.2.3", FirmwareBanner: "Braketestbench", Status: finishedStatus, StartedAt: start, FinishedAt: start.Add(time.Hour)})
+	ioutil.WriteFile(path.Join(experimentFolder, runInfoFileName), info, 0666)
+
+	for snub := 1; snub <= 2; snub++ {
+		metrics, _ := json.Marshal(SnubMetrics{Snub: snub, Phase: "burnish", InitialSpeed: 80, FinalSpeed: 30, MeanTorque: 100, Friction: 0.4, PeakTemperature: 50 + float64(snub)})
+		appendLine(path.Join(experimentFolder, snubMetricsFileName), metrics)
+	}
+
+	for i := 0; i < 10; i++ {
+		fields := []string{strconv.Itoa(int(start.Unix()) + i)}
+		for range recordedChannels {
+			fields = append(fields, strconv.Itoa(i*10))
+		}
+		fields = append(fields, byteToStateName[braking])
+		appendLine(path.Join(experimentFolder, samplesFileName), []byte(strings.Join(fields, ",")))
+	}
+
+	for _, event := range []Event{{Time: start, Type: experimentEvent, Description: "Ensaio iniciado"}, {Time: start, Type: stateEvent, Description: "only on journal"}} {
+		encoded, _ := json.Marshal(event)
+		appendLine(path.Join(experimentFolder, eventsFileName), encoded)
+	}
+
+	report, err := loadReport(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Info.FirmwareBanner != "Braketestbench" || len(report.Metrics) != 2 || len(report.Samples) != 10 || report.Analysis == nil {
+		t.Errorf("Wrong report loaded: %+v", report.Info)
+	}
+	if len(report.Events) != 1 {
+		t.Errorf("Events only for journal on report: %v", report.Events)
+	}
+
+	paths, err := generateReport(id)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("Report not generated: %v", err)
+	}
+
+	html, _ := ioutil.ReadFile(path.Join(experimentFolder, reportHTMLFileName))
+	for _, expected := range []string{"Relatório do ensaio 7", "Identificação do firmware", "Braketestbench", "1.2.3", "Ensaio iniciado", "<svg"} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("%q not on HTML report", expected)
+		}
+	}
+	if strings.Contains(string(html), "only on journal") {
+		t.Error("Event only for journal on HTML report")
+	}
+
+	pdf, _ := ioutil.ReadFile(path.Join(experimentFolder, reportPDFFileName))
+	if !strings.HasPrefix(string(pdf), "%PDF") {
+		t.Error("Invalid PDF report")
+	}
+}
+
+func TestCalibrationWizardResult(t *testing.T) {
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+
+	for _, channel := range []string{"speed", "pressure", "unknown"} {
+		if err := bench.wizard.Start(channel); err == nil {
+			t.Errorf("Calibration of %v started without calibration entry", channel)
+		}
+	}
+
+	wizard := &bench.wizard
+	wizard.zero = &calibrationPoint{Reference: 0, Noise: NoiseStatistics{Mean: 100}}
+	wizard.span = &calibrationPoint{Reference: 500, Noise: NoiseStatistics{Mean: 600}}
+
+	expected := map[string]string{"temperature1": "temperature_offset", "force2": "force_offset", "vibration": "vibration_offset"}
+	for channel, offsetKey := range expected {
+		wizard.channel = channel
+		result, err := wizard.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		factor, _ := result["conversion_factor"].(float64)
+		offset, _ := result[offsetKey].(float64)
+		if math.Abs(factor*toMilliVolts(600)+offset-500) > 1e-9 || math.Abs(factor*toMilliVolts(100)+offset) > 1e-9 {
+			t.Errorf("Wrong calibration of %v: factor %v, offset %v", channel, factor, offset)
+		}
+		if result["factor"] != result["conversion_factor"] || result["offset"] != result[offsetKey] {
+			t.Errorf("Keys of version 2 differ on %v: %v", channel, result)
+		}
+		if result["acquisition_chanel"] != calibrationChannels[channel].idx {
+			t.Errorf("Wrong channel of %v: %v", channel, result["acquisition_chanel"])
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	appDirs = singleAppDir(folder)
+	defer func() { appDirs = defaultAppDirs() }()
+
+	go func() {
+		for range mqttKeyStatusCh { // Published without MQTT key
+		}
+	}()
+
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+	journal := &bench.journal
+	const id = 3
+	eventsPath := path.Join(getExperimentFolder(id), eventsFileName)
+
+	journal.record(operatorEvent, nil, "Sem ensaio aberto")
+	journal.fault(nil, "Falha sem ensaio aberto")
+	if _, err := os.Stat(eventsPath); !os.IsNotExist(err) {
+		t.Errorf("Events recorded without experiment open: %v", err)
+	}
+
+	journal.open(id)
+	journal.fault(EventData{"channel": 1}, "Falha no canal %v", 1)
+	journal.fault(EventData{"channel": 1}, "Falha no canal %v", 1)
+	journal.fault(EventData{"channel": 2}, "Falha no canal %v", 2)
+	journal.record(waterEvent, EventData{"on": true}, "Água ligada")
+
+	journal.mux.Lock()
+	journal.lastFaults["Falha no canal 1"] = time.Now().Add(-journalFaultInterval - time.Second)
+	journal.mux.Unlock()
+	journal.fault(EventData{"channel": 1}, "Falha no canal %v", 1)
+
+	journal.close()
+	journal.record(operatorEvent, nil, "Após fechar")
+
+	events, err := readEvents(eventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	expected := []string{configEvent, faultEvent, faultEvent, waterEvent, faultEvent}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Errorf("Wrong events: %v, expected %v", types, expected)
+	}
+
+	stdout := os.Stdout
+	reader, writer, _ := os.Pipe()
+	os.Stdout = writer
+	runEventsCommandLine([]string{strconv.Itoa(id), waterEvent, configEvent})
+	writer.Close()
+	os.Stdout = stdout
+
+	output, _ := ioutil.ReadAll(reader)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], configEvent) || !strings.Contains(lines[1], "Água ligada") {
+		t.Errorf("Events not filtered by type: %q", lines)
+	}
+}
+
+func TestStopOnCooldown(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	appDirs = singleAppDir(folder)
+	defer func() { appDirs = defaultAppDirs() }()
+
+	go func() {
+		for range mqttKeyStatusCh { // Published without MQTT key
+		}
+	}()
+
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+	experiment, err := ExperimentFromJSON(bench, []byte(testExperimentPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bench.reserve() {
+		t.Fatal("Free bench not reserved")
+	}
+	experiment.stopCh = make(chan bool)
+	experiment.snub.stopCh = experiment.stopCh
+	experiment.continueRunning = true
+	experiment.snub.state = cooldown
+	experiment.snub.counterCh = make(chan int)
+
+	// As watchSpeed does at the end of a snub
+	experiment.watchers.Add(1)
+	go func() {
+		defer experiment.watchers.Done()
+		experiment.snub.NextState()
+	}()
+
+	experiment.snub.counterCh <- 5 // Received by the snub, nobody will read the next one
+	experiment.stop()
+
+	finished := make(chan bool)
+	go func() {
+		experiment.watchers.Wait()
+		experiment.finish()
+		close(finished)
+	}()
+
+	go func() {
+		<-bench.quitEnableCh
+		<-bench.statusCh
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Experiment stopped on cooldown never finished")
+	}
+
+	if !bench.isFree() {
+		t.Error("Bench not freed after experiment stopped on cooldown")
+	}
+}
+
+func TestBenchReservation(t *testing.T) {
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+
+	reserved := make(chan bool, 10)
+	for i := 0; i < cap(reserved); i++ {
+		go func() { reserved <- bench.reserve() }()
+	}
+
+	count := 0
+	for i := 0; i < cap(reserved); i++ {
+		if <-reserved {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Bench reserved %v times at once", count)
+	}
+
+	if bench.isFree() || bench.reserve() {
+		t.Error("Reserved bench is free")
+	}
+
+	bench.release()
+	if !bench.reserve() {
+		t.Error("Released bench not reserved")
+	}
+}
+
+func TestLogging(t *testing.T) {
+
+	folder, err := ioutil.TempDir("", "unbrake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	output, formatter, level := logger.Out, logger.Formatter, logger.GetLevel()
+	defer func() {
+		logger.SetOutput(output)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(level)
+		logRotation = nil
+		configFile = defaultConfig()
+	}()
+
+	logger.SetOutput(ioutil.Discard)
+	for name, expected := range map[string]logrus.Level{"debug": logrus.DebugLevel, " warning\n": logrus.WarnLevel, "error": logrus.ErrorLevel} {
+		if err := setLogLevel(name); err != nil || logger.GetLevel() != expected {
+			t.Errorf("Wrong level for %q: %v, %v", name, logger.GetLevel(), err)
+		}
+	}
+	if err := setLogLevel("verbose"); err == nil || logger.GetLevel() != logrus.ErrorLevel {
+		t.Errorf("Invalid level accepted: %v", logger.GetLevel())
+	}
+
+	var buffer strings.Builder
+	config := defaultConfig()
+
+	config.LogFormat = jsonLogFormat
+	setConfig(config, nil, "")
+	configureLogging()
+	if logger.GetLevel() != defaultLogLevel {
+		t.Errorf("Level of configuration not applied: %v", logger.GetLevel())
+	}
+
+	logger.SetOutput(&buffer)
+	logger.WithField(experimentField, 3).Info("json line")
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(buffer.String()), &line); err != nil || line["msg"] != "json line" || line[experimentField] != 3.0 {
+		t.Errorf("Wrong json line: %q, %v", buffer.String(), err)
+	}
+
+	config.LogFormat = logfmtLogFormat
+	setConfig(config, nil, "")
+	configureLogging()
+
+	buffer.Reset()
+	logger.SetOutput(&buffer)
+	logger.WithField(experimentField, 3).Info("logfmt line")
+	if !strings.Contains(buffer.String(), `msg="logfmt line"`) || !strings.Contains(buffer.String(), experimentField+"=3") {
+		t.Errorf("Wrong logfmt line: %q", buffer.String())
+	}
+
+	logRotation = newLogRotation(path.Join(folder, logFilePath))
+	if logRotation.MaxSize != defaultLogMaxSize || logRotation.MaxAge != defaultLogMaxAge || !logRotation.Compress {
+		t.Errorf("Wrong default rotation: %+v", logRotation)
+	}
+
+	config.LogMaxSize, config.LogMaxAge, config.LogMaxBackups = 5, 2, 3
+	setConfig(config, nil, "")
+	configureLogging()
+	if logRotation.MaxSize != 5 || logRotation.MaxAge != 2 || logRotation.MaxBackups != 3 || logRotation.Filename != path.Join(folder, logFilePath) {
+		t.Errorf("Rotation of configuration not applied: %+v", logRotation)
+	}
+	if logger.Out != logRotation {
+		t.Error("Not logging to the new rotation")
+	}
+	logRotation.Close()
+}
+
+func TestMetrics(t *testing.T) {
+	bench := newBench(BenchConfig{Name: defaultBenchName})
+	bench.isMain = true
+	bench.setFirmwareBanner("Braketestbench")
+
+	reading := make([]float64, numSerialAttrs)
+	for i := range reading {
+		reading[i] = float64(i) + 0.5
+	}
+	bench.samples.Push(&Sample{Time: time.Now(), Filtered: reading})
+
+	benches = []*Bench{bench}
+	defer func() { benches = nil }()
+
+	publishedMessagesMetric.WithLabelValues(bench.name).Inc()
+
+	var registry *prometheus.Registry
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("Registering metrics panicked: %v", r)
+			}
+		}()
+		registry = newMetricsRegistry()
+	}()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %v", err)
+	}
+
+	series := map[string][]map[string]string{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			series[family.GetName()] = append(series[family.GetName()], labels)
+		}
+	}
+
+	raw := series["unbrake_sensor_raw"]
+	if len(raw) != len(calibrationChannels) {
+		t.Fatalf("Expected %v raw series, got %v", len(calibrationChannels), len(raw))
+	}
+	for _, labels := range raw {
+		if len(labels) != 2 || labels["bench"] != bench.name {
+			t.Errorf("Wrong labels on raw series: %v", labels)
+		}
+		if _, exists := calibrationChannels[labels["channel"]]; !exists {
+			t.Errorf("Unknown channel on raw series: %v", labels["channel"])
+		}
+	}
+
+	if len(series["unbrake_sensor_value"]) != 0 {
+		t.Errorf("Converted values collected without calibration: %v", series["unbrake_sensor_value"])
+	}
+
+	info := series["unbrake_agent_info"]
+	expectedInfo := map[string]string{"bench": bench.name, "version": version, "firmware_banner": "Braketestbench"}
+	if len(info) != 1 || !reflect.DeepEqual(info[0], expectedInfo) {
+		t.Errorf("Expected agent info %v, got %v", expectedInfo, info)
+	}
+
+	published := series["unbrake_mqtt_published_messages_total"]
+	if len(published) != 1 || !reflect.DeepEqual(published[0], map[string]string{"bench": bench.name}) {
+		t.Errorf("Wrong published messages series: %v", published)
+	}
+
+	bench.setActiveCalibration(&Calibration{})
+	families, err = registry.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics with calibration: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "unbrake_sensor_value" {
+			continue
+		}
+		if len(family.GetMetric()) != len(calibrationChannels) {
+			t.Errorf("Expected %v converted series, got %v", len(calibrationChannels), len(family.GetMetric()))
+		}
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != 3 {
+				t.Errorf("Expected bench, channel and unit labels, got %v", metric.GetLabel())
+			}
+		}
+	}
+}
+
+// Address on localhost which nothing listens to
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("No free port: %v", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+func isServingMetrics(address string) bool {
+	response, err := http.Get("http://" + address + metricsPath)
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode == http.StatusOK
+}
+
+func TestRestartMetrics(t *testing.T) {
+	defer func() { configFile = defaultConfig() }()
+	defer func() {
+		metricsServerMux.Lock()
+		if metricsServer != nil {
+			metricsServer.Close()
+			metricsServer = nil
+		}
+		metricsServerMux.Unlock()
+	}()
+
+	waitServing := func(address string) {
+		for i := 0; i < 100 && !isServingMetrics(address); i++ {
+			time.Sleep(time.Millisecond * 20)
+		}
+		if !isServingMetrics(address) {
+			t.Fatalf("Metrics not served on %v", address)
+		}
+	}
+
+	config := defaultConfig()
+	config.MetricsAddress = freeAddress(t)
+	setConfig(config, nil, "")
+
+	go serveMetrics()
+	waitServing(config.MetricsAddress)
+	oldAddress := config.MetricsAddress
+
+	config.MetricsAddress = freeAddress(t)
+	setConfig(config, nil, "")
+
+	restartMetrics() // Registers the collectors again on a new registry
+	waitServing(config.MetricsAddress)
+
+	if isServingMetrics(oldAddress) {
+		t.Errorf("Metrics still served on old address %v", oldAddress)
+	}
+
+	metricsServerMux.Lock()
+	if metricsServer == nil || metricsServer.Addr != config.MetricsAddress {
+		t.Errorf("Server not bound to %v", config.MetricsAddress)
+	}
+	metricsServerMux.Unlock()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const mqttSubchannelDisplayUnits = "/displayUnits"
+
+// Units which values are shown on, set by configuration. Internally and on
+// what is published or recorded values are always on km/h, °C and N
+const (
+	kmhSpeedUnit              = "km/h"
+	rpmSpeedUnit              = "rpm" // Of the wheel, needs the radius of the tire
+	msSpeedUnit               = "m/s"
+	celsiusTemperatureUnit    = "C"
+	fahrenheitTemperatureUnit = "F"
+	newtonForceUnit           = "N"
+	kgfForceUnit              = "kgf"
+)
+
+const standardGravity = 9.80665 // m/s², N by kgf
+
+// DisplayUnit converts values to be shown on an unit
+type DisplayUnit struct {
+	symbol   string
+	decimals int
+	convert  func(value float64) float64 // From the unit used internally
+}
+
+var speedUnits = map[string]DisplayUnit{
+	kmhSpeedUnit: {"km/h", 1, func(speed float64) float64 { return speed }},
+	msSpeedUnit:  {"m/s", 2, func(speed float64) float64 { return speed / 3.6 }},
+}
+
+var temperatureUnits = map[string]DisplayUnit{
+	celsiusTemperatureUnit:    {"°C", 1, func(temperature float64) float64 { return temperature }},
+	fahrenheitTemperatureUnit: {"°F", 1, func(temperature float64) float64 { return temperature*9/5 + 32 }},
+}
+
+var forceUnits = map[string]DisplayUnit{
+	newtonForceUnit: {"N", 1, func(force float64) float64 { return force }},
+	kgfForceUnit:    {"kgf", 2, func(force float64) float64 { return force / standardGravity }},
+}
+
+// Unit of speeds, given the radius of the tire in m. Without the radius
+// rotation is unknown, so km/h is used instead of rpm
+func speedUnit(tireRadius float64) DisplayUnit {
+	unit := getConfig().SpeedUnit
+	if unit == rpmSpeedUnit {
+		if tireRadius <= 0 {
+			return speedUnits[kmhSpeedUnit]
+		}
+		return DisplayUnit{"rpm", 0, func(speed float64) float64 { return speed / 3.6 / (2 * math.Pi * tireRadius) * 60 }}
+	}
+	return speedUnits[unit]
+}
+
+func temperatureUnit() DisplayUnit {
+	return temperatureUnits[getConfig().TemperatureUnit]
+}
+
+func forceUnit() DisplayUnit {
+	return forceUnits[getConfig().ForceUnit]
+}
+
+// Formats a value on the unit, with its symbol
+func (unit DisplayUnit) format(value float64) string {
+	return formatNumber(unit.convert(value), unit.decimals) + " " + unit.symbol
+}
+
+// Formats a number with the decimal separator of the language configured
+func formatNumber(value float64, decimals int) string {
+	formatted := strconv.FormatFloat(value, 'f', decimals, 64)
+	if language == portugueseLanguage {
+		formatted = strings.Replace(formatted, ".", ",", 1)
+	}
+	return formatted
+}
+
+// Formats a speed in km/h, see speedUnit
+func formatSpeed(speed, tireRadius float64) string {
+	return speedUnit(tireRadius).format(speed)
+}
+
+// Formats a temperature in °C
+func formatTemperature(temperature float64) string {
+	return temperatureUnit().format(temperature)
+}
+
+// Formats a force in N
+func formatForce(force float64) string {
+	return forceUnit().format(force)
+}
+
+// Publishes the units and language configured, so the frontends show
+// values as the interface does
+func (bench *Bench) publishDisplayUnits() {
+	config := getConfig()
+	data, _ := json.Marshal(map[string]string{
+		"speed":       config.SpeedUnit,
+		"temperature": config.TemperatureUnit,
+		"force":       config.ForceUnit,
+		"language":    language,
+	})
+	bench.publishData(string(data), mqttSubchannelDisplayUnits)
+}
+
+func isValidSpeedUnit(unit string) bool {
+	_, exists := speedUnits[unit]
+	return exists || unit == rpmSpeedUnit
+}
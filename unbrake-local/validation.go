@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mqttSubchannelExperimentRejected = "/experimentRejected"
+	mqttSubchannelExperimentSchema   = "/experimentSchema"
+)
+
+// Limits of values which would only be given by mistake, as on wrong units
+const (
+	maxDiscTemperature = 1000.0 // °C
+	maxDeceleration    = 15.0   // m/s²
+)
+
+// ExperimentError lists every invalid field of an experiment, each one as
+// "<path of the field on JSON>: <problem>"
+type ExperimentError []string
+
+func (err ExperimentError) Error() string {
+	return strings.Join(err, "\n")
+}
+
+// Adds a problem of a field
+func (err *ExperimentError) add(field, format string, args ...interface{}) {
+	*err = append(*err, field+": "+fmt.Sprintf(format, args...))
+}
+
+// Decodes a legacy experiment refusing unknown fields, values of wrong types
+// and anything after it, instead of going on with zero values. It's nil when
+// it's not possible to decode, otherwise the invalid fields are returned with it
+func decodeExperiment(data []byte) (*experimentData, ExperimentError) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var decoded experimentData
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, decodingError(err)
+	}
+
+	if decoder.More() {
+		return nil, ExperimentError{"experiment: unexpected data after it"}
+	}
+
+	return &decoded, decoded.validate()
+}
+
+// Describes an error of JSON decoding as an invalid field
+func decodingError(err error) ExperimentError {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		return ExperimentError{fmt.Sprintf("experiment: invalid JSON at byte %v, %v", err.Offset, err)}
+	case *json.UnmarshalTypeError:
+		field := err.Field
+		if field == "" {
+			field = "experiment"
+		}
+		return ExperimentError{fmt.Sprintf("%v: must be %v, not %v", field, jsonTypeName(err.Type), err.Value)}
+	}
+
+	if message := err.Error(); strings.HasPrefix(message, "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(message, "json: unknown field "))
+		return ExperimentError{field + ": unknown field"}
+	}
+
+	return ExperimentError{"experiment: " + err.Error()}
+}
+
+// Name of the type on JSON, as used by the schema
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// Checks the fields which are used as they are received, the ones of
+// the procedure are checked by validateExperiment
+func (decoded *experimentData) validate() ExperimentError {
+	var errs ExperimentError
+
+	if decoded.Pk <= 0 {
+		errs.add("pk", "must be positive, not %v", decoded.Pk)
+	}
+
+	calibration := decoded.Fields.Calibration
+	relations := map[string]int{
+		"transversal_selection_width": calibration.Relations.TransversalSelectionWidth,
+		"heigth_width_relation":       calibration.Relations.HeigthWidthRelation,
+		"rim_diameter":                calibration.Relations.RimDiameter,
+		"sheave_move_diameter":        calibration.Relations.SheaveMoveDiameter,
+		"sheave_motor_diameter":       calibration.Relations.SheaveMotorDiameter,
+	}
+	for _, name := range []string{"transversal_selection_width", "heigth_width_relation", "rim_diameter", "sheave_move_diameter", "sheave_motor_diameter"} {
+		if relations[name] <= 0 {
+			errs.add("fields.calibration.relations."+name, "must be positive, not %v", relations[name])
+		}
+	}
+
+	if len(calibration.Temperature) != 2 {
+		errs.add("fields.calibration.temperature", "must have 2 calibrations, one by sensor, not %v", len(calibration.Temperature))
+	}
+	for i, temperature := range calibration.Temperature {
+		errs = append(errs, temperature.curveData.validate(fmt.Sprintf("fields.calibration.temperature[%v]", i))...)
+	}
+
+	if len(calibration.Force) != 2 {
+		errs.add("fields.calibration.force", "must have 2 calibrations, one by sensor, not %v", len(calibration.Force))
+	}
+	for i, force := range calibration.Force {
+		errs = append(errs, force.curveData.validate(fmt.Sprintf("fields.calibration.force[%v]", i))...)
+	}
+
+	errs = append(errs, calibration.Vibration.curveData.validate("fields.calibration.vibration")...)
+
+	nonNegatives := []struct {
+		field string
+		value float64
+	}{
+		{"fields.calibration.brake.lever_radius", calibration.Brake.LeverRadius},
+		{"fields.calibration.brake.effective_radius", calibration.Brake.EffectiveRadius},
+		{"fields.calibration.brake.piston_area", calibration.Brake.PistonArea},
+		{"fields.calibration.brake.inertia", calibration.Brake.Inertia},
+		{"fields.calibration.command.max_pression", calibration.Command.MaxPression},
+		{"fields.calibration.command.chanel_command_pression", float64(calibration.Command.ChanelCommandPression)},
+	}
+	for _, nonNegative := range nonNegatives {
+		if nonNegative.value < 0 {
+			errs.add(nonNegative.field, "must not be negative, not %v", nonNegative.value)
+		}
+	}
+	if channel := calibration.Command.ChanelCommandPression; channel > maxPressureCommandChannel {
+		errs.add("fields.calibration.command.chanel_command_pression", "must be at most %v, not %v", maxPressureCommandChannel, channel)
+	}
+
+	return errs
+}
+
+// Checks the curve of a sensor calibration at field
+func (data curveData) validate(field string) ExperimentError {
+	var errs ExperimentError
+
+	switch data.Curve {
+	case linearCurve, "":
+	case polynomialCurve:
+		if len(data.Coefficients) == 0 {
+			errs.add(field+".coefficients", "must not be empty on a polynomial curve")
+		}
+	case tableCurve:
+		if len(data.Table) < 2 {
+			errs.add(field+".table", "must have at least 2 points, not %v", len(data.Table))
+		}
+	default:
+		errs.add(field+".curve", "must be %v, %v or %v, not %q", linearCurve, polynomialCurve, tableCurve, data.Curve)
+	}
+
+	return errs
+}
+
+// Publishes why an experiment was refused, so whoever submitted it knows
+// what to fix. The id is taken from the payload when possible
+func (bench *Bench) rejectExperiment(payload []byte, err error) {
+	id := experimentIDOf(payload)
+
+	errs, ok := err.(ExperimentError)
+	if !ok {
+		errs = ExperimentError{err.Error()}
+	}
+
+	bench.logger().WithField(experimentField, id).WithError(err).Warn("Invalid experiment refused")
+
+	data, _ := json.Marshal(struct {
+		ExperimentID int      `json:"experimentId"`
+		Errors       []string `json:"errors"`
+	}{id, errs})
+
+	bench.publishData("false: "+strconv.Itoa(id), "/validExperiment")
+	bench.publishData(string(data), mqttSubchannelExperimentRejected)
+}
+
+// Publishes the schema of experiments accepted, for the frontends
+func (bench *Bench) publishExperimentSchema() {
+	bench.publishData(experimentSchema, mqttSubchannelExperimentSchema)
+}
+
+func runSchemaCommandLine(args []string) bool {
+	fmt.Println(experimentSchema)
+	return false
+}
+
+// JSON Schema of the experiments accepted, on version 2 or legacy, the same
+// checks made when decoding. Ranges which depend on other fields, as the max
+// speed of the bench, are only checked by the agent
+const experimentSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Ensaio do UnBrake",
+  "oneOf": [
+    {"$ref": "#/definitions/experiment"},
+    {"$ref": "#/definitions/legacyExperiment"}
+  ],
+  "definitions": {
+    "experiment": {
+      "title": "Ensaio na versão 2 do formato",
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["version", "id", "bench", "sensors", "procedure"],
+      "properties": {
+        "version": {"const": 2},
+        "id": {"type": "integer", "minimum": 1},
+        "operator": {"type": "string"},
+        "calibration": {"type": "string"},
+        "bench": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["tire", "sheaves"],
+          "properties": {
+            "tire": {
+              "type": "object",
+              "additionalProperties": false,
+              "required": ["width_mm", "aspect_ratio_percent", "rim_diameter_in"],
+              "properties": {
+                "width_mm": {"type": "integer", "minimum": 1},
+                "aspect_ratio_percent": {"type": "integer", "minimum": 1},
+                "rim_diameter_in": {"type": "integer", "minimum": 1}
+              }
+            },
+            "sheaves": {
+              "type": "object",
+              "additionalProperties": false,
+              "required": ["driven_diameter", "motor_diameter"],
+              "properties": {
+                "driven_diameter": {"type": "integer", "minimum": 1},
+                "motor_diameter": {"type": "integer", "minimum": 1}
+              }
+            },
+            "brake": {
+              "type": "object",
+              "additionalProperties": false,
+              "properties": {
+                "lever_radius_m": {"type": "number", "minimum": 0},
+                "effective_radius_m": {"type": "number", "minimum": 0},
+                "piston_area_cm2": {"type": "number", "minimum": 0},
+                "inertia_kgm2": {"type": "number", "minimum": 0},
+                "max_pressure_bar": {"type": "number", "minimum": 0},
+                "pressure_command_channel": {"type": "integer", "minimum": 0, "maximum": 9}
+              }
+            }
+          }
+        },
+        "sensors": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["temperature", "force"],
+          "properties": {
+            "temperature": {
+              "type": "array",
+              "minItems": 2,
+              "maxItems": 2,
+              "items": {"$ref": "#/definitions/sensor"},
+              "description": "°C"
+            },
+            "force": {
+              "type": "array",
+              "minItems": 2,
+              "maxItems": 2,
+              "items": {"$ref": "#/definitions/sensor"},
+              "description": "N"
+            },
+            "vibration": {"$ref": "#/definitions/sensor"}
+          }
+        },
+        "procedure": {
+          "type": "array",
+          "minItems": 1,
+          "items": {"$ref": "#/definitions/phase"}
+        }
+      }
+    },
+    "legacyExperiment": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["pk", "fields"],
+      "properties": {
+        "model": {"type": "string"},
+        "pk": {"type": "integer", "minimum": 1},
+        "fields": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["calibration"],
+          "anyOf": [
+            {
+              "required": ["procedure"]
+            },
+            {
+              "required": ["configuration"],
+              "properties": {
+                "configuration": {"required": ["number", "upper_limit", "inferior_limit", "temperature", "time"]}
+              }
+            }
+          ],
+          "properties": {
+            "create_by": {"type": "string"},
+            "calibration": {
+              "type": "object",
+              "additionalProperties": false,
+              "required": ["relations", "temperature", "force"],
+              "properties": {
+                "name": {"type": "string"},
+                "is_default": {"type": "boolean"},
+                "vibration": {
+                  "type": "object",
+                  "additionalProperties": false,
+                  "properties": {
+                    "acquisition_chanel": {"type": "integer"},
+                    "conversion_factor": {"type": "number"},
+                    "vibration_offset": {"type": "number"},
+                    "curve": {"$ref": "#/definitions/curve"},
+                    "coefficients": {"$ref": "#/definitions/coefficients"},
+                    "table": {"$ref": "#/definitions/table"}
+                  }
+                },
+                "speed": {
+                  "type": "object",
+                  "additionalProperties": false,
+                  "properties": {
+                    "acquisition_chanel": {"type": "integer"},
+                    "tire_radius": {"type": "number"}
+                  }
+                },
+                "relations": {
+                  "type": "object",
+                  "additionalProperties": false,
+                  "required": ["transversal_selection_width", "heigth_width_relation", "rim_diameter", "sheave_move_diameter", "sheave_motor_diameter"],
+                  "properties": {
+                    "transversal_selection_width": {"type": "integer", "minimum": 1, "description": "mm"},
+                    "heigth_width_relation": {"type": "integer", "minimum": 1, "description": "%"},
+                    "rim_diameter": {"type": "integer", "minimum": 1, "description": "polegadas"},
+                    "sync_motor_rodation": {"type": "integer"},
+                    "sheave_move_diameter": {"type": "integer", "minimum": 1},
+                    "sheave_motor_diameter": {"type": "integer", "minimum": 1}
+                  }
+                },
+                "brake": {
+                  "type": "object",
+                  "additionalProperties": false,
+                  "properties": {
+                    "lever_radius": {"type": "number", "minimum": 0, "description": "m"},
+                    "effective_radius": {"type": "number", "minimum": 0, "description": "m"},
+                    "piston_area": {"type": "number", "minimum": 0, "description": "cm²"},
+                    "inertia": {"type": "number", "minimum": 0, "description": "kg·m²"}
+                  }
+                },
+                "command": {
+                  "type": "object",
+                  "additionalProperties": false,
+                  "properties": {
+                    "command_chanel_speed": {"type": "integer"},
+                    "actual_speed": {"type": "number"},
+                    "max_speed": {"type": "number"},
+                    "chanel_command_pression": {"type": "integer", "minimum": 0, "maximum": 9},
+                    "actual_pression": {"type": "number"},
+                    "max_pression": {"type": "number", "minimum": 0, "description": "bar"}
+                  }
+                },
+                "temperature": {
+                  "type": "array",
+                  "minItems": 2,
+                  "maxItems": 2,
+                  "items": {
+                    "type": "object",
+                    "additionalProperties": false,
+                    "properties": {
+                      "acquisition_chanel": {"type": "integer"},
+                      "conversion_factor": {"type": "number"},
+                      "temperature_offset": {"type": "number"},
+                      "calibration": {"type": "integer"},
+                      "curve": {"$ref": "#/definitions/curve"},
+                      "coefficients": {"$ref": "#/definitions/coefficients"},
+                      "table": {"$ref": "#/definitions/table"}
+                    }
+                  }
+                },
+                "force": {
+                  "type": "array",
+                  "minItems": 2,
+                  "maxItems": 2,
+                  "items": {
+                    "type": "object",
+                    "additionalProperties": false,
+                    "properties": {
+                      "acquisition_chanel": {"type": "integer"},
+                      "conversion_factor": {"type": "number"},
+                      "force_offset": {"type": "number"},
+                      "calibration": {"type": "integer"},
+                      "curve": {"$ref": "#/definitions/curve"},
+                      "coefficients": {"$ref": "#/definitions/coefficients"},
+                      "table": {"$ref": "#/definitions/table"}
+                    }
+                  }
+                }
+              }
+            },
+            "configuration": {
+              "type": "object",
+              "additionalProperties": false,
+              "properties": {
+                "name": {"type": "string"},
+                "is_default": {"type": "boolean"},
+                "number": {"type": "integer", "minimum": 1},
+                "time_between_cycles": {"type": "integer", "minimum": 0, "description": "s"},
+                "upper_limit": {"type": "integer", "minimum": 1, "description": "km/h"},
+                "inferior_limit": {"type": "integer", "exclusiveMinimum": 0, "description": "km/h"},
+                "upper_time": {"type": "integer", "minimum": 0, "description": "s"},
+                "inferior_time": {"type": "integer", "minimum": 0, "description": "s"},
+                "disable_shutdown": {"type": "boolean"},
+                "enable_output": {"type": "boolean"},
+                "temperature": {"type": "number", "exclusiveMinimum": 0, "maximum": 1000, "description": "°C"},
+                "time": {"type": "number", "exclusiveMinimum": 0, "description": "s"}
+              }
+            },
+            "procedure": {
+              "type": "array",
+              "minItems": 1,
+              "items": {"$ref": "#/definitions/legacyPhase"}
+            }
+          }
+        }
+      },
+      "title": "Ensaio no formato legado, exportado dos modelos do backend"
+    },
+    "phase": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["snubs", "upper_speed_kmh", "lower_speed_kmh", "temperature_limit_c", "water_time_s"],
+      "properties": {
+        "name": {"type": "string"},
+        "snubs": {"type": "integer", "minimum": 1},
+        "upper_speed_kmh": {"type": "number", "exclusiveMinimum": 0},
+        "lower_speed_kmh": {"type": "number", "exclusiveMinimum": 0},
+        "brake_delay_s": {"type": "integer", "minimum": 0},
+        "release_delay_s": {"type": "integer", "minimum": 0},
+        "cooldown_time_s": {"type": "integer", "minimum": 0},
+        "cooldown_temperature_c": {"type": "number", "minimum": 0, "maximum": 1000},
+        "cooldown_max_time_s": {"type": "integer", "minimum": 0},
+        "heating_temperature_c": {"type": "number", "minimum": 0, "maximum": 1000},
+        "temperature_condition": {
+          "enum": ["", "any", "both"]
+        },
+        "temperature_limit_c": {"type": "number", "exclusiveMinimum": 0, "maximum": 1000},
+        "water": {"type": "boolean"},
+        "water_time_s": {"type": "number", "exclusiveMinimum": 0},
+        "brake_mode": {
+          "enum": ["", "on_off", "pressure", "deceleration"]
+        },
+        "target_pressure_bar": {"type": "number", "minimum": 0},
+        "target_deceleration_ms2": {"type": "number", "minimum": 0, "maximum": 15}
+      }
+    },
+    "legacyPhase": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["number", "upper_limit", "inferior_limit", "temperature", "time"],
+      "properties": {
+        "name": {"type": "string"},
+        "number": {"type": "integer", "minimum": 1},
+        "time_between_cycles": {"type": "integer", "minimum": 0, "description": "s"},
+        "upper_limit": {"type": "integer", "minimum": 1, "description": "km/h"},
+        "inferior_limit": {"type": "integer", "exclusiveMinimum": 0, "description": "km/h"},
+        "upper_time": {"type": "integer", "minimum": 0, "description": "s"},
+        "inferior_time": {"type": "integer", "minimum": 0, "description": "s"},
+        "enable_output": {"type": "boolean"},
+        "temperature": {"type": "number", "exclusiveMinimum": 0, "maximum": 1000, "description": "°C"},
+        "time": {"type": "number", "exclusiveMinimum": 0, "description": "s"},
+        "cooldown_temperature": {"type": "number", "minimum": 0, "maximum": 1000, "description": "°C"},
+        "cooldown_max_time": {"type": "integer", "minimum": 0, "description": "s"},
+        "heating_temperature": {"type": "number", "minimum": 0, "maximum": 1000, "description": "°C"},
+        "temperature_condition": {
+          "enum": ["", "any", "both"]
+        },
+        "brake_mode": {
+          "enum": ["", "on_off", "pressure", "deceleration"]
+        },
+        "target_pressure": {"type": "number", "minimum": 0, "description": "bar"},
+        "target_deceleration": {"type": "number", "minimum": 0, "maximum": 15, "description": "m/s²"}
+      }
+    },
+    "sensor": {
+      "type": "object",
+      "additionalProperties": false,
+      "anyOf": [
+        {"required": ["factor"]},
+        {"required": ["curve"], "properties": {"curve": {"enum": ["polynomial", "table"]}}}
+      ],
+      "properties": {
+        "factor": {"type": "number", "description": "required on linear curves"},
+        "offset": {"type": "number"},
+        "curve": {"$ref": "#/definitions/curve"},
+        "coefficients": {"$ref": "#/definitions/coefficients"},
+        "table": {"$ref": "#/definitions/table"}
+      }
+    },
+    "curve": {
+      "enum": ["", "linear", "polynomial", "table"]
+    },
+    "coefficients": {
+      "type": "array",
+      "items": {"type": "number"}
+    },
+    "table": {
+      "type": "array",
+      "items": {
+        "type": "array",
+        "items": {"type": "number"},
+        "minItems": 2,
+        "maxItems": 2
+      }
+    }
+  }
+}`
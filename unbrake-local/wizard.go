@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	emitter "github.com/icaropires/go/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Calibration wizard parameters
+const (
+	wizardSamplingTime      = time.Second * 5
+	wizardMinSamples        = 20
+	wizardMaxStdDev         = 5.0  // Raw units, above it sensor is considered noisy
+	wizardMinSpanMilliVolts = 50.0 // Below it sensor is considered not responding
+	calibrationsFolderName  = "calibrations"
+	wizardBufferSize        = 1024 // Frames, every one read is sampled
+)
+
+const (
+	mqttSubchannelCalibrationWizard       = "/calibrationWizard"
+	mqttSubchannelCalibrationWizardStatus = "/calibrationWizardStatus"
+)
+
+// Channel read from the bench, kind is the name used on the calibration
+// entries of an experiment. It's empty when experiments have no entry to
+// calibrate the channel, as speed comes from the tire and pressure from the
+// brake
+type calibrationChannel struct {
+	idx  int
+	kind string
+}
+
+var calibrationChannels = map[string]calibrationChannel{
+	"speed":        {frequencyIdx, ""},
+	"temperature1": {temperature1Idx, "temperature"},
+	"temperature2": {temperature2Idx, "temperature"},
+	"force1":       {brakingForce1Idx, "force"},
+	"force2":       {brakingForce2Idx, "force"},
+	"vibration":    {vibrationIdx, "vibration"},
+	"pressure":     {pressureIdx, ""},
+}
+
+// NoiseStatistics of raw values read while sampling a reference
+type NoiseStatistics struct {
+	Samples int     `json:"samples"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"std_dev"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+func noiseStatistics(values []float64) NoiseStatistics {
+	statistics := NoiseStatistics{Samples: len(values)}
+	if len(values) == 0 {
+		return statistics
+	}
+
+	statistics.Min, statistics.Max = values[0], values[0]
+	for _, value := range values {
+		statistics.Mean += value
+		statistics.Min = math.Min(statistics.Min, value)
+		statistics.Max = math.Max(statistics.Max, value)
+	}
+	statistics.Mean /= float64(len(values))
+
+	for _, value := range values {
+		statistics.StdDev += (value - statistics.Mean) * (value - statistics.Mean)
+	}
+	statistics.StdDev = math.Sqrt(statistics.StdDev / float64(len(values)))
+
+	return statistics
+}
+
+// Point of the calibration, the known reference applied by the operator
+// and what was read from the sensor meanwhile
+type calibrationPoint struct {
+	Reference float64         `json:"reference"`
+	Noise     NoiseStatistics `json:"noise"`
+}
+
+// CalibrationWizard guides a zero and span calibration of a channel
+type CalibrationWizard struct {
+	bench   *Bench
+	mux     sync.Mutex
+	channel string
+	zero    *calibrationPoint
+	span    *calibrationPoint
+}
+
+// Start calibration of a channel, discarding any previous one not finished
+func (wizard *CalibrationWizard) Start(channel string) error {
+	wizard.mux.Lock()
+	defer wizard.mux.Unlock()
+
+	if calibrationChannels[channel].kind == "" {
+		return fmt.Errorf("invalid channel: %v, experiments have no calibration entry for it", channel)
+	}
+
+	if !wizard.bench.port.IsOpen() {
+		return errors.New("serial port not selected")
+	}
+
+	wizard.channel = channel
+	wizard.zero, wizard.span = nil, nil
+
+	wizard.bench.logger().WithField("channel", channel).Info("Calibration started")
+
+	return nil
+}
+
+// Zero samples the channel while operator applies the lower reference
+func (wizard *CalibrationWizard) Zero(reference float64) error {
+	point, err := wizard.sample(reference)
+	if err == nil {
+		wizard.mux.Lock()
+		wizard.zero = point
+		wizard.mux.Unlock()
+	}
+	return err
+}
+
+// Span samples the channel while operator applies the upper reference
+func (wizard *CalibrationWizard) Span(reference float64) error {
+	point, err := wizard.sample(reference)
+	if err == nil {
+		wizard.mux.Lock()
+		wizard.span = point
+		wizard.mux.Unlock()
+	}
+	return err
+}
+
+func (wizard *CalibrationWizard) sample(reference float64) (*calibrationPoint, error) {
+	wizard.mux.Lock()
+	defer wizard.mux.Unlock()
+
+	if wizard.channel == "" {
+		return nil, errors.New("calibration not started")
+	}
+
+	idx := calibrationChannels[wizard.channel].idx
+	wizard.bench.logger().WithFields(logrus.Fields{"channel": wizard.channel, "reference": reference, "duration": wizardSamplingTime}).Info("Sampling calibration point")
+
+	subscription := wizard.bench.sampleBus.Subscribe("calibration", dropNewestPolicy, wizardBufferSize, func() int { return 1 })
+
+	var values []float64
+	timeout := time.After(wizardSamplingTime)
+	for sampling := true; sampling; {
+		select {
+		case sample := <-subscription.C:
+			values = append(values, sample.Raw[idx])
+		case <-timeout:
+			sampling = false
+		}
+	}
+
+	wizard.bench.sampleBus.Unsubscribe(subscription)
+
+	if len(values) < wizardMinSamples {
+		return nil, fmt.Errorf("only %v samples read, is data being collected?", len(values))
+	}
+
+	return &calibrationPoint{Reference: reference, Noise: noiseStatistics(values)}, nil
+}
+
+// Computes conversion factor and offset, in the same way LinearCurve uses them
+func twoPointCalibration(zero, span calibrationPoint) (float64, float64, error) {
+	zeroMilliVolts := toMilliVolts(zero.Noise.Mean)
+	spanMilliVolts := toMilliVolts(span.Noise.Mean)
+
+	if math.Abs(spanMilliVolts-zeroMilliVolts) < wizardMinSpanMilliVolts {
+		return 0, 0, fmt.Errorf("sensor not responding, difference between points is %.1f mV", spanMilliVolts-zeroMilliVolts)
+	}
+
+	factor := (span.Reference - zero.Reference) / (spanMilliVolts - zeroMilliVolts)
+	offset := zero.Reference - factor*zeroMilliVolts
+
+	return factor, offset, nil
+}
+
+// Result of calibration, with the keys of the calibration entries of both
+// formats of experiment: the legacy one and the sensors of version 2
+func (wizard *CalibrationWizard) Result() (map[string]interface{}, error) {
+	wizard.mux.Lock()
+	defer wizard.mux.Unlock()
+
+	if wizard.zero == nil || wizard.span == nil {
+		return nil, errors.New("zero and span must be sampled first")
+	}
+
+	factor, offset, err := twoPointCalibration(*wizard.zero, *wizard.span)
+	if err != nil {
+		return nil, err
+	}
+
+	channel := calibrationChannels[wizard.channel]
+
+	var warnings []string
+	for name, point := range map[string]*calibrationPoint{"zero": wizard.zero, "span": wizard.span} {
+		if point.Noise.StdDev > wizardMaxStdDev {
+			warnings = append(warnings, fmt.Sprintf("noisy sensor on %v: std dev %.2f", name, point.Noise.StdDev))
+		}
+	}
+
+	result := map[string]interface{}{
+		"acquisition_chanel":     channel.idx,
+		"conversion_factor":      factor,
+		channel.kind + "_offset": offset,
+		"factor":                 factor,
+		"offset":                 offset,
+		"zero":                   wizard.zero,
+		"span":                   wizard.span,
+		"warnings":               warnings,
+		"channel":                wizard.channel,
+		"date":                   time.Now(),
+	}
+
+	return result, nil
+}
+
+// Saves result of calibration, returns where it was saved
+func saveCalibrationResult(result map[string]interface{}) (string, error) {
+	folder := path.Join(appDirs.Data, calibrationsFolderName)
+	os.MkdirAll(folder, os.ModePerm)
+
+	name := fmt.Sprintf("%v-%v.json", result["channel"], time.Now().Format("20060102-150405"))
+	resultPath := path.Join(folder, name)
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return resultPath, ioutil.WriteFile(resultPath, data, 0666)
+}
+
+// Handles a command of calibration wizard of the bench, as received from MQTT
+// or command line, returning the answer
+func (bench *Bench) handleCalibrationCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	wizard := &bench.wizard
+
+	parseReference := func() (float64, error) {
+		if len(args) != 2 {
+			return 0, fmt.Errorf("usage: %v <reference>", args[0])
+		}
+		return strconv.ParseFloat(args[1], 64)
+	}
+
+	switch {
+	case args[0] == "start" && len(args) == 2:
+		if err := wizard.Start(args[1]); err != nil {
+			return "", err
+		}
+		return "started " + args[1], nil
+
+	case args[0] == "zero" || args[0] == "span":
+		reference, err := parseReference()
+		if err != nil {
+			return "", err
+		}
+
+		if args[0] == "zero" {
+			err = wizard.Zero(reference)
+		} else {
+			err = wizard.Span(reference)
+		}
+		if err != nil {
+			return "", err
+		}
+		return args[0] + " sampled", nil
+
+	case args[0] == "finish":
+		result, err := wizard.Result()
+		if err != nil {
+			return "", err
+		}
+
+		resultPath, err := saveCalibrationResult(result)
+		if err != nil {
+			bench.logger().WithError(err).Error("Wasn't possible to save calibration")
+		} else {
+			bench.logger().WithField("file", resultPath).Info("Calibration saved")
+		}
+
+		data, _ := json.Marshal(result)
+		return string(data), nil
+
+	default:
+		return "", fmt.Errorf("invalid command: %v", command)
+	}
+}
+
+// Receives calibration wizard commands of the bench from MQTT
+func (bench *Bench) handleCalibrationReceiving() {
+	bench.subscribeMqtt(mqttSubchannelCalibrationWizard, func(_ *emitter.Client, msg emitter.Message) {
+		go func() {
+			answer, err := bench.handleCalibrationCommand(string(msg.Payload()))
+			if err != nil {
+				bench.logger().WithError(err).Warn("Calibration command failed")
+				answer = "error: " + err.Error()
+			}
+
+			bench.publishData(answer, mqttSubchannelCalibrationWizardStatus)
+		}()
+	})
+}
+
+// Calibration wizard by command line, guides the operator through the procedure
+func runCalibrationCommandLine(args []string) bool {
+	if len(args) == 0 {
+		fmt.Println("Uso: unbrake-local calibrate <canal> [bancada|porta]")
+		fmt.Println("Canais: speed, temperature1, temperature2, force1, force2, vibration, pressure")
+		return false
+	}
+
+	var arg string
+	if len(args) > 1 {
+		arg = args[1]
+	}
+	bench, serialPortName := commandLineBench(arg)
+
+	if err := bench.port.Open(serialPortName); err != nil {
+		fmt.Println("Não foi possível abrir a porta serial: ", err)
+		return false
+	}
+	defer bench.port.Close()
+
+	if !bench.isCorrectDevice() {
+		fmt.Println("A porta selecionada não é do simulador de frenagem")
+		return false
+	}
+
+	defer bench.acquireInBackground()()
+
+	if err := bench.wizard.Start(args[0]); err != nil {
+		fmt.Println("Erro: ", err)
+		return false
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for _, step := range []string{"zero", "span"} {
+		fmt.Printf("Aplique a referência de %v, digite seu valor e pressione Enter: ", step)
+		if !scanner.Scan() {
+			return false
+		}
+
+		fmt.Printf("Amostrando por %v...\n", wizardSamplingTime)
+		if _, err := bench.handleCalibrationCommand(step + " " + strings.TrimSpace(scanner.Text())); err != nil {
+			fmt.Println("Erro: ", err)
+			return false
+		}
+	}
+
+	answer, err := bench.handleCalibrationCommand("finish")
+	if err != nil {
+		fmt.Println("Erro: ", err)
+		return false
+	}
+	fmt.Println(answer)
+
+	return false
+}